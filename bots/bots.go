@@ -0,0 +1,25 @@
+// Package bots 運行在服務器進程內的機器人
+package bots
+
+import (
+	"fmt"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// factories 可用的機器人，key 為設定檔 bots 中使用的名稱
+var factories = map[string]func() logic.Bot{
+	"remind": NewRemindBot,
+}
+
+// Register 按名稱註冊機器人
+func Register(names []string) error {
+	for _, name := range names {
+		factory, ok := factories[name]
+		if !ok {
+			return fmt.Errorf("unknown bot: %s", name)
+		}
+		logic.RegisterBot(factory())
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package bots
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// 提醒時間的上限
+const maxRemindAfter = 24 * time.Hour
+
+// 每個用戶以及所有用戶等待中的提醒數量上限，每個提醒都佔用一個計時器
+const (
+	maxRemindersPerUser = 10
+	maxReminders        = 10000
+)
+
+// remindBot 示例機器人：
+//   - /remind <時長> <內容>：到時以私聊提醒，例如 /remind 10m 開會
+//   - 房間中有人說 ping 時，以 🏓 回應
+type remindBot struct {
+	logic.BaseBot
+
+	// 保護 pending、total
+	mu sync.Mutex
+	// 各 UID 等待中的提醒數量
+	pending map[int]int
+	total   int
+}
+
+// NewRemindBot 創建提醒機器人
+func NewRemindBot() logic.Bot {
+	return &remindBot{pending: make(map[int]int)}
+}
+
+func (b *remindBot) Name() string {
+	return "reminder"
+}
+
+func (b *remindBot) Commands() []*logic.BotCommand {
+	return []*logic.BotCommand{
+		{
+			Name:   "remind",
+			Usage:  "/remind <時長，例如 10m> <內容>",
+			Role:   logic.RoleUser,
+			Handle: b.remind,
+		},
+	}
+}
+
+func (b *remindBot) Patterns() []*logic.BotPattern {
+	return []*logic.BotPattern{
+		{
+			Regexp: regexp.MustCompile(`(?i)^\s*ping\s*$`),
+			Handle: b.pong,
+		},
+	}
+}
+
+func (b *remindBot) remind(c *logic.BotContext, msg *logic.Message, args []string) {
+	if len(args) < 2 {
+		c.Reply(msg, "用法：/remind <時長，例如 10m> <內容>")
+		return
+	}
+
+	after, err := time.ParseDuration(args[0])
+	if err != nil || after <= 0 || after > maxRemindAfter {
+		c.Reply(msg, "時長格式錯誤，例如 30s、10m、1h30m，最長 24h")
+		return
+	}
+
+	uid := msg.User.UID
+	b.mu.Lock()
+	if b.pending[uid] >= maxRemindersPerUser || b.total >= maxReminders {
+		b.mu.Unlock()
+		c.Reply(msg, fmt.Sprintf("等待中的提醒太多，每人最多 %d 個，請稍後再試", maxRemindersPerUser))
+		return
+	}
+	b.pending[uid]++
+	b.total++
+	b.mu.Unlock()
+
+	nickname := msg.User.NickName
+	text := strings.Join(args[1:], " ")
+	time.AfterFunc(after, func() {
+		b.mu.Lock()
+		if b.pending[uid]--; b.pending[uid] == 0 {
+			delete(b.pending, uid)
+		}
+		b.total--
+		b.mu.Unlock()
+
+		c.DirectMessage(nickname, "提醒："+text)
+	})
+
+	c.Reply(msg, fmt.Sprintf("好的，%s 後提醒您：%s", after, text))
+}
+
+func (b *remindBot) pong(c *logic.BotContext, msg *logic.Message, args []string) {
+	c.React(msg, "🏓")
+}
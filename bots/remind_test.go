@@ -0,0 +1,183 @@
+package bots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/rorast/go-chatroom/transport"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chatroom-bots-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = logic.OpenStore(filepath.Join(dir, "chatroom.db")); err != nil {
+		log.Fatal(err)
+	}
+	if err = Register([]string{"remind"}); err != nil {
+		log.Fatal(err)
+	}
+	if err = logic.StartBots(); err != nil {
+		log.Fatal(err)
+	}
+	go logic.Broadcaster.Start()
+
+	code := m.Run()
+
+	logic.CloseStore()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeUser 在房間 room 中的用戶，測試直接調用 HandleClientMessage 代替讀取連接，從內存管道讀取發給他的消息
+type fakeUser struct {
+	t    *testing.T
+	user *logic.User
+	pipe *transport.Pipe
+	room string
+}
+
+// newRoom 每個測試使用新的房間，避免加入房間時補發的最近消息來自之前的測試
+func newRoom() string {
+	return fmt.Sprintf("test-%d", time.Now().UnixNano())
+}
+
+func enter(t *testing.T, nickname, room string) *fakeUser {
+	t.Helper()
+
+	ident, err := logic.AuthenticateToken("", nickname, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUser{t: t, pipe: transport.NewPipe(64), room: room}
+	f.user = logic.NewUser(f.pipe, ident, "fake")
+	go f.user.SendMessage(context.Background())
+
+	logic.Broadcaster.UserEntering(f.user)
+	if err = logic.Broadcaster.JoinRoom(f.user, room); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logic.Broadcaster.UserLeaving(f.user) })
+	return f
+}
+
+func (f *fakeUser) say(content string) {
+	f.user.HandleClientMessage(map[string]string{"room": f.room, "content": content})
+}
+
+// expect 讀取消息直到 match 返回 true，超時則測試失敗
+func (f *fakeUser) expect(wait time.Duration, match func(*logic.Message) bool) *logic.Message {
+	f.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	for {
+		msg, err := f.pipe.Receive(ctx)
+		if err != nil {
+			f.t.Fatalf("%s: expected message not received: %v", f.user.NickName, err)
+		}
+		if match(msg) {
+			return msg
+		}
+	}
+}
+
+// fromBot 匹配機器人發給 nickname 的私聊
+func fromBot(nickname string) func(*logic.Message) bool {
+	return func(msg *logic.Message) bool {
+		return msg.To == nickname && msg.User.NickName == "reminder"
+	}
+}
+
+func TestRemind(t *testing.T) {
+	alice := enter(t, "alice", newRoom())
+
+	alice.say("/remind 50ms 開會")
+	ack := alice.expect(time.Second, fromBot("alice"))
+	if ack.Content != "好的，50ms 後提醒您：開會" {
+		t.Errorf("ack = %q", ack.Content)
+	}
+	reminder := alice.expect(time.Second, fromBot("alice"))
+	if reminder.Content != "提醒：開會" {
+		t.Errorf("reminder = %q", reminder.Content)
+	}
+}
+
+func TestRemindUsage(t *testing.T) {
+	bob := enter(t, "bob", newRoom())
+
+	bob.say("/remind soon 開會")
+	if msg := bob.expect(time.Second, fromBot("bob")); msg.Content != "時長格式錯誤，例如 30s、10m、1h30m，最長 24h" {
+		t.Errorf("reply = %q", msg.Content)
+	}
+	bob.say("/remind 10m")
+	if msg := bob.expect(time.Second, fromBot("bob")); msg.Content != "用法：/remind <時長，例如 10m> <內容>" {
+		t.Errorf("reply = %q", msg.Content)
+	}
+}
+
+func TestRemindLimit(t *testing.T) {
+	erin := enter(t, "erin", newRoom())
+
+	// 指令與發言共用頻率限制，被限制時等待令牌補充後重試
+	command := func() *logic.Message {
+		for {
+			erin.say("/remind 1h 開會")
+			msg := erin.expect(time.Second, func(msg *logic.Message) bool {
+				return fromBot("erin")(msg) || msg.Type == logic.MsgTypeError
+			})
+			if msg.Type != logic.MsgTypeError {
+				return msg
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	for i := 0; i < maxRemindersPerUser; i++ {
+		command()
+	}
+	if msg := command(); msg.Content != "等待中的提醒太多，每人最多 10 個，請稍後再試" {
+		t.Errorf("reply = %q", msg.Content)
+	}
+}
+
+func TestPingReaction(t *testing.T) {
+	room := newRoom()
+	carol := enter(t, "carol", room)
+	dave := enter(t, "dave", room)
+
+	carol.say("ping")
+	ping := dave.expect(time.Second, func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeNormal && msg.User.NickName == "carol"
+	})
+
+	// 房間中所有人（包括發送者）都看到機器人的回應
+	for _, f := range []*fakeUser{carol, dave} {
+		reaction := f.expect(time.Second, func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeReaction })
+		if reaction.User.NickName != "reminder" || reaction.Content != "🏓" || reaction.ReplyTo != ping.ID {
+			t.Errorf("%s: reaction = %s %q reply to %q, want reminder 🏓 reply to %q",
+				f.user.NickName, reaction.User.NickName, reaction.Content, reaction.ReplyTo, ping.ID)
+		}
+	}
+}
+
+func TestBotNameReserved(t *testing.T) {
+	if _, err := logic.AuthenticateToken("", "reminder", true); err == nil {
+		t.Error("a guest can use the bot's nickname")
+	}
+	if _, err := logic.Accounts.Register("reminder", "secret-password"); err == nil {
+		t.Error("the bot's nickname can be registered")
+	}
+	if _, err := logic.BindIdentity("proxy", "reminder", "reminder", logic.RoleUser); err == nil {
+		t.Error("an external identity can use the bot's nickname")
+	}
+	if logic.Broadcaster.CanEnterRoom("reminder") {
+		t.Error("the bot's nickname can enter the chatroom")
+	}
+}
@@ -0,0 +1,133 @@
+// chatctl 聊天室的管理工具。
+//
+// export、import 直接讀寫數據庫文件，使用前需要先停止聊天室服務（數據庫文件有排他鎖）：
+//
+//	chatctl export -room lobby -since 2024-01-01 -until 2024-02-01 -format html -o lobby.html
+//	chatctl import -room demo lobby.jsonl
+//
+// replay 以模擬用戶的身份把聊天記錄重新發送到運行中的聊天室，用於演示或重現問題：
+//
+//	chatctl replay -speed 10 -prefix bot- lobby.jsonl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/rorast/go-chatroom/global"
+	"github.com/rorast/go-chatroom/logic"
+)
+
+type subcommand struct {
+	// 參數為子命令之後的命令行參數
+	run  func(args []string) error
+	help string
+	// 是否需要打開數據庫
+	store bool
+}
+
+var subcommands = map[string]*subcommand{
+	"export": {run: exportCommand, help: "導出房間的聊天記錄", store: true},
+	"import": {run: importCommand, help: "把 JSON Lines 聊天記錄導入消息歷史", store: true},
+	"replay": {run: replayCommand, help: "把 JSON Lines 聊天記錄重放到運行中的聊天室"},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "用法：chatctl <子命令> [參數]")
+	fmt.Fprintln(os.Stderr, "子命令：")
+	for _, name := range []string{"export", "import", "replay"} {
+		fmt.Fprintf(os.Stderr, "  %s  %s\n", name, subcommands[name].help)
+	}
+	fmt.Fprintln(os.Stderr, "使用 chatctl <子命令> -h 查看子命令的參數")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := subcommands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	global.Init()
+	if cmd.store {
+		if err := logic.OpenStore(global.DBPath); err != nil {
+			log.Fatal("open store error: ", err, "（聊天室服務是否仍在運行？）")
+		}
+		defer logic.CloseStore()
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		log.Print(err)
+		logic.CloseStore()
+		os.Exit(1)
+	}
+}
+
+// openInput 打開輸入文件，name 為空或 - 時使用標準輸入
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "" || name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	room := fs.String("room", logic.DefaultRoom, "房間")
+	since := fs.String("since", "", "開始時間（包含），RFC 3339、日期或 Unix 秒數")
+	until := fs.String("until", "", "結束時間（不包含），格式同 -since")
+	format := fs.String("format", logic.ExportJSONL, "導出格式：jsonl、csv、text、html")
+	system := fs.Bool("system", false, "包含進出房間的消息")
+	output := fs.String("o", "", "輸出文件，預設輸出到標準輸出")
+	fs.Parse(args)
+
+	opts := &logic.ExportOptions{Room: *room, Format: *format, IncludeSystem: *system}
+	var err error
+	if *since != "" {
+		if opts.Since, err = logic.ParseTime(*since); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if opts.Until, err = logic.ParseTime(*until); err != nil {
+			return err
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return logic.ExportHistory(w, opts)
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	room := fs.String("room", "", "全部導入到該房間，預設使用記錄中的房間")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "用法：chatctl import [參數] [文件]，文件為空或 - 時讀取標準輸入")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	n, err := logic.ImportHistory(in, *room)
+	log.Printf("imported %d messages", n)
+	return err
+}
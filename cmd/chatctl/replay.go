@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// replayUser 重放時模擬的一個用戶
+type replayUser struct {
+	conn  *websocket.Conn
+	rooms map[string]bool
+}
+
+// replayer 按記錄中的時間間隔（除以 speed）發送消息，每個作者一個 WebSocket 連接
+type replayer struct {
+	addr   string
+	prefix string
+	room   string
+	speed  float64
+	maxGap time.Duration
+
+	ctx   context.Context
+	users map[string]*replayUser
+	// 連接失敗的作者，之後的消息直接跳過
+	failed map[string]bool
+	sent   int
+	// 以 / 開頭、會被當作指令執行而跳過的消息數量
+	skipped int
+}
+
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	r := &replayer{}
+	fs.StringVar(&r.addr, "addr", "ws://127.0.0.1:2066/ws", "聊天室的 WebSocket 地址")
+	fs.StringVar(&r.prefix, "prefix", "", "模擬用戶昵稱的前綴，避免與真實用戶衝突")
+	fs.StringVar(&r.room, "room", "", "全部重放到該房間，預設使用記錄中的房間")
+	fs.Float64Var(&r.speed, "speed", 1, "重放速度倍數，0 表示不等待")
+	fs.DurationVar(&r.maxGap, "max-gap", 0, "兩條消息之間最長的等待時間，0 表示不限制")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "用法：chatctl replay [參數] [文件]，文件為空或 - 時讀取標準輸入")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r.ctx = context.Background()
+	r.users = make(map[string]*replayUser)
+	r.failed = make(map[string]bool)
+	defer r.closeAll()
+
+	var last time.Time
+	err = logic.ReadTranscript(in, func(record *logic.ExportRecord) error {
+		if !last.IsZero() && r.speed > 0 {
+			gap := time.Duration(float64(record.Time.Sub(last)) / r.speed)
+			if r.maxGap > 0 && gap > r.maxGap {
+				gap = r.maxGap
+			}
+			time.Sleep(gap)
+		}
+		last = record.Time
+		if r.room != "" {
+			record.Room = r.room
+		}
+		return r.replay(record)
+	})
+	log.Printf("replayed %d messages, skipped %d", r.sent, r.skipped)
+	return err
+}
+
+// replay 以記錄作者的身份重放一條記錄
+func (r *replayer) replay(record *logic.ExportRecord) error {
+	nickname := r.prefix + record.Author
+	if r.failed[nickname] {
+		return nil
+	}
+
+	var content string
+	switch record.Type {
+	case "message":
+		// 以 / 開頭的內容會被服務器當作指令執行，不重放
+		if logic.IsCommand(record.Content) {
+			r.skipped++
+			return nil
+		}
+		content = record.Content
+	case "action":
+		content = "/me " + record.Content
+	case "enter":
+		_, err := r.join(nickname, record.Room)
+		return err
+	case "leave":
+		return r.part(nickname, record.Room)
+	default:
+		// 回應指向的消息編號在重放後會改變，設置話題需要管理員，都無法重放
+		return nil
+	}
+
+	u, err := r.join(nickname, record.Room)
+	if u == nil {
+		return err
+	}
+	if err = wsjson.Write(r.ctx, u.conn, map[string]string{"room": record.Room, "content": content}); err != nil {
+		return err
+	}
+	r.sent++
+	return nil
+}
+
+// join 確保用戶已連接並加入房間，連接失敗時只記錄日誌並跳過該用戶，返回 nil
+func (r *replayer) join(nickname, room string) (*replayUser, error) {
+	u := r.users[nickname]
+	if u == nil {
+		ctx, cancel := context.WithTimeout(r.ctx, 10*time.Second)
+		conn, _, err := websocket.Dial(ctx, r.addr+"?nickname="+url.QueryEscape(nickname), nil)
+		cancel()
+		if err != nil {
+			log.Println("connect", nickname, "error:", err)
+			r.failed[nickname] = true
+			return nil, nil
+		}
+		// 服務器先接受連接再認證，第一條消息是歡迎消息時才算進入，否則是認證失敗的原因（例如昵稱已註冊）
+		if err = readWelcome(r.ctx, conn); err != nil {
+			log.Println("connect", nickname, "error:", err)
+			conn.Close(websocket.StatusNormalClosure, "")
+			r.failed[nickname] = true
+			return nil, nil
+		}
+		u = &replayUser{conn: conn, rooms: map[string]bool{logic.DefaultRoom: true}}
+		r.users[nickname] = u
+		go discard(r.ctx, nickname, conn)
+	}
+
+	if !u.rooms[room] {
+		if err := wsjson.Write(r.ctx, u.conn, map[string]string{"type": "join", "room": room}); err != nil {
+			return nil, err
+		}
+		u.rooms[room] = true
+	}
+	return u, nil
+}
+
+// part 離開房間，不在任何房間中時斷開連接
+func (r *replayer) part(nickname, room string) error {
+	u := r.users[nickname]
+	if u == nil || !u.rooms[room] {
+		return nil
+	}
+	delete(u.rooms, room)
+	if len(u.rooms) == 0 {
+		delete(r.users, nickname)
+		return u.conn.Close(websocket.StatusNormalClosure, "")
+	}
+	return wsjson.Write(r.ctx, u.conn, map[string]string{"type": "part", "room": room})
+}
+
+func (r *replayer) closeAll() {
+	// 等待最後的消息發送完
+	time.Sleep(time.Second)
+	for _, u := range r.users {
+		u.conn.Close(websocket.StatusNormalClosure, "")
+	}
+}
+
+// readWelcome 讀取連接後的第一條消息，不是歡迎消息時返回 error
+func readWelcome(ctx context.Context, conn *websocket.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var msg logic.Message
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		return err
+	}
+	if msg.Type != logic.MsgTypeWelcome {
+		return errors.New(msg.Content)
+	}
+	return nil
+}
+
+// discard 讀取並丟棄服務器發來的消息，只打印錯誤消息
+func discard(ctx context.Context, nickname string, conn *websocket.Conn) {
+	for {
+		var msg logic.Message
+		if err := wsjson.Read(ctx, conn, &msg); err != nil {
+			return
+		}
+		if msg.Type == logic.MsgTypeError {
+			log.Println(nickname+":", msg.Content)
+		}
+	}
+}
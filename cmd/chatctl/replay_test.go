@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// fakeChatroom 模擬聊天室的 WebSocket 接口：與服務器一樣先接受連接再認證，昵稱為 reserved 時返回錯誤
+type fakeChatroom struct {
+	reserved string
+
+	mu       sync.Mutex
+	received []string // 昵稱: 內容
+}
+
+func (f *fakeChatroom) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	ctx := req.Context()
+
+	nickname := req.FormValue("nickname")
+	if nickname == f.reserved {
+		wsjson.Write(ctx, conn, logic.NewErrorMessage("該昵稱已經註冊，請先登入"))
+		return
+	}
+	wsjson.Write(ctx, conn, &logic.Message{User: &logic.User{NickName: nickname}, Type: logic.MsgTypeWelcome})
+	for {
+		var msg map[string]string
+		if err := wsjson.Read(ctx, conn, &msg); err != nil {
+			return
+		}
+		if msg["content"] != "" {
+			f.mu.Lock()
+			f.received = append(f.received, nickname+": "+msg["content"])
+			f.mu.Unlock()
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	chatroom := &fakeChatroom{reserved: "carol"}
+	srv := httptest.NewServer(chatroom)
+	t.Cleanup(srv.Close)
+
+	now := time.Now()
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	for i, r := range []*logic.ExportRecord{
+		{Type: "message", Author: "carol", Content: "hi"},
+		{Type: "message", Author: "dave", Content: "/nick evil"},
+		{Type: "topic", Author: "dave", Content: "new topic"},
+		{Type: "message", Author: "dave", Content: "hello"},
+		{Type: "action", Author: "dave", Content: "waves"},
+	} {
+		r.Time, r.Room = now.Add(time.Duration(i)*time.Millisecond), logic.DefaultRoom
+		enc.Encode(r)
+	}
+	file := filepath.Join(t.TempDir(), "lobby.jsonl")
+	if err := os.WriteFile(file, []byte(sb.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 作者的昵稱被拒絕時跳過該作者，不中止重放
+	addr := "ws" + strings.TrimPrefix(srv.URL, "http")
+	if err := replayCommand([]string{"-addr", addr, "-speed", "0", file}); err != nil {
+		t.Fatal(err)
+	}
+
+	chatroom.mu.Lock()
+	defer chatroom.mu.Unlock()
+	if got := strings.Join(chatroom.received, "\n"); got != "dave: hello\ndave: /me waves" {
+		t.Errorf("received:\n%s\nwant only the plain message and the action from dave", got)
+	}
+}
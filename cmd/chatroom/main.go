@@ -3,12 +3,12 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/http"
-
-	_ "net/http/pprof"
 
+	"github.com/rorast/go-chatroom/bots"
 	"github.com/rorast/go-chatroom/global"
+	"github.com/rorast/go-chatroom/logic"
 	"github.com/rorast/go-chatroom/server"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -30,9 +30,35 @@ func init() {
 }
 
 func main() {
-	fmt.Printf(banner, addr)
+	if viper.GetBool("tls.enable") {
+		fmt.Printf(banner, viper.GetString("tls.addr")+" (TLS)")
+	} else {
+		fmt.Printf(banner, addr)
+	}
+
+	if err := logic.OpenStore(global.DBPath); err != nil {
+		log.Fatal("open store error:", err)
+	}
+
+	// 進程內機器人需要在 RegisterHandle 啟動它們之前註冊
+	if err := bots.Register(viper.GetStringSlice("bots")); err != nil {
+		log.Fatal(err)
+	}
 
 	server.RegisterHandle()
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	// 行模式 TCP 聊天服務，與 WebSocket 用戶共用聊天室
+	if tcpAddr := viper.GetString("tcp.addr"); tcpAddr != "" {
+		go func() {
+			log.Fatal(server.ServeTCP(tcpAddr))
+		}()
+	}
+
+	if ircAddr := viper.GetString("irc.addr"); ircAddr != "" {
+		go func() {
+			log.Fatal(server.ServeIRC(ircAddr))
+		}()
+	}
+
+	log.Fatal(server.ListenAndServe(addr))
 }
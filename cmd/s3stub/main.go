@@ -0,0 +1,200 @@
+// s3stub 本地測試用的 S3 兼容服務，內容只保存在內存中。
+// 支持 path-style 的 PUT、GET、HEAD，並校驗 AWS Signature Version 4 簽名和請求體的 SHA-256。
+// 簽名按請求中的 SignedHeaders 獨立計算，不使用 logic 中的簽名代碼，可以用來檢查客戶端的簽名是否正確。
+//
+//	go run ./cmd/s3stub -addr :9001 -access-key test -secret-key test-secret
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	addr      string
+	accessKey string
+	secretKey string
+)
+
+func init() {
+	flag.StringVar(&addr, "addr", ":9001", "監聽地址")
+	flag.StringVar(&accessKey, "access-key", "test", "access key")
+	flag.StringVar(&secretKey, "secret-key", "test-secret", "secret key")
+}
+
+type object struct {
+	data        []byte
+	contentType string
+}
+
+var (
+	mu      sync.Mutex
+	objects = make(map[string]*object)
+)
+
+func main() {
+	flag.Parse()
+	http.HandleFunc("/", handle)
+	log.Println("s3stub listen on", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+func handle(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if code, err := verify(req, body); err != nil {
+		s3Error(w, http.StatusForbidden, code, err.Error())
+		return
+	}
+
+	key := req.URL.Path
+	log.Println(req.Method, key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch req.Method {
+	case http.MethodPut:
+		objects[key] = &object{data: body, contentType: req.Header.Get("Content-Type")}
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if req.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+	}
+}
+
+// verify 校驗請求體的 SHA-256 和 Authorization 中的簽名
+func verify(req *http.Request, body []byte) (string, error) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+	credential := fields["Credential"]
+	access, scope, _ := strings.Cut(credential, "/")
+	if access != accessKey || len(strings.Split(scope, "/")) != 4 {
+		return "InvalidAccessKeyId", fmt.Errorf("unknown credential: %s", credential)
+	}
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return "XAmzContentSHA256Mismatch", fmt.Errorf("payload hash mismatch")
+	}
+	t, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "AccessDenied", fmt.Errorf("invalid X-Amz-Date")
+	}
+	if d := time.Since(t); d > 15*time.Minute || d < -15*time.Minute {
+		return "RequestTimeTooSkewed", fmt.Errorf("request time too skewed")
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if !hasHeader(signedHeaders, "host") || !hasHeader(signedHeaders, "x-amz-date") || !hasHeader(signedHeaders, "x-amz-content-sha256") {
+		return "AccessDenied", fmt.Errorf("host, x-amz-date and x-amz-content-sha256 must be signed")
+	}
+	want := signature(req, scope, signedHeaders, payloadHash, secretKey)
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(want)) {
+		return "SignatureDoesNotMatch", fmt.Errorf("signature does not match")
+	}
+	return "", nil
+}
+
+func hasHeader(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// signature 按 Signature Version 4 計算請求的簽名，scope 為 日期/區域/服務/aws4_request
+func signature(req *http.Request, scope string, signedHeaders []string, payloadHash, secret string) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	sort.Strings(params)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// uriEncode 按 AWS 的規則編碼：只保留 A-Z a-z 0-9 - _ . ~
+func uriEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
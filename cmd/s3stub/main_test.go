@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/spf13/viper"
+)
+
+func TestSignatureVector(t *testing.T) {
+	// AWS Signature Version 4 測試套件中的 get-vanilla
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	req.Header.Set("X-Amz-Date", "20150830T123600Z")
+	got := signature(req, "20150830/us-east-1/service/aws4_request", []string{"host", "x-amz-date"},
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	if want := "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"; got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+// startAttachments 使用本地的 s3stub 和 secret 啟用附件
+func startAttachments(t *testing.T, endpoint, secret string) {
+	t.Helper()
+
+	viper.Set("attachments.store", "s3")
+	viper.Set("attachments.s3.endpoint", endpoint)
+	viper.Set("attachments.s3.bucket", "chatroom")
+	viper.Set("attachments.s3.access-key", accessKey)
+	viper.Set("attachments.s3.secret-key", secret)
+	if err := logic.Attachments.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	if err := logic.OpenStore(filepath.Join(t.TempDir(), "chatroom.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logic.CloseStore() })
+	srv := httptest.NewServer(http.HandlerFunc(handle))
+	t.Cleanup(srv.Close)
+
+	img := image.NewGray(image.Rect(0, 0, 600, 300))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// 密鑰錯誤時 s3stub 拒絕簽名
+	startAttachments(t, srv.URL, "wrong-secret")
+	if _, err := logic.Attachments.Upload("photo.png", bytes.NewReader(data)); err == nil {
+		t.Fatal("upload signed with a wrong secret succeeded")
+	}
+
+	startAttachments(t, srv.URL, secretKey)
+	a, err := logic.Attachments.Upload("photo.png", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Thumbnail {
+		t.Errorf("attachment = %+v, want a thumbnail", a)
+	}
+
+	r, _, err := logic.Attachments.Open(a.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("stored content differs from the upload")
+	}
+
+	r, _, err = logic.Attachments.Open(a.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := png.Decode(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := thumb.Bounds(); b.Dx() != 256 || b.Dy() != 128 {
+		t.Errorf("thumbnail size = %v, want 256x128", b.Size())
+	}
+}
@@ -1,19 +1,28 @@
 // Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
 // License: https://creativecommons.org/licenses/by-nc-sa/4.0/
 
+// tcp 是聊天室行模式 TCP 服務（設定檔 tcp.addr）的簡單客戶端：
+// 把標準輸入逐行發給服務器，並把服務器的輸出打印到標準輸出，與 telnet / nc 的用法相同。
+//
+//	go run ./cmd/tcp -addr localhost:2020
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
 	"net"
 	"os"
 )
 
+var addr = flag.String("addr", "localhost:2020", "聊天室 TCP 服務的地址")
+
 func main() {
-	conn, err := net.Dial("tcp", ":2020")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *addr)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	done := make(chan struct{})
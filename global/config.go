@@ -1,6 +1,8 @@
 package global
 
 import (
+	"path/filepath"
+
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
@@ -9,6 +11,9 @@ var (
 	SensitiveWords []string
 
 	MessageQueueLen = 1024
+
+	// 嵌入式數據庫文件路徑
+	DBPath string
 )
 
 func initConfig() {
@@ -22,6 +27,11 @@ func initConfig() {
 	SensitiveWords = viper.GetStringSlice("sensitive")
 	MessageQueueLen = viper.GetInt("message-queue")
 
+	DBPath = viper.GetString("db-path")
+	if !filepath.IsAbs(DBPath) {
+		DBPath = filepath.Join(RootDir, DBPath)
+	}
+
 	viper.WatchConfig()
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		viper.ReadInConfig()
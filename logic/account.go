@@ -0,0 +1,233 @@
+package logic
+
+/*
+用戶帳號：
+1、帳號以昵稱為 key 存放在 accounts bucket 中，密碼只保存 bcrypt 雜湊值。
+2、UID 由 accounts bucket 的自增序列分配，遊客和註冊用戶共用同一個序列，
+   因此重啟服務後 UID 不會被不同的人重複使用。
+3、已註冊的昵稱只能通過 POST /login 取得的 token 進入聊天室。
+4、所有帳號的昵稱和 UID 在打開存儲時加載到內存，註冊和改名時同步更新，
+   廣播器判斷已知用戶時使用 UID，不需要在廣播器 goroutine 中讀數據庫。
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var accountBucket = []byte("accounts")
+
+var (
+	errAccountExists    = errors.New("該昵稱已經註冊")
+	errAccountLogin     = errors.New("昵稱或密碼錯誤")
+	errPasswordTooShort = errors.New("密碼長度不能少於 6 位")
+	errNicknameReserved = errors.New("該昵稱已經註冊，請先登入")
+	errGuestNotAllowed  = errors.New("不允許遊客進入，請先登入")
+	errBotNickname      = errors.New("該昵稱已被機器人使用")
+)
+
+// Account 註冊用戶帳號
+type Account struct {
+	UID          int       `json:"uid"`
+	NickName     string    `json:"nickname"`
+	PasswordHash []byte    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type accountStore struct {
+	mu sync.RWMutex
+	// key 為昵稱，value 為帳號的 UID
+	uids map[string]int
+}
+
+var Accounts = &accountStore{uids: make(map[string]int)}
+
+// load 加載所有帳號的昵稱和 UID
+func (s *accountStore) load() error {
+	uids := make(map[string]int)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountBucket).ForEach(func(k, v []byte) error {
+			var account Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return err
+			}
+			uids[string(k)] = account.UID
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.uids = uids
+	s.mu.Unlock()
+	return nil
+}
+
+// UID 昵稱已註冊時返回帳號的 UID，只讀內存，可以在廣播器 goroutine 中調用
+func (s *accountStore) UID(nickname string) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uid, ok := s.uids[nickname]
+	return uid, ok
+}
+
+// NextUID 分配一個新的 UID
+func (s *accountStore) NextUID() (int, error) {
+	if db == nil {
+		return 0, errStoreClosed
+	}
+
+	var uid uint64
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		uid, err = tx.Bucket(accountBucket).NextSequence()
+		return err
+	})
+	return int(uid), err
+}
+
+// Get 按昵稱查找帳號，不存在時返回 nil
+func (s *accountStore) Get(nickname string) (*Account, error) {
+	if db == nil {
+		return nil, errStoreClosed
+	}
+
+	var account *Account
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(accountBucket).Get([]byte(nickname))
+		if v == nil {
+			return nil
+		}
+		account = new(Account)
+		return json.Unmarshal(v, account)
+	})
+	return account, err
+}
+
+// Register 註冊帳號
+func (s *accountStore) Register(nickname, password string) (*Account, error) {
+	if err := CheckNickname(nickname); err != nil {
+		return nil, err
+	}
+	if isBotName(nickname) {
+		return nil, errBotNickname
+	}
+	if len(password) < 6 {
+		return nil, errPasswordTooShort
+	}
+	if db == nil {
+		return nil, errStoreClosed
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &Account{
+		NickName:     nickname,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountBucket)
+		if b.Get([]byte(nickname)) != nil {
+			return errAccountExists
+		}
+
+		uid, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		account.UID = int(uid)
+
+		v, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(nickname), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.uids[nickname] = account.UID
+	s.mu.Unlock()
+	return account, nil
+}
+
+// Login 驗證密碼，成功時返回帳號和新簽發的 token
+func (s *accountStore) Login(nickname, password string) (*Account, string, error) {
+	account, err := s.Get(nickname)
+	if err != nil {
+		return nil, "", err
+	}
+	if account == nil {
+		// 帳號不存在時也做一次雜湊比較，避免通過響應時間探測哪些昵稱已註冊
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, "", errAccountLogin
+	}
+	if bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(password)) != nil {
+		return nil, "", errAccountLogin
+	}
+
+	return account, genToken(account.UID, account.NickName), nil
+}
+
+// Rename 帳號跟隨用戶改名，uid 不匹配時表示 oldNickname 不屬於該用戶，不做處理
+func (s *accountStore) Rename(uid int, oldNickname, newNickname string) error {
+	if db == nil {
+		return errStoreClosed
+	}
+
+	renamed := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(accountBucket)
+		if b.Get([]byte(newNickname)) != nil {
+			return errAccountExists
+		}
+
+		v := b.Get([]byte(oldNickname))
+		if v == nil {
+			return nil
+		}
+		var account Account
+		if err := json.Unmarshal(v, &account); err != nil {
+			return err
+		}
+		if account.UID != uid {
+			return nil
+		}
+
+		account.NickName = newNickname
+		v, err := json.Marshal(&account)
+		if err != nil {
+			return err
+		}
+		if err = b.Delete([]byte(oldNickname)); err != nil {
+			return err
+		}
+		renamed = true
+		return b.Put([]byte(newNickname), v)
+	})
+	if err != nil || !renamed {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.uids, oldNickname)
+	s.uids[newNickname] = uid
+	s.mu.Unlock()
+	return nil
+}
+
+// dummyPasswordHash 與真實密碼相同 cost 的 bcrypt 雜湊值，用於帳號不存在時的比較
+var dummyPasswordHash = []byte("$2a$10$1bKMFIGVGrR8w0MxBhwLZ.L1JrLpnsIuG/ZH2MwyHjzx6XWANKG2W")
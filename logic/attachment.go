@@ -0,0 +1,433 @@
+package logic
+
+/*
+附件：用戶通過 POST /upload 上傳文件，得到附件編號後，在發送房間消息時以 {"attachments": "編號1,編號2"} 附帶。
+
+1、附件編號為文件內容的 SHA-256，相同內容的文件只保存一份，文件名、類型等元數據使用第一次上傳時的值。
+2、文件類型按內容識別（不信任客戶端聲明的類型），只允許 attachments.allowed-types 中的類型，
+   大小不能超過 attachments.max-size。
+3、JPEG、PNG、GIF 圖片記錄寬高，大於 attachments.thumbnail-size 時生成縮略圖，key 為 thumb/ 編號。
+   解碼圖片最多佔用約 64 MB 內存，同時生成縮略圖的數量不超過 attachments.thumbnail-workers。
+4、元數據保存在 attachments bucket 中；附件不隨消息歷史的保留策略刪除，因為同一個附件可能被多條消息引用。
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var attachmentBucket = []byte("attachments")
+
+// 生成縮略圖時允許解碼的最大像素數（約 1600 萬），避免超大圖片耗盡內存
+const maxThumbnailPixels = 16 << 20
+
+// 縮略圖每個像素在每個方向上最多採樣的源像素數
+const thumbnailSamples = 4
+
+var (
+	errAttachmentsDisabled = errors.New("附件功能未啟用")
+	// ErrAttachmentEmpty 上傳的文件為空
+	ErrAttachmentEmpty = errors.New("文件內容不能為空")
+	// ErrAttachmentNotFound 附件不存在或附件功能未啟用
+	ErrAttachmentNotFound = errors.New("附件不存在")
+	// ErrAttachmentTooLarge 文件超過大小限制
+	ErrAttachmentTooLarge = errors.New("文件太大")
+	// ErrAttachmentType 不允許的文件類型
+	ErrAttachmentType = errors.New("不支持的文件類型")
+)
+
+// Attachment 附件的元數據
+type Attachment struct {
+	// 文件內容 SHA-256 的十六進制
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Thumbnail   bool      `json:"thumbnail,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ThumbnailType 縮略圖的類型：JPEG 圖片的縮略圖為 JPEG，其他為 PNG
+func (a *Attachment) ThumbnailType() string {
+	if a.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// IsImage 是否是圖片
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// attachmentKey 附件內容在 blob store 中的 key
+func attachmentKey(id string, thumb bool) string {
+	if thumb {
+		return "thumb/" + id
+	}
+	return id
+}
+
+// validAttachmentID 附件編號必須是 64 位小寫十六進制，同時防止拼接 key 時出現路徑
+func validAttachmentID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type attachmentService struct {
+	store         BlobStore
+	maxSize       int64
+	allowedTypes  []string
+	thumbnailSize int
+	maxPerMessage int
+	publicURL     string
+	// 生成縮略圖的並發限制，每個元素代表一個正在解碼的圖片
+	thumbnailSlots chan struct{}
+}
+
+// Attachments 附件服務，需要調用 Start 後才能上傳
+var Attachments = &attachmentService{}
+
+// Start 按設定檔創建 blob store，attachments.store 為空時不啟用附件
+func (s *attachmentService) Start() error {
+	name := viper.GetString("attachments.store")
+	if name == "" {
+		return nil
+	}
+	factory, ok := blobStoreFactories[name]
+	if !ok {
+		return fmt.Errorf("unknown blob store: %s", name)
+	}
+	store, err := factory()
+	if err != nil {
+		return fmt.Errorf("blob store %s: %w", name, err)
+	}
+
+	s.maxSize = viper.GetInt64("attachments.max-size")
+	if s.maxSize <= 0 {
+		s.maxSize = 10 << 20
+	}
+	s.allowedTypes = viper.GetStringSlice("attachments.allowed-types")
+	if len(s.allowedTypes) == 0 {
+		s.allowedTypes = []string{"image/*"}
+	}
+	s.thumbnailSize = viper.GetInt("attachments.thumbnail-size")
+	if s.thumbnailSize <= 0 {
+		s.thumbnailSize = 256
+	}
+	s.maxPerMessage = viper.GetInt("attachments.max-per-message")
+	if s.maxPerMessage <= 0 {
+		s.maxPerMessage = 10
+	}
+	workers := viper.GetInt("attachments.thumbnail-workers")
+	if workers <= 0 {
+		workers = 2
+	}
+	s.thumbnailSlots = make(chan struct{}, workers)
+	s.publicURL = strings.TrimRight(viper.GetString("attachments.public-url"), "/")
+	s.store = store
+	return nil
+}
+
+// Enabled 是否啟用了附件
+func (s *attachmentService) Enabled() bool {
+	return s.store != nil
+}
+
+// MaxSize 單個文件的大小限制
+func (s *attachmentService) MaxSize() int64 {
+	return s.maxSize
+}
+
+// URL 附件的下載地址，沒有配置 attachments.public-url 時為相對地址
+func (s *attachmentService) URL(a *Attachment, thumb bool) string {
+	url := s.publicURL + "/files/" + a.ID
+	if thumb {
+		url += "/thumb"
+	}
+	return url
+}
+
+// allowed 文件類型是否允許上傳，支持 image/* 形式的通配
+func (s *attachmentService) allowed(mediaType string) bool {
+	for _, t := range s.allowedTypes {
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload 保存上傳的文件並返回附件的元數據，內容已存在時直接返回已有的元數據
+func (s *attachmentService) Upload(name string, r io.Reader) (*Attachment, error) {
+	if s.store == nil {
+		return nil, errAttachmentsDisabled
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	if len(data) == 0 {
+		return nil, ErrAttachmentEmpty
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !s.allowed(mediaType) {
+		return nil, ErrAttachmentType
+	}
+
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	if a, err := s.Get(id); err != ErrAttachmentNotFound {
+		return a, err
+	}
+
+	a := &Attachment{
+		ID:          id,
+		Name:        attachmentName(name, id),
+		ContentType: mediaType,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now(),
+	}
+	if err = s.makeThumbnail(a, data); err != nil {
+		return nil, err
+	}
+
+	// 先保存內容再保存元數據，元數據存在時內容一定存在
+	exists, err := s.store.Exists(attachmentKey(id, false))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err = s.store.Put(attachmentKey(id, false), mediaType, data); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(attachmentBucket).Put([]byte(id), v)
+	})
+	return a, err
+}
+
+// attachmentName 去掉文件名中的路徑，過長時截斷，為空時使用編號
+func attachmentName(name, id string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		name = id[:12]
+	}
+	return name
+}
+
+// makeThumbnail 記錄圖片的寬高，圖片大於縮略圖尺寸時生成並保存縮略圖
+func (s *attachmentService) makeThumbnail(a *Attachment, data []byte) error {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// 不是能解碼的圖片（例如 PDF、WebP），不生成縮略圖
+		return nil
+	}
+	a.Width, a.Height = config.Width, config.Height
+	if a.Width <= s.thumbnailSize && a.Height <= s.thumbnailSize || a.Width*a.Height > maxThumbnailPixels {
+		return nil
+	}
+
+	// 解碼後的圖片很大，限制同時解碼的數量，其他上傳等待
+	s.thumbnailSlots <- struct{}{}
+	thumb, err := s.decodeThumbnail(data)
+	<-s.thumbnailSlots
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.store.Put(attachmentKey(a.ID, true), a.ThumbnailType(), buf.Bytes()); err != nil {
+		return err
+	}
+	a.Thumbnail = true
+	return nil
+}
+
+// decodeThumbnail 解碼圖片並生成縮略圖，解碼的圖片在返回後即可回收
+func (s *attachmentService) decodeThumbnail(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return thumbnail(img, s.thumbnailSize), nil
+}
+
+// thumbnail 按比例縮小到長邊為 size，每個像素取對應區域中等距採樣的像素的平均值
+// 採樣數固定，耗時只與縮略圖尺寸有關，不隨源圖片的像素數增長
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := size, size
+	if w > h {
+		th = max(1, h*size/w)
+	} else {
+		tw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy += stride(y1 - y0) {
+				for sx := x0; sx < x1; sx += stride(x1 - x0) {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// stride 在長度為 n 的區間中最多採樣 thumbnailSamples 個像素時的步長
+func stride(n int) int {
+	return max(1, n/thumbnailSamples)
+}
+
+// Get 讀取附件的元數據
+func (s *attachmentService) Get(id string) (*Attachment, error) {
+	if !validAttachmentID(id) {
+		return nil, ErrAttachmentNotFound
+	}
+	if db == nil {
+		return nil, errStoreClosed
+	}
+
+	var a *Attachment
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(attachmentBucket).Get([]byte(id))
+		if v == nil {
+			return ErrAttachmentNotFound
+		}
+		a = new(Attachment)
+		return json.Unmarshal(v, a)
+	})
+	return a, err
+}
+
+// Open 讀取附件或它的縮略圖，調用者負責關閉
+func (s *attachmentService) Open(id string, thumb bool) (io.ReadCloser, *Attachment, error) {
+	if s.store == nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	a, err := s.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if thumb && !a.Thumbnail {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	r, err := s.store.Get(attachmentKey(id, thumb))
+	if err == errBlobNotFound {
+		err = ErrAttachmentNotFound
+	}
+	return r, a, err
+}
+
+// Resolve 解析消息中以逗號分隔的附件編號
+func (s *attachmentService) Resolve(ids string) ([]*Attachment, error) {
+	if s.store == nil {
+		return nil, errAttachmentsDisabled
+	}
+
+	var attachments []*Attachment
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if len(attachments) >= s.maxPerMessage {
+			return nil, fmt.Errorf("一條消息最多附帶 %d 個附件", s.maxPerMessage)
+		}
+		a, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// ContentWithAttachments 消息內容，每個附件附加一行說明，供只能顯示文本的客戶端使用
+func (m *Message) ContentWithAttachments() string {
+	content := m.Content
+	for _, a := range m.Attachments {
+		if content != "" {
+			content += "\n"
+		}
+		content += fmt.Sprintf("[附件] %s (%s) %s", a.Name, formatSize(a.Size), Attachments.URL(a, false))
+	}
+	return content
+}
+
+// formatSize 以 B、KB、MB 顯示文件大小
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -0,0 +1,269 @@
+package logic
+
+/*
+附件的二進制存儲（blob store）：按 key 保存、讀取文件內容，附件的元數據另外保存在 attachments bucket 中。
+
+1、存儲方式在設定檔 attachments.store 中選擇，內置 local（本地目錄）和 s3（S3 兼容的對象存儲，
+   使用 AWS Signature Version 4 簽名，可以對接 MinIO 等服務，也可以用 cmd/s3stub 在本地測試），
+   其他團隊可以通過 RegisterBlobStore 註冊新的存儲方式。
+2、附件按內容的 SHA-256 保存，同一個 key 的內容不會改變，因此寫入前先檢查是否已存在即可去重。
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rorast/go-chatroom/global"
+	"github.com/spf13/viper"
+)
+
+var errBlobNotFound = errors.New("文件不存在")
+
+// BlobStore 附件內容的存儲
+type BlobStore interface {
+	Put(key, contentType string, data []byte) error
+	// Get 讀取內容，不存在時返回 errBlobNotFound
+	Get(key string) (io.ReadCloser, error)
+	Exists(key string) (bool, error)
+}
+
+// blobStoreFactories 存儲方式註冊表，key 為設定檔中使用的名稱
+// 只在啟動階段註冊，運行期間只讀，因此不需要加鎖
+var blobStoreFactories = make(map[string]func() (BlobStore, error))
+
+// RegisterBlobStore 註冊存儲方式，factory 在 Attachments.Start 時調用，可以在其中讀取設定檔
+func RegisterBlobStore(name string, factory func() (BlobStore, error)) {
+	blobStoreFactories[name] = factory
+}
+
+func init() {
+	RegisterBlobStore("local", newLocalBlobStore)
+	RegisterBlobStore("s3", newS3BlobStore)
+}
+
+// localBlobStore 保存在本地目錄中，key 中的 / 對應子目錄
+type localBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore() (BlobStore, error) {
+	dir := viper.GetString("attachments.local.dir")
+	if dir == "" {
+		dir = "data/blobs"
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(global.RootDir, dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func (s *localBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Put 先寫入臨時文件再改名，讀取者不會看到寫了一半的文件
+func (s *localBlobStore) Put(key, contentType string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *localBlobStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// s3BlobStore S3 兼容的對象存儲，使用 path-style 地址：endpoint/bucket/key
+type s3BlobStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3BlobStore() (BlobStore, error) {
+	s := &s3BlobStore{
+		endpoint:  strings.TrimRight(viper.GetString("attachments.s3.endpoint"), "/"),
+		bucket:    viper.GetString("attachments.s3.bucket"),
+		region:    viper.GetString("attachments.s3.region"),
+		accessKey: viper.GetString("attachments.s3.access-key"),
+		secretKey: viper.GetString("attachments.s3.secret-key"),
+	}
+	if s.endpoint == "" || s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("attachments.s3.endpoint, bucket, access-key and secret-key are required")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	timeout := viper.GetDuration("attachments.s3.timeout")
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	s.client = &http.Client{Timeout: timeout}
+	return s, nil
+}
+
+func (s *s3BlobStore) do(method, key, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(body)
+	SignS3Request(req, s.accessKey, s.secretKey, s.region, hex.EncodeToString(sum[:]), time.Now())
+	return s.client.Do(req)
+}
+
+func (s *s3BlobStore) Put(key, contentType string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, contentType, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	defer resp.Body.Close()
+	return nil, s3Error(resp)
+}
+
+func (s *s3BlobStore) Exists(key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, key, "", nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, s3Error(resp)
+}
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(body))
+}
+
+// SignS3Request 使用 AWS Signature Version 4 為 S3 請求簽名，設置 X-Amz-Date、X-Amz-Content-Sha256 和 Authorization 請求頭。
+// payloadHash 為請求體 SHA-256 的十六進制；簽名的請求頭為 host 以及全部 x-amz-* 請求頭
+func SignS3Request(req *http.Request, accessKey, secretKey, region, payloadHash string, t time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, accessKey, secretKey, region, "s3", payloadHash, t)
+}
+
+// signV4 設置 X-Amz-Date，按 Signature Version 4 計算 service 的簽名並設置 Authorization 請求頭
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = macSha256([]byte(part), key)
+	}
+	signature := hex.EncodeToString(macSha256([]byte(stringToSign), key))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,265 @@
+package logic
+
+/*
+機器人：CI、監控等系統通過 HTTP 接口向房間發送消息，不需要保持 WebSocket 連接。
+機器人用戶不登記到廣播器的在線用戶中，它發出的消息與普通用戶的消息一樣過濾敏感字、解析 @ 後廣播。
+
+進程內機器人：實現 Bot 接口並在啟動時通過 RegisterBot 註冊。
+1、廣播器把每條房間消息、發給機器人的私聊以及用戶加入、離開房間的事件投遞給機器人。
+2、機器人聲明的斜線指令註冊到指令註冊表中，聲明的正則匹配到消息時調用對應的處理函數。
+3、每個機器人在自己的 goroutine 中處理事件，處理慢的機器人不會阻塞廣播器，事件隊列滿時丟棄事件。
+4、機器人通過 BotContext 在房間中發言、回覆、回應（表情）或發送私聊。
+*/
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 機器人單條消息內容的最大長度
+const botMaxContentLen = 4096
+
+// botProvider 進程內機器人綁定 UID 時使用的認證來源名稱
+const botProvider = "bot"
+
+// NewBotUser 根據認證後的身份創建機器人用戶，與代表系統的 System 不同，機器人有自己的 UID 和昵稱
+func NewBotUser(ident *Identity) *User {
+	return &User{
+		UID:      ident.UID,
+		NickName: ident.NickName,
+		EnterAt:  time.Now(),
+		Role:     ident.Role,
+		Bot:      true,
+	}
+}
+
+// PostBotMessage 機器人向房間發送一條消息，返回廣播的消息
+func PostBotMessage(bot *User, room, content string) (*Message, error) {
+	if err := CheckRoomName(room); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(content) == "" {
+		return nil, errors.New("消息內容不能為空")
+	}
+	if len(content) > botMaxContentLen {
+		return nil, errors.New("消息內容過長")
+	}
+
+	msg := NewMessage(bot, room, content, "")
+	if err := bot.broadcastProcessed(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Bot 運行在服務器進程內的機器人，可以嵌入 BaseBot 只實現需要的方法
+type Bot interface {
+	// Name 機器人的昵稱
+	Name() string
+	// Commands 機器人處理的斜線指令
+	Commands() []*BotCommand
+	// Patterns 機器人處理的消息正則
+	Patterns() []*BotPattern
+	// OnMessage 收到房間中的每一條消息，以及發給機器人的私聊
+	OnMessage(c *BotContext, msg *Message)
+	// OnPresence 用戶加入或離開房間
+	OnPresence(c *BotContext, ev *PresenceEvent)
+}
+
+// BotHandler 處理觸發機器人的消息，args 為指令參數或正則的子匹配
+type BotHandler func(c *BotContext, msg *Message, args []string)
+
+// BotCommand 機器人處理的斜線指令，參數按空白分隔
+type BotCommand struct {
+	Name   string
+	Usage  string
+	Role   Role
+	Handle BotHandler
+}
+
+// BotPattern 機器人處理的消息正則
+type BotPattern struct {
+	Regexp *regexp.Regexp
+	Handle BotHandler
+}
+
+// PresenceEvent 用戶加入或離開房間的事件，Room 為空表示離開聊天室
+type PresenceEvent struct {
+	Join bool
+	Room string
+	User *User
+}
+
+// BaseBot 提供 Bot 接口的空實現
+type BaseBot struct{}
+
+func (BaseBot) Commands() []*BotCommand                     { return nil }
+func (BaseBot) Patterns() []*BotPattern                     { return nil }
+func (BaseBot) OnMessage(c *BotContext, msg *Message)       {}
+func (BaseBot) OnPresence(c *BotContext, ev *PresenceEvent) {}
+
+// 每個機器人待處理事件隊列的長度
+const botQueueLen = 64
+
+// botRunner 運行一個機器人
+type botRunner struct {
+	bot      Bot
+	patterns []*BotPattern
+	ctx      *BotContext
+	events   chan func()
+}
+
+// bots 已註冊的機器人，key 為昵稱
+// 機器人只在啟動階段註冊，運行期間只讀，因此不需要加鎖
+var bots = make(map[string]*botRunner)
+
+// RegisterBot 註冊機器人及其指令，需要在 StartBots 之前調用
+func RegisterBot(bot Bot) {
+	runner := &botRunner{
+		bot:      bot,
+		patterns: bot.Patterns(),
+		ctx:      &BotContext{},
+		events:   make(chan func(), botQueueLen),
+	}
+	bots[bot.Name()] = runner
+
+	for _, cmd := range bot.Commands() {
+		cmd := cmd
+		RegisterCommand(&Command{
+			Name:      cmd.Name,
+			Usage:     cmd.Usage,
+			Role:      cmd.Role,
+			ParseArgs: fieldsArg,
+			Handler: func(u *User, room string, args []string) error {
+				msg := &Message{
+					User:    u.snapshot(),
+					Room:    room,
+					Type:    MsgTypeCommand,
+					Content: "/" + cmd.Name + " " + strings.Join(args, " "),
+					MsgTime: time.Now(),
+				}
+				runner.post(func() { cmd.Handle(runner.ctx, msg, args) })
+				return nil
+			},
+		})
+	}
+}
+
+// StartBots 為已註冊的機器人綁定 UID 並啟動處理事件的 goroutine，需要在存儲打開之後調用
+func StartBots() error {
+	for name, runner := range bots {
+		ident, err := BindIdentity(botProvider, name, name, RoleUser)
+		if err != nil {
+			return err
+		}
+		runner.ctx.user = NewBotUser(ident)
+		go runner.run()
+	}
+	return nil
+}
+
+func (r *botRunner) run() {
+	for event := range r.events {
+		event()
+	}
+}
+
+// post 把事件放入機器人的隊列，隊列滿時丟棄，不阻塞調用者
+func (r *botRunner) post(event func()) {
+	select {
+	case r.events <- event:
+	default:
+		log.Println("bot", r.bot.Name(), "queue is full, event dropped")
+	}
+}
+
+// dispatchMessage 把消息交給機器人，機器人自己發出的消息除外
+func (r *botRunner) dispatchMessage(msg *Message) {
+	if r.ctx.user == nil || msg.User.UID == r.ctx.user.UID {
+		return
+	}
+	r.post(func() {
+		r.bot.OnMessage(r.ctx, msg)
+		for _, p := range r.patterns {
+			if args := p.Regexp.FindStringSubmatch(msg.Content); args != nil {
+				p.Handle(r.ctx, msg, args[1:])
+			}
+		}
+	})
+}
+
+func (r *botRunner) dispatchPresence(ev *PresenceEvent) {
+	if r.ctx.user == nil {
+		return
+	}
+	r.post(func() { r.bot.OnPresence(r.ctx, ev) })
+}
+
+// dispatchBotMessage 廣播器調用：房間消息交給所有機器人
+func dispatchBotMessage(msg *Message) {
+	if msg.Type != MsgTypeNormal && msg.Type != MsgTypeAction {
+		return
+	}
+	for _, r := range bots {
+		r.dispatchMessage(msg)
+	}
+}
+
+// dispatchBotPresence 廣播器調用：加入、離開房間的事件交給所有機器人
+func dispatchBotPresence(ev *PresenceEvent) {
+	for _, r := range bots {
+		r.dispatchPresence(ev)
+	}
+}
+
+// isBotName 昵稱是否被機器人使用
+func isBotName(nickname string) bool {
+	_, ok := bots[nickname]
+	return ok
+}
+
+// isInProcessBot u 是否是進程內的機器人，進程內機器人是受信任的，不受發言頻率等限制
+func isInProcessBot(u *User) bool {
+	r, ok := bots[u.NickName]
+	return ok && r.ctx.user != nil && r.ctx.user.UID == u.UID
+}
+
+// BotContext 機器人發送消息的方式
+type BotContext struct {
+	user *User
+}
+
+// User 機器人自己的用戶信息
+func (c *BotContext) User() *User {
+	return c.user
+}
+
+// Say 在房間中發言
+func (c *BotContext) Say(room, content string) error {
+	_, err := PostBotMessage(c.user, room, content)
+	return err
+}
+
+// Reply 回覆 msg：房間消息在原房間中回覆，私聊和指令以私聊回覆發送者
+func (c *BotContext) Reply(msg *Message, content string) error {
+	if msg.To != "" || msg.Type == MsgTypeCommand || msg.Room == "" {
+		return c.DirectMessage(msg.User.NickName, content)
+	}
+	return c.Say(msg.Room, content)
+}
+
+// React 以表情回應 msg
+func (c *BotContext) React(msg *Message, emoji string) {
+	Broadcaster.Broadcast(NewReactionMessage(c.user, msg, emoji))
+}
+
+// DirectMessage 給 nickname 發送私聊
+func (c *BotContext) DirectMessage(nickname, content string) error {
+	if strings.TrimSpace(content) == "" {
+		return errors.New("消息內容不能為空")
+	}
+	return c.user.broadcastProcessed(NewDirectMessage(c.user, nickname, content))
+}
@@ -1,10 +1,13 @@
 package logic
 
 import (
+	"errors"
 	"expvar" // Go 內建的變數監控工具，用來監控 message_queue 長度的變數數據
 	"fmt"
 	"github.com/rorast/go-chatroom/global"
 	"log"
+	"sync"
+	"time"
 )
 
 func init() {
@@ -25,24 +28,39 @@ type broadcaster struct {
 
 	// 所有 channel 統一管理，可以避免外部亂用
 	// enteringChannel, leavingChannel, messageChannel 等 chan 變數也都透過 make(chan ...) 初始化，確保可以正常使用。
-	enteringChannel chan *User    // 使用者進入聊天室
-	leavingChannel  chan *User    // 使用者離開聊天室
-	messageChannel  chan *Message // 訊息佇列
+	enteringChannel chan *enterRequest // 使用者進入聊天室
+	leavingChannel  chan *User         // 使用者離開聊天室
+	messageChannel  chan *Message      // 訊息佇列
 
 	// 判斷該昵稱用戶是否可進入聊天室（重復與否）：true 能，false 不能
 	checkUserChannel      chan string
 	checkUserCanInChannel chan bool
 
+	// 用戶改名請求，結果透過請求中的 result 回傳
+	renameChannel chan *renameRequest
+
+	// 用戶加入、離開房間
+	roomChannel chan *roomRequest
+
+	// 客戶端回報的已讀位置
+	readChannel chan *readRequest
+
+	// 各房間的消息序號以及用戶的已讀位置，只在廣播器 goroutine 中讀寫
+	reads *readTracker
+
 	// 獲取用戶列表
-	requestUsersChannel chan struct{} // 當外部請求用戶列表時，這個通道會收到一個空結構體 struct{} 來觸發查詢。
-	usersChannel        chan []*User  // 用來回傳當前所有在線的 User。
+	requestUsersChannel chan string  // 當外部請求用戶列表時，這個通道會收到房間名稱來觸發查詢，空字符串表示所有在線用戶。
+	usersChannel        chan []*User // 用來回傳當前所有在線的 User。
+
+	// 各房間的話題，key 為房間名稱，由指令 /topic 設置，可能被多個用戶 goroutine 同時讀寫
+	topics sync.Map
 }
 
 // Broadcaster 變數：初始化 broadcaster - 單例模式(這裡定義了一個全域變數 Broadcaster，以確保聊天室的 broadcaster 只有一個實例。)
 var Broadcaster = &broadcaster{
 	users: make(map[string]*User),
 
-	enteringChannel: make(chan *User),
+	enteringChannel: make(chan *enterRequest),
 	leavingChannel:  make(chan *User),
 	// messageChannel 是唯一有 buffer（global.MessageQueueLen）的 channel，確保訊息佇列不會阻塞。
 	messageChannel: make(chan *Message, global.MessageQueueLen), // messageChannel 的容量由 global.MessageQueueLen 控制，避免訊息堆積過多導致崩潰。
@@ -50,63 +68,236 @@ var Broadcaster = &broadcaster{
 	checkUserChannel:      make(chan string),
 	checkUserCanInChannel: make(chan bool),
 
-	requestUsersChannel: make(chan struct{}),
+	renameChannel: make(chan *renameRequest),
+
+	roomChannel: make(chan *roomRequest),
+
+	readChannel: make(chan *readRequest, 64),
+	reads:       newReadTracker(),
+
+	requestUsersChannel: make(chan string),
 	usersChannel:        make(chan []*User),
 }
 
 // Start() - 廣播器的核心 - 需要在一个新 goroutine 中運行，因为它不會返回
 func (b *broadcaster) Start() {
+	// 定期清理離線消息和遊客記錄，不依賴房間中有沒有消息
+	sweep := time.NewTicker(inboxSweepInterval)
+	defer sweep.Stop()
+
 	// 事件驅動的 Goroutine，負責處理不同的聊天室事件。
 	for { // 這裡是一個無限循環，不斷地從不同的 channel 中讀取數據。
 		select {
-		// 新使用者進入聊天室，存入 users，並可能發送離線訊息。
-		case user := <-b.enteringChannel:
+		// 新使用者進入聊天室，存入 users，並可能發送 @ 他的離線訊息。
+		case req := <-b.enteringChannel:
+			user := req.user
+			if old, ok := b.users[user.NickName]; ok {
+				if old.UID != user.UID {
+					req.result <- errNicknameExists
+					continue
+				}
+				// 同一用戶在舊連接斷開前重新連接：以新連接為準，斷開舊連接
+				old.replace()
+			}
 			// 新用户进入
 			b.users[user.NickName] = user
+			b.reads.enter(user)
 
 			OfflineProcessor.Send(user)
+			req.result <- nil
+		// 使用者加入或離開房間，加入時給他發送房間成員、話題以及該房間最近的消息。
+		case req := <-b.roomChannel:
+			_, in := req.user.rooms[req.room]
+			if in == req.join {
+				req.result <- false
+				continue
+			}
+			if req.join {
+				req.user.rooms[req.room] = struct{}{}
+
+				members := make([]*User, 0, len(b.users))
+				for _, user := range b.users {
+					if _, in := user.rooms[req.room]; in {
+						members = append(members, user.snapshot())
+					}
+				}
+				lastRead, known := b.reads.get(req.user.UID, req.room)
+				// 第一次加入房間時從房間當前的序號開始記錄已讀位置，最近的消息只作為上下文發送
+				if !known {
+					b.reads.mark(req.user.UID, req.room, b.reads.latest(req.room))
+				}
+				req.user.MessageChannel <- NewRoomJoinedMessage(req.user, req.room, b.Topic(req.room), members,
+					b.reads.latest(req.room), b.reads.unread(req.user.UID, req.room))
+
+				// 只補發未讀的最近消息
+				OfflineProcessor.SendRecent(req.user, req.room, lastRead)
+				OfflineProcessor.AddRoomMember(req.room, req.user.NickName)
+				Webhooks.Fire(&WebhookEvent{Event: WebhookEventJoin, Room: req.room, User: newWebhookUser(req.user)})
+			} else {
+				delete(req.user.rooms, req.room)
+				Webhooks.Fire(&WebhookEvent{Event: WebhookEventLeave, Room: req.room, User: newWebhookUser(req.user)})
+			}
+			dispatchBotPresence(&PresenceEvent{Join: req.join, Room: req.room, User: req.user.snapshot()})
+			req.result <- true
+		// 客戶端回報已讀位置
+		case req := <-b.readChannel:
+			b.handleRead(req)
 		// 使用者離開聊天室，從 users 刪除並關閉訊息通道。
 		case user := <-b.leavingChannel:
-			// 用户离开
-			delete(b.users, user.NickName)
 			// 避免 goroutine 泄露
 			user.CloseMessageChannel()
-		// 對所有使用者廣播訊息，但排除發送者自己。
+			// 被新連接取代的舊會話：用戶仍然在線，不刪除新的會話，也不發出離開的通知
+			if b.users[user.NickName] != user {
+				continue
+			}
+			// 用户离开
+			delete(b.users, user.NickName)
+			OfflineProcessor.Seen(user)
+			b.reads.leave(user)
+
+			for room := range user.rooms {
+				History.Save(NewUserPartMessage(user, room))
+				Webhooks.Fire(&WebhookEvent{Event: WebhookEventLeave, Room: room, User: newWebhookUser(user)})
+			}
+			dispatchBotPresence(&PresenceEvent{User: user.snapshot()})
+		// 對房間內的使用者廣播訊息，但排除發送者自己。
 		case msg := <-b.messageChannel:
-			// 给所有在线用户发送消息
+			// 私聊只發給接收者
+			if msg.To != "" {
+				b.deliverDirect(msg)
+				continue
+			}
+
+			// 在線用戶只能向自己加入的房間發送消息（離開房間的通知發出時已經不在房間中）
+			if sender, ok := b.users[msg.User.NickName]; ok && sender.UID == msg.User.UID && msg.Room != "" && msg.Type != MsgTypeUserLeave {
+				if _, in := sender.rooms[msg.Room]; !in {
+					sender.MessageChannel <- NewErrorMessage("您不在房間 " + msg.Room + " 中")
+					continue
+				}
+			}
+
+			// 分配房間內的消息序號，發送者自己的消息視為已讀
+			if hasSeq(msg) {
+				msg.Seq = b.reads.next(msg.Room)
+				b.reads.mark(msg.User.UID, msg.Room, msg.Seq)
+			}
+
+			// 给房間內的在线用户发送消息
 			for _, user := range b.users {
-				if user.UID == msg.User.UID {
+				if user.UID == msg.User.UID || !b.shouldReceive(user, msg) {
 					continue
 				}
 				user.MessageChannel <- msg
 				fmt.Println("msg :: ", msg)
 			}
 			OfflineProcessor.Save(msg)
+			History.Save(msg)
+			b.notifyMentions(msg)
+			fireMessageWebhooks(msg)
+			dispatchBotMessage(msg)
 		// 檢查用戶是否已存在，結果透過 checkUserCanInChannel 回傳。
 		case nickname := <-b.checkUserChannel:
-			if _, ok := b.users[nickname]; ok {
+			if _, ok := b.users[nickname]; ok || isBotName(nickname) {
 				b.checkUserCanInChannel <- false
 			} else {
 				b.checkUserCanInChannel <- true
 			}
-		// 查詢當前在線使用者並透過 usersChannel 回傳。
-		case <-b.requestUsersChannel:
+		// 用戶改名：檢查新昵稱是否被佔用，並以新昵稱重新登記用戶。
+		case req := <-b.renameChannel:
+			if _, ok := b.users[req.nickname]; ok || isBotName(req.nickname) {
+				req.result <- errNicknameExists
+				continue
+			}
+			// 其他 goroutine 只拿到用戶的副本（見 snapshot），這裡可以直接修改
+			oldNickname := req.user.NickName
+			if b.users[oldNickname] == req.user {
+				delete(b.users, oldNickname)
+			}
+			req.user.NickName = req.nickname
+			b.users[req.nickname] = req.user
+
+			OfflineProcessor.Rename(oldNickname, req.nickname)
+			req.result <- nil
+		// 查詢當前在線使用者（或某個房間內的使用者）並透過 usersChannel 回傳。
+		case room := <-b.requestUsersChannel:
 			userList := make([]*User, 0, len(b.users))
 			for _, user := range b.users {
-				userList = append(userList, user)
+				if _, in := user.rooms[room]; room != "" && !in {
+					continue
+				}
+				userList = append(userList, user.snapshot())
 			}
 
 			b.usersChannel <- userList
+		case <-sweep.C:
+			OfflineProcessor.Sweep(b.users)
+			b.reads.sweep(OfflineProcessor.guestTTL)
 		}
 	}
 }
 
+// shouldReceive 判斷 user 是否應該收到 msg：
+// 指定了房間的消息只發給房間成員；沒有指定房間的消息（例如離開聊天室、改名）
+// 發給與發送者至少同在一個房間的用戶，系統消息發給所有人。
+func (b *broadcaster) shouldReceive(user *User, msg *Message) bool {
+	if msg.Room != "" {
+		_, in := user.rooms[msg.Room]
+		return in
+	}
+	if msg.User.UID == System.UID {
+		return true
+	}
+	for room := range msg.User.rooms {
+		if _, in := user.rooms[room]; in {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverDirect 把私聊發給接收者（在線用戶或機器人），在線的發送者也收到一份以便顯示，
+// 接收者不在線時存入他的離線收件箱，不是已知用戶時告知發送者
+func (b *broadcaster) deliverDirect(msg *Message) {
+	sender, ok := b.users[msg.User.NickName]
+	if !ok || sender.UID != msg.User.UID {
+		sender = nil
+	}
+
+	if bot, ok := bots[msg.To]; ok {
+		bot.dispatchMessage(msg)
+	} else if user, ok := b.users[msg.To]; ok {
+		user.MessageChannel <- msg
+	} else if OfflineProcessor.SaveDirect(msg) {
+		if sender != nil {
+			sender.MessageChannel <- NewCommandMessage("用戶 " + msg.To + " 不在線，消息將在其上線後送達")
+		}
+	} else {
+		if sender != nil {
+			sender.MessageChannel <- NewErrorMessage("用戶 " + msg.To + " 不在線")
+		}
+		return
+	}
+
+	if sender != nil {
+		sender.MessageChannel <- msg
+	}
+}
+
 /*
 UserEntering() 和 UserLeaving() 負責把 User 寫入對應的 channel 來驅動 Start() 內的事件。
 */
-// 使用者進入
-func (b *broadcaster) UserEntering(u *User) {
-	b.enteringChannel <- u
+// enterRequest 使用者進入聊天室的請求
+type enterRequest struct {
+	user   *User
+	result chan error
+}
+
+// 使用者進入，昵稱被其他用戶（UID 不同）使用時返回 errNicknameExists；
+// 同一用戶已經在線時（例如在舊連接斷開前重新連接），斷開舊連接，以新連接為準
+func (b *broadcaster) UserEntering(u *User) error {
+	req := &enterRequest{user: u, result: make(chan error)}
+	b.enteringChannel <- req
+	return <-req.result
 }
 
 // 使用者離開
@@ -129,8 +320,86 @@ func (b *broadcaster) CanEnterRoom(nickname string) bool {
 	return <-b.checkUserCanInChannel
 }
 
+// renameRequest 改名請求
+type renameRequest struct {
+	user     *User
+	nickname string
+	result   chan error
+}
+
+var errNicknameExists = errors.New("該昵稱已經存在")
+
+// Rename 將在線用戶 u 改名為 nickname，由廣播器 goroutine 保證昵稱唯一
+func (b *broadcaster) Rename(u *User, nickname string) error {
+	req := &renameRequest{
+		user:     u,
+		nickname: nickname,
+		result:   make(chan error),
+	}
+	b.renameChannel <- req
+	return <-req.result
+}
+
 // 獲取目前在線使用者
 func (b *broadcaster) GetUserList() []*User {
-	b.requestUsersChannel <- struct{}{}
+	b.requestUsersChannel <- ""
 	return <-b.usersChannel
 }
+
+// RoomMembers 獲取房間內的在線使用者
+func (b *broadcaster) RoomMembers(room string) []*User {
+	b.requestUsersChannel <- room
+	return <-b.usersChannel
+}
+
+// roomRequest 加入或離開房間的請求，result 回傳成員關係是否有變化
+type roomRequest struct {
+	user   *User
+	room   string
+	join   bool
+	result chan bool
+}
+
+var errNotInRoom = errors.New("您不在該房間中")
+
+// JoinRoom 使用者加入房間，並通知房間內的其他人，已在房間中時不做任何事
+func (b *broadcaster) JoinRoom(u *User, room string) error {
+	if err := CheckRoomName(room); err != nil {
+		return err
+	}
+
+	req := &roomRequest{user: u, room: room, join: true, result: make(chan bool)}
+	b.roomChannel <- req
+	if <-req.result {
+		b.Broadcast(NewUserEnterMessage(u, room))
+	}
+	return nil
+}
+
+// LeaveRoom 使用者離開房間，並通知房間內的其他人
+func (b *broadcaster) LeaveRoom(u *User, room string) error {
+	req := &roomRequest{user: u, room: room, result: make(chan bool)}
+	b.roomChannel <- req
+	if !<-req.result {
+		return errNotInRoom
+	}
+
+	// 自己也收到一份，以便客戶端更新狀態
+	msg := NewUserPartMessage(u, room)
+	u.MessageChannel <- msg
+	b.Broadcast(msg)
+	return nil
+}
+
+// Topic 獲取房間話題
+func (b *broadcaster) Topic(room string) string {
+	topic, _ := b.topics.Load(room)
+	s, _ := topic.(string)
+	return s
+}
+
+// SetTopic 設置房間話題，返回需要廣播的話題變更消息
+func (b *broadcaster) SetTopic(u *User, room, topic string) *Message {
+	b.topics.Store(room, topic)
+	return NewTopicMessage(u, room, topic)
+}
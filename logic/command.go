@@ -0,0 +1,256 @@
+package logic
+
+/*
+斜線指令（Slash Command）：
+用戶輸入的內容以 / 開頭時，不會當作普通消息廣播，而是交給指令註冊表處理。
+每個指令聲明自己的名稱、參數解析方式、需要的角色以及處理函數，
+未知的指令、參數錯誤或權限不足，都只會以 MsgTypeError 回給發送者本人。
+處理管道中配置了 ratelimit 時，執行指令與發言共用同一個按 UID 的頻率限制。
+*/
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Command 聊天室指令
+type Command struct {
+	// 指令名稱，不含前導的 /，例如 "nick"
+	Name string
+	// 用法說明，/help 時顯示
+	Usage string
+	// 執行指令所需的最低角色
+	Role Role
+	// ParseArgs 解析指令名稱之後的原始參數字串，為 nil 時表示不接受參數
+	ParseArgs func(raw string) ([]string, error)
+	// Handler 指令的處理函數，room 為指令發出時所在的房間，返回的 error 會以錯誤消息回給發送者
+	Handler func(u *User, room string, args []string) error
+	// 指令產生的消息本身經過處理管道（例如 /me、/msg），執行時不再單獨計入頻率限制
+	Pipelined bool
+}
+
+// commands 指令註冊表，key 為指令名稱
+// 指令只在啟動階段註冊，運行期間只讀，因此不需要加鎖
+var commands = make(map[string]*Command)
+
+// RegisterCommand 註冊指令，同名指令後註冊的會覆蓋先註冊的
+func RegisterCommand(cmd *Command) {
+	commands[strings.ToLower(cmd.Name)] = cmd
+}
+
+// IsCommand 判斷內容是否為斜線指令
+func IsCommand(content string) bool {
+	return strings.HasPrefix(content, "/")
+}
+
+// ExecCommand 解析並執行 u 在 room 中發出的指令，錯誤只發給 u 本人
+func (u *User) ExecCommand(room, content string) {
+	name, raw, _ := strings.Cut(strings.TrimPrefix(content, "/"), " ")
+	name = strings.ToLower(name)
+
+	cmd, ok := commands[name]
+	if !ok {
+		u.MessageChannel <- NewErrorMessage("未知的指令：/" + name + "，輸入 /help 查看可用指令")
+		return
+	}
+
+	if u.Role < cmd.Role {
+		u.MessageChannel <- NewErrorMessage("您沒有權限執行指令：/" + name)
+		return
+	}
+	// 指令可能很耗資源（例如 /search），與發言共用頻率限制，避免客戶端用指令刷屏
+	if !cmd.Pipelined {
+		if err := chargeCommand(u); err != nil {
+			u.MessageChannel <- NewErrorMessage(err.Error())
+			return
+		}
+	}
+
+	var (
+		args []string
+		err  error
+	)
+	raw = strings.TrimSpace(raw)
+	if cmd.ParseArgs != nil {
+		args, err = cmd.ParseArgs(raw)
+	} else if raw != "" {
+		err = errors.New("該指令不接受參數")
+	}
+	if err != nil {
+		u.MessageChannel <- NewErrorMessage(err.Error() + "，用法：" + cmd.Usage)
+		return
+	}
+
+	if err = cmd.Handler(u, room, args); err != nil {
+		u.MessageChannel <- NewErrorMessage(err.Error())
+	}
+}
+
+// inRoom 判斷 u 是否在 room 中
+func inRoom(u *User, room string) bool {
+	for _, member := range Broadcaster.RoomMembers(room) {
+		if member.UID == u.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// restArg 將剩餘的全部內容作為一個必填參數
+func restArg(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, errors.New("缺少參數")
+	}
+	return []string{raw}, nil
+}
+
+// fieldsArg 按空白分隔參數
+func fieldsArg(raw string) ([]string, error) {
+	return strings.Fields(raw), nil
+}
+
+// targetAndRestArg 第一個參數為對象（例如昵稱），剩餘的全部內容作為第二個參數
+func targetAndRestArg(raw string) ([]string, error) {
+	target, rest, _ := strings.Cut(raw, " ")
+	rest = strings.TrimSpace(rest)
+	if target == "" || rest == "" {
+		return nil, errors.New("缺少參數")
+	}
+	return []string{target, rest}, nil
+}
+
+// optionalRestArg 將剩餘的全部內容作為一個可選參數
+func optionalRestArg(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	return []string{raw}, nil
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:    "help",
+		Usage:   "/help",
+		Role:    RoleUser,
+		Handler: helpCommand,
+	})
+	RegisterCommand(&Command{
+		Name:      "nick",
+		Usage:     "/nick <新昵稱>",
+		Role:      RoleUser,
+		ParseArgs: restArg,
+		Handler:   nickCommand,
+	})
+	RegisterCommand(&Command{
+		Name:      "me",
+		Usage:     "/me <動作>",
+		Role:      RoleUser,
+		ParseArgs: restArg,
+		Handler:   meCommand,
+		Pipelined: true,
+	})
+	RegisterCommand(&Command{
+		Name:      "msg",
+		Usage:     "/msg <昵稱> <內容>",
+		Role:      RoleUser,
+		ParseArgs: targetAndRestArg,
+		Handler:   msgCommand,
+		Pipelined: true,
+	})
+	RegisterCommand(&Command{
+		Name:    "who",
+		Usage:   "/who",
+		Role:    RoleUser,
+		Handler: whoCommand,
+	})
+	// 所有用戶都可以查看話題，設置話題需要管理員，在 topicCommand 中檢查
+	RegisterCommand(&Command{
+		Name:      "topic",
+		Usage:     "/topic [新話題]",
+		Role:      RoleUser,
+		ParseArgs: optionalRestArg,
+		Handler:   topicCommand,
+	})
+}
+
+// helpCommand 列出當前用戶可以使用的指令
+func helpCommand(u *User, room string, args []string) error {
+	usages := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		if u.Role >= cmd.Role {
+			usages = append(usages, cmd.Usage)
+		}
+	}
+	sort.Strings(usages)
+
+	u.MessageChannel <- NewCommandMessage("可用指令：\n" + strings.Join(usages, "\n"))
+	return nil
+}
+
+// nickCommand 在線修改昵稱，不需要重新連接
+func nickCommand(u *User, room string, args []string) error {
+	return u.Rename(args[0])
+}
+
+// meCommand 以第三人稱描述動作，例如 /me 揮揮手
+func meCommand(u *User, room string, args []string) error {
+	if !inRoom(u, room) {
+		return errNotInRoom
+	}
+	msg := NewActionMessage(u, room, args[0])
+	ok, err := RunPipeline(msg)
+	if err != nil || !ok {
+		return err
+	}
+
+	// 廣播時會排除發送者，所以單獨給自己發一份
+	u.MessageChannel <- msg
+	Broadcaster.Broadcast(msg)
+	return nil
+}
+
+// msgCommand 給在線用戶或機器人發送私聊
+func msgCommand(u *User, room string, args []string) error {
+	return u.SendDirect(args[0], args[1])
+}
+
+// whoCommand 列出當前房間的在線用戶
+func whoCommand(u *User, room string, args []string) error {
+	userList := Broadcaster.RoomMembers(room)
+
+	nicknames := make([]string, 0, len(userList))
+	for _, user := range userList {
+		nicknames = append(nicknames, user.NickName)
+	}
+	sort.Strings(nicknames)
+
+	u.MessageChannel <- NewCommandMessage("房間 " + room + " 在線用戶：" + strings.Join(nicknames, "、"))
+	return nil
+}
+
+var errTopicAdminOnly = errors.New("只有管理員可以設置話題")
+
+// topicCommand 查看或設置房間話題，設置話題僅限管理員
+func topicCommand(u *User, room string, args []string) error {
+	if len(args) == 0 {
+		topic := Broadcaster.Topic(room)
+		if topic == "" {
+			topic = "（尚未設置）"
+		}
+		u.MessageChannel <- NewCommandMessage("房間 " + room + " 當前話題：" + topic)
+		return nil
+	}
+
+	if u.Role < RoleAdmin {
+		return errTopicAdminOnly
+	}
+	if !inRoom(u, room) {
+		return errNotInRoom
+	}
+	msg := Broadcaster.SetTopic(u, room, FilterSensitive(args[0]))
+
+	u.MessageChannel <- msg
+	Broadcaster.Broadcast(msg)
+	return nil
+}
@@ -0,0 +1,23 @@
+package logic
+
+import "context"
+
+// CloseCode 關閉連接的原因分類，由各傳輸方式映射為自己的關閉碼
+type CloseCode int
+
+const (
+	CloseNormal          CloseCode = iota // 正常關閉
+	ClosePolicyViolation                  // 認證失敗等違反策略的情況
+	CloseInternalError                    // 服務端內部錯誤
+)
+
+// Conn 用戶的連接，屏蔽具體的傳輸方式（WebSocket、TCP、內存管道……）
+// ReadMessage 和 WriteMessage 各自只會在一個 goroutine 中調用
+type Conn interface {
+	// ReadMessage 讀取客戶端發來的一條消息，連接被客戶端正常關閉時返回 io.EOF
+	ReadMessage(ctx context.Context) (map[string]string, error)
+	// WriteMessage 向客戶端寫入一條消息
+	WriteMessage(ctx context.Context, msg *Message) error
+	// Close 以 code 和 reason 關閉連接
+	Close(code CloseCode, reason string) error
+}
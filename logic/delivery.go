@@ -0,0 +1,154 @@
+package logic
+
+/*
+可靠投遞（至少一次）：客戶端連接時帶上 ack=1 啟用。
+
+1、需要可靠投遞的消息（普通消息、動作、回應、話題變更、@ 提醒）寫出前分配一個遞增的投遞序號 Message.Delivery，
+   並保存在該用戶的未確認窗口中。
+2、客戶端收到後回覆 {"type": "ack", "seq": "N"}，表示 N 及之前的消息都已收到，服務端從窗口中刪除。
+3、連接斷開（包括寫入失敗）後窗口按 UID 保留 delivery.resume-ttl，
+   同一用戶以可靠模式重新連接時，在歡迎消息之後重發窗口中未確認的消息，投遞序號保持不變。
+   重新連接可能早於舊連接結束，因此窗口記錄使用它的連接數，最後一個連接結束時才開始計時。
+4、窗口最多保留 delivery.window 條消息，超出時丟棄最舊的。
+
+同一條消息可能被投遞多次（例如重發的消息同時也在房間最近消息中），客戶端應按消息 id 去重。
+*/
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// deliveryWindow 一個用戶未確認的消息
+type deliveryWindow struct {
+	uid int
+
+	mu      sync.Mutex
+	next    int64
+	pending []*Message // 按投遞序號遞增
+	// 正在使用窗口的連接數
+	owners int
+	// 所有連接斷開後到期刪除窗口的計時器
+	expire *time.Timer
+}
+
+// deliveryWindows 各用戶的未確認窗口，key 為 UID
+var deliveryWindows = struct {
+	sync.Mutex
+	m map[int]*deliveryWindow
+}{m: make(map[int]*deliveryWindow)}
+
+// EnableReliableDelivery 為用戶啟用可靠投遞，沿用該 UID 在 resume-ttl 內保留的未確認窗口
+// 需要在啟動寫入 goroutine 之前調用
+func (u *User) EnableReliableDelivery() {
+	deliveryWindows.Lock()
+	defer deliveryWindows.Unlock()
+
+	w, ok := deliveryWindows.m[u.UID]
+	if !ok {
+		w = &deliveryWindow{uid: u.UID}
+		deliveryWindows.m[u.UID] = w
+	}
+	w.mu.Lock()
+	w.owners++
+	if w.expire != nil {
+		w.expire.Stop()
+		w.expire = nil
+	}
+	w.mu.Unlock()
+
+	u.deliveries = w
+}
+
+// ReleaseDeliveries 連接結束後調用，沒有其他連接使用時，未確認窗口保留 delivery.resume-ttl 後刪除
+func (u *User) ReleaseDeliveries() {
+	w := u.deliveries
+	if w == nil {
+		return
+	}
+
+	ttl := viper.GetDuration("delivery.resume-ttl")
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.owners--; w.owners > 0 {
+		return
+	}
+
+	var expire *time.Timer
+	expire = time.AfterFunc(ttl, func() {
+		deliveryWindows.Lock()
+		defer deliveryWindows.Unlock()
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		// 到期前又重新連接了（Stop 時計時器可能已經觸發）
+		if w.expire != expire || w.owners > 0 {
+			return
+		}
+		if deliveryWindows.m[w.uid] == w {
+			delete(deliveryWindows.m, w.uid)
+		}
+	})
+	w.expire = expire
+}
+
+// needsDelivery 需要可靠投遞的消息，其他消息（歡迎、成員列表、token 等）在重新連接時會重新生成
+func needsDelivery(msg *Message) bool {
+	switch msg.Type {
+	case MsgTypeNormal, MsgTypeAction, MsgTypeReaction, MsgTypeTopic, MsgTypeHighlight:
+		return true
+	}
+	return false
+}
+
+// track 給消息分配投遞序號並加入窗口；消息可能同時發給多個用戶，因此返回的是副本
+func (w *deliveryWindow) track(msg *Message) *Message {
+	if !needsDelivery(msg) {
+		return msg
+	}
+
+	size := viper.GetInt("delivery.window")
+	if size <= 0 {
+		size = 256
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.next++
+	tracked := *msg
+	tracked.Delivery = w.next
+	w.pending = append(w.pending, &tracked)
+	if over := len(w.pending) - size; over > 0 {
+		log.Println("delivery window full, drop", over, "unacked messages of uid", w.uid)
+		w.pending = append(w.pending[:0:0], w.pending[over:]...)
+	}
+	return &tracked
+}
+
+// ack 刪除 seq 及之前的消息
+func (w *deliveryWindow) ack(seq int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	i := 0
+	for i < len(w.pending) && w.pending[i].Delivery <= seq {
+		i++
+	}
+	w.pending = append(w.pending[:0:0], w.pending[i:]...)
+}
+
+// unacked 未確認的消息
+func (w *deliveryWindow) unacked() []*Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]*Message(nil), w.pending...)
+}
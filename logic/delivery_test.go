@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// windowOf 該 UID 當前保留的未確認窗口
+func windowOf(uid int) *deliveryWindow {
+	deliveryWindows.Lock()
+	defer deliveryWindows.Unlock()
+	return deliveryWindows.m[uid]
+}
+
+func trackContents(w *deliveryWindow, contents ...string) {
+	for _, content := range contents {
+		w.track(NewMessage(System, "lobby", content, ""))
+	}
+}
+
+func pendingContents(w *deliveryWindow) []string {
+	var contents []string
+	for _, msg := range w.unacked() {
+		contents = append(contents, msg.Content)
+	}
+	return contents
+}
+
+func TestDeliveryAckAndTrim(t *testing.T) {
+	viper.Set("delivery.window", 3)
+	t.Cleanup(func() { viper.Set("delivery.window", nil) })
+
+	u := &User{UID: 1001}
+	u.EnableReliableDelivery()
+	t.Cleanup(func() {
+		u.ReleaseDeliveries()
+		deliveryWindows.Lock()
+		delete(deliveryWindows.m, u.UID)
+		deliveryWindows.Unlock()
+	})
+	w := u.deliveries
+
+	// 不需要可靠投遞的消息不分配序號
+	if msg := w.track(NewWelcomeMessage(u)); msg.Delivery != 0 {
+		t.Errorf("welcome delivery = %d, want 0", msg.Delivery)
+	}
+
+	trackContents(w, "1", "2", "3", "4")
+	if got := pendingContents(w); len(got) != 3 || got[0] != "2" {
+		t.Fatalf("pending = %v, want the newest 3", got)
+	}
+
+	w.ack(3)
+	pending := w.unacked()
+	if len(pending) != 1 || pending[0].Content != "4" || pending[0].Delivery != 4 {
+		t.Errorf("pending after ack = %v, want only delivery 4", pendingContents(w))
+	}
+}
+
+func TestDeliveryResume(t *testing.T) {
+	viper.Set("delivery.resume-ttl", 20*time.Millisecond)
+	t.Cleanup(func() { viper.Set("delivery.resume-ttl", nil) })
+
+	old := &User{UID: 1002}
+	old.EnableReliableDelivery()
+	trackContents(old.deliveries, "a", "b")
+
+	// 重新連接早於舊連接結束，舊連接結束時不能讓新連接正在使用的窗口到期
+	reconnected := &User{UID: 1002}
+	reconnected.EnableReliableDelivery()
+	if reconnected.deliveries != old.deliveries {
+		t.Fatal("the reconnected session did not resume the window")
+	}
+	old.ReleaseDeliveries()
+	time.Sleep(50 * time.Millisecond)
+	if windowOf(1002) == nil {
+		t.Fatal("the window expired while the reconnected session was using it")
+	}
+	if got := pendingContents(reconnected.deliveries); len(got) != 2 {
+		t.Errorf("pending = %v, want a and b to be redelivered", got)
+	}
+
+	// 最後一個連接結束後到期刪除
+	reconnected.ReleaseDeliveries()
+	deadline := time.Now().Add(time.Second)
+	for windowOf(1002) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the window did not expire after the last session ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
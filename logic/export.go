@@ -0,0 +1,379 @@
+package logic
+
+/*
+聊天記錄導出：把房間某段時間內的消息歷史導出為 JSON Lines、CSV、純文本或獨立的 HTML 頁面。
+
+1、作者昵稱按 UID 解析為註冊帳號當前的昵稱，遊客使用發送消息時的昵稱。
+2、進出房間的系統消息（MsgTypeUserEnter、MsgTypeUserLeave）只在 IncludeSystem 時導出。
+3、消息逐條寫出，不在內存中保存整個房間的記錄；歷史分批在短事務中讀取，寫得慢的客戶端不會長時間佔用讀事務。
+4、CSV 中以 =、+、-、@ 開頭的單元格前加上 '，避免在電子表格中被當作公式執行。
+*/
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 導出格式
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+	ExportText  = "text"
+	ExportHTML  = "html"
+)
+
+// ExportFormats 支持的導出格式以及對應的 Content-Type、文件擴展名
+var ExportFormats = map[string]struct{ ContentType, Ext string }{
+	ExportJSONL: {"application/x-ndjson; charset=utf-8", "jsonl"},
+	ExportCSV:   {"text/csv; charset=utf-8", "csv"},
+	ExportText:  {"text/plain; charset=utf-8", "txt"},
+	ExportHTML:  {"text/html; charset=utf-8", "html"},
+}
+
+// ExportOptions 導出條件
+type ExportOptions struct {
+	Room string
+	// 時間範圍 [Since, Until)，為零值時不限制
+	Since time.Time
+	Until time.Time
+	// 導出格式，為空時為 jsonl
+	Format string
+	// 是否包含進出房間的消息
+	IncludeSystem bool
+}
+
+// ExportRecord 導出的一條消息
+type ExportRecord struct {
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room"`
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	UID     int       `json:"uid"`
+	Author  string    `json:"author"`
+	Content string    `json:"content"`
+	ReplyTo string    `json:"reply_to,omitempty"`
+
+	Attachments []*Attachment `json:"attachments,omitempty"`
+}
+
+// exportTypeNames 導出的消息類型名稱
+var exportTypeNames = map[int]string{
+	MsgTypeNormal:    "message",
+	MsgTypeAction:    "action",
+	MsgTypeReaction:  "reaction",
+	MsgTypeTopic:     "topic",
+	MsgTypeUserEnter: "enter",
+	MsgTypeUserLeave: "leave",
+}
+
+var errUnknownExportFormat = errors.New("不支持的導出格式")
+
+// ParseTime 解析查詢參數、命令行參數中的時間：RFC 3339、日期（本地時區）或 Unix 秒數
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, errors.New("時間格式不合法：" + s)
+}
+
+// 遍歷歷史時一個讀事務最多讀取的消息數量
+const historyRangeBatch = 256
+
+// Range 按時間順序遍歷房間中時間在 [since, until) 內的消息，零值表示不限制
+// 消息 key 以消息時間開頭（見 historyKey），從 since 對應的 key 開始讀取，讀到 until 對應的 key 時停止。
+// 消息分批在短事務中讀取，fn 在事務之外調用，可以做較慢的操作（例如寫入網絡連接）
+func (h *historyStore) Range(room string, since, until time.Time, fn func(msg *Message) error) error {
+	if db == nil {
+		return errStoreClosed
+	}
+
+	var (
+		after    []byte // 上一批最後讀取的 key
+		done     bool
+		untilKey []byte
+	)
+	if !until.IsZero() {
+		untilKey = historyKey(until, 0)
+	}
+	for !done {
+		batch := make([]*Message, 0, historyRangeBatch)
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(historyBucket).Bucket([]byte(room))
+			if b == nil {
+				done = true
+				return nil
+			}
+			c := b.Cursor()
+			var k, v []byte
+			switch {
+			case after != nil:
+				if k, v = c.Seek(after); bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			case !since.IsZero():
+				k, v = c.Seek(historyKey(since, 0))
+			default:
+				k, v = c.First()
+			}
+			for n := 0; k != nil && n < historyRangeBatch; k, v = c.Next() {
+				if untilKey != nil && bytes.Compare(k, untilKey) >= 0 {
+					k = nil
+					break
+				}
+				n++
+				after = append(after[:0], k...)
+				msg := new(Message)
+				if err := json.Unmarshal(v, msg); err != nil {
+					return err
+				}
+				batch = append(batch, msg)
+			}
+			done = k == nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, msg := range batch {
+			if err = fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// accountNicknames 註冊帳號 UID 到當前昵稱的映射
+func accountNicknames() (map[int]string, error) {
+	nicknames := make(map[int]string)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountBucket).ForEach(func(k, v []byte) error {
+			var account Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return err
+			}
+			nicknames[account.UID] = account.NickName
+			return nil
+		})
+	})
+	return nicknames, err
+}
+
+// exportWriter 按某種格式逐條寫出記錄，Close 寫出結尾並刷新緩衝
+type exportWriter interface {
+	Write(r *ExportRecord) error
+	Close() error
+}
+
+// ExportHistory 按 opts 把房間的消息歷史寫入 w
+func ExportHistory(w io.Writer, opts *ExportOptions) error {
+	if opts.Format == "" {
+		opts.Format = ExportJSONL
+	}
+	if _, ok := ExportFormats[opts.Format]; !ok {
+		return errUnknownExportFormat
+	}
+	if err := CheckRoomName(opts.Room); err != nil {
+		return err
+	}
+	if db == nil {
+		return errStoreClosed
+	}
+
+	nicknames, err := accountNicknames()
+	if err != nil {
+		return err
+	}
+
+	var ew exportWriter
+	switch opts.Format {
+	case ExportCSV:
+		ew, err = newCSVExporter(w)
+	case ExportText:
+		ew = &textExporter{w: w}
+	case ExportHTML:
+		ew, err = newHTMLExporter(w, opts)
+	default:
+		ew = newJSONLExporter(w)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = History.Range(opts.Room, opts.Since, opts.Until, func(msg *Message) error {
+		if !opts.IncludeSystem && (msg.Type == MsgTypeUserEnter || msg.Type == MsgTypeUserLeave) {
+			return nil
+		}
+		author := msg.User.NickName
+		if nickname, ok := nicknames[msg.User.UID]; ok {
+			author = nickname
+		}
+		return ew.Write(&ExportRecord{
+			Time:    msg.MsgTime,
+			Room:    msg.Room,
+			Type:    exportTypeNames[msg.Type],
+			ID:      msg.ID,
+			UID:     msg.User.UID,
+			Author:  author,
+			Content: msg.Content,
+			ReplyTo: msg.ReplyTo,
+
+			Attachments: msg.Attachments,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+type jsonlExporter struct {
+	enc *json.Encoder
+}
+
+func newJSONLExporter(w io.Writer) *jsonlExporter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonlExporter{enc: enc}
+}
+
+func (e *jsonlExporter) Write(r *ExportRecord) error { return e.enc.Encode(r) }
+
+func (e *jsonlExporter) Close() error { return nil }
+
+type csvExporter struct {
+	cw *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) (*csvExporter, error) {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"time", "room", "type", "id", "uid", "author", "content", "reply_to"})
+	return &csvExporter{cw: cw}, err
+}
+
+func (e *csvExporter) Write(r *ExportRecord) error {
+	return e.cw.Write([]string{r.Time.Format(time.RFC3339), csvCell(r.Room), r.Type, csvCell(r.ID), strconv.Itoa(r.UID),
+		csvCell(r.Author), csvCell(r.Content), csvCell(r.ReplyTo)})
+}
+
+func (e *csvExporter) Close() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// csvCell 以 =、+、-、@ 開頭的內容在電子表格中會被當作公式，前面加上 ' 作為文本顯示
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportLine 純文本和 HTML 中一條消息的顯示內容，不含時間
+func exportLine(r *ExportRecord) string {
+	switch r.Type {
+	case "action":
+		return "* " + r.Author + " " + r.Content
+	case "reaction":
+		return "* " + r.Author + " 回應了 " + r.Content
+	case "topic":
+		return "*** " + r.Author + " 將話題設置為：" + r.Content
+	case "enter":
+		return "*** " + r.Author + " 加入了房間"
+	case "leave":
+		return "*** " + r.Author + " 離開了房間"
+	default:
+		return r.Author + ": " + r.Content
+	}
+}
+
+type textExporter struct {
+	w io.Writer
+}
+
+func (e *textExporter) Write(r *ExportRecord) error {
+	line := strings.ReplaceAll(exportLine(r), "\n", "\n    ")
+	_, err := fmt.Fprintf(e.w, "[%s] %s\n", r.Time.Format("2006-01-02 15:04:05"), line)
+	return err
+}
+
+func (e *textExporter) Close() error { return nil }
+
+// HTML 頁面分為開頭、每條消息和結尾三部分，記錄條數在寫完所有消息後才知道，因此放在結尾
+var exportHTMLTemplate = template.Must(template.New("export").Funcs(template.FuncMap{"line": exportLine}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="zh-Hant">
+<head>
+<meta charset="utf-8">
+<title>{{.Room}} 聊天記錄</title>
+<style>
+  body { font-family: sans-serif; max-width: 860px; margin: 2em auto; color: #333; }
+  h1 { font-size: 1.4em; }
+  .range { color: #888; margin-bottom: 1.5em; }
+  .msg { padding: 4px 0; border-bottom: 1px solid #eee; white-space: pre-wrap; }
+  .time { color: #999; font-size: 0.85em; margin-right: 0.5em; }
+  .author { font-weight: bold; }
+  .system { color: #888; font-style: italic; }
+  .count { color: #888; margin-top: 1.5em; }
+</style>
+</head>
+<body>
+<h1>房間 {{.Room}} 聊天記錄</h1>
+<div class="range">{{.Range}}</div>
+{{end}}
+{{define "record"}}<div class="msg{{if ne .Type "message"}} system{{end}}"><span class="time">{{.Time.Format "2006-01-02 15:04:05"}}</span>{{if eq .Type "message"}}<span class="author">{{.Author}}</span>: {{.Content}}{{else}}{{line .}}{{end}}</div>
+{{end}}
+{{define "foot"}}<div class="count">共 {{.}} 條</div>
+</body>
+</html>
+{{end}}`))
+
+type htmlExporter struct {
+	w     io.Writer
+	count int
+}
+
+func newHTMLExporter(w io.Writer, opts *ExportOptions) (*htmlExporter, error) {
+	timeRange := "全部時間"
+	if !opts.Since.IsZero() || !opts.Until.IsZero() {
+		since, until := "最早", "現在"
+		if !opts.Since.IsZero() {
+			since = opts.Since.Format("2006-01-02 15:04")
+		}
+		if !opts.Until.IsZero() {
+			until = opts.Until.Format("2006-01-02 15:04")
+		}
+		timeRange = since + " 至 " + until
+	}
+
+	err := exportHTMLTemplate.ExecuteTemplate(w, "head", map[string]interface{}{
+		"Room":  opts.Room,
+		"Range": timeRange,
+	})
+	return &htmlExporter{w: w}, err
+}
+
+func (e *htmlExporter) Write(r *ExportRecord) error {
+	e.count++
+	return exportHTMLTemplate.ExecuteTemplate(e.w, "record", r)
+}
+
+func (e *htmlExporter) Close() error {
+	return exportHTMLTemplate.ExecuteTemplate(e.w, "foot", e.count)
+}
@@ -0,0 +1,103 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendHistory 在 room 中保存內容為 contents 的消息，時間從一小時前開始每條遞增一秒
+func appendHistory(t *testing.T, room string, contents ...string) []*Message {
+	t.Helper()
+
+	alice := &User{UID: 1, NickName: "alice"}
+	start := time.Now().Add(-time.Hour)
+	msgs := make([]*Message, 0, len(contents))
+	for i, content := range contents {
+		msg := NewMessage(alice, room, content, "")
+		msg.MsgTime = start.Add(time.Duration(i) * time.Second)
+		msgs = append(msgs, msg)
+	}
+	if err := History.Append(msgs); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func TestExportCSV(t *testing.T) {
+	openTestStore(t)
+
+	contents := make([]string, historyRangeBatch+10)
+	for i := range contents {
+		contents[i] = fmt.Sprintf("message %d", i)
+	}
+	contents[0] = "=HYPERLINK(\"http://evil\")"
+	contents[1] = "-2+3"
+	appendHistory(t, "lobby", contents...)
+
+	var buf bytes.Buffer
+	if err := ExportHistory(&buf, &ExportOptions{Room: "lobby", Format: ExportCSV}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(contents)+1 {
+		t.Fatalf("rows = %d, want header and %d records", len(rows), len(contents))
+	}
+	if got := rows[1][6]; got != "'"+contents[0] {
+		t.Errorf("formula cell = %q, want it prefixed with '", got)
+	}
+	if got := rows[2][6]; got != "'-2+3" {
+		t.Errorf("formula cell = %q, want it prefixed with '", got)
+	}
+	// 跨越讀取批次時保持保存順序
+	for i := 2; i < len(contents); i++ {
+		if got := rows[i+1][6]; got != contents[i] {
+			t.Fatalf("row %d = %q, want %q", i+1, got, contents[i])
+		}
+	}
+}
+
+func TestExportHTMLAndRange(t *testing.T) {
+	openTestStore(t)
+
+	msgs := appendHistory(t, "lobby", "first", "<b>second</b>", "third")
+
+	var buf bytes.Buffer
+	opts := &ExportOptions{Room: "lobby", Format: ExportHTML, Since: msgs[1].MsgTime}
+	if err := ExportHistory(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	if strings.Contains(page, "first") || !strings.Contains(page, "third") {
+		t.Errorf("page does not honour since:\n%s", page)
+	}
+	if strings.Contains(page, "<b>second") || !strings.Contains(page, "&lt;b&gt;second") {
+		t.Errorf("content is not escaped:\n%s", page)
+	}
+	if !strings.Contains(page, "共 2 條") || !strings.HasSuffix(page, "</html>\n") {
+		t.Errorf("page footer is missing:\n%s", page)
+	}
+}
+
+func TestRangeWindow(t *testing.T) {
+	openTestStore(t)
+
+	msgs := appendHistory(t, "lobby", "one", "two", "three", "four")
+	var contents []string
+	err := History.Range("lobby", msgs[1].MsgTime, msgs[3].MsgTime, func(msg *Message) error {
+		contents = append(contents, msg.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(contents, ",") != "two,three" {
+		t.Errorf("contents = %v, want [since, until)", contents)
+	}
+}
@@ -0,0 +1,245 @@
+package logic
+
+/*
+消息歷史：房間內的消息（普通消息、動作、回應、話題變更以及進出房間）持久化到 history bucket 中，
+供搜索、導出等功能使用。私聊不保存。
+
+1、每個房間一個子 bucket，key 為消息時間（Unix 納秒）和子 bucket 自增序列各 8 字節的大端序，
+   因此按 key 遍歷即按消息時間遍歷，導入的舊消息也排在它們原來的位置。
+   舊版本只以序列為 key，打開存儲時由 migrateHistoryKeys 轉換。
+2、保存的消息只保留用戶的 UID、昵稱、角色等公開信息，不保存 token 和 IP 地址。
+3、廣播器調用 Save 後由獨立的 goroutine 批量寫入，避免每條消息一次磁盤同步阻塞廣播器；
+   同一個事務中同時更新搜索索引。
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var historyBucket = []byte("history")
+
+// 一個寫入事務最多包含的消息數量
+const historyBatchSize = 256
+
+type historyStore struct {
+	queue chan *Message
+}
+
+// History 消息歷史存儲，需要調用 Start 後 Save 才會寫入
+var History = &historyStore{}
+
+// Start 啟動寫入 goroutine
+func (h *historyStore) Start() {
+	h.queue = make(chan *Message, 4096)
+	go h.write()
+}
+
+// historyMessage 需要保存的消息
+func historyMessage(msg *Message) bool {
+	if msg.Room == "" || msg.To != "" {
+		return false
+	}
+	switch msg.Type {
+	case MsgTypeNormal, MsgTypeAction, MsgTypeReaction, MsgTypeTopic, MsgTypeUserEnter, MsgTypeUserLeave:
+		return true
+	}
+	return false
+}
+
+// Save 排隊保存消息，不需要保存的消息直接忽略
+func (h *historyStore) Save(msg *Message) {
+	if h.queue == nil || !historyMessage(msg) {
+		return
+	}
+	h.queue <- msg
+}
+
+func (h *historyStore) write() {
+	for msg := range h.queue {
+		batch := []*Message{msg}
+	drain:
+		for len(batch) < historyBatchSize {
+			select {
+			case msg := <-h.queue:
+				batch = append(batch, msg)
+			default:
+				break drain
+			}
+		}
+
+		if err := h.Append(batch); err != nil {
+			log.Println("save history error:", err)
+		}
+	}
+}
+
+// Append 在一個事務中保存消息並更新搜索索引，消息保留原有的時間和作者
+func (h *historyStore) Append(msgs []*Message) error {
+	if db == nil {
+		return errStoreClosed
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(historyBucket)
+		for _, msg := range msgs {
+			b, err := root.CreateBucketIfNotExists([]byte(msg.Room))
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			stored := storedMessage(msg)
+			v, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			key := historyKey(msg.MsgTime, seq)
+			if err = b.Put(key, v); err != nil {
+				return err
+			}
+			if err = indexMessage(tx, stored, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// storedMessage 去掉用戶的 token、地址等不應持久化的信息
+func storedMessage(msg *Message) *Message {
+	stored := *msg
+	stored.User = &User{
+		UID:      msg.User.UID,
+		NickName: msg.User.NickName,
+		Role:     msg.User.Role,
+		Bot:      msg.User.Bot,
+	}
+	stored.Users = nil
+	stored.Delivery = 0
+	stored.Unread = 0
+	return &stored
+}
+
+func historyKey(t time.Time, seq uint64) []byte {
+	var nano uint64
+	if n := t.UnixNano(); n > 0 {
+		nano = uint64(n)
+	}
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, nano)
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// 一個事務最多轉換的舊 key 數量
+const historyMigrateBatch = 1000
+
+// migrateHistoryKeys 把舊版本只以序列為 key（8 字節）的消息改為以時間為 key，並更新搜索索引
+// 舊 key 的第一個字節總是小於新 key，因此都排在每個房間的最前面
+func migrateHistoryKeys() error {
+	var rooms [][]byte
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEach(func(k, v []byte) error {
+			if v == nil {
+				rooms = append(rooms, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		for done := false; !done; {
+			err = db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(historyBucket).Bucket(room)
+				cur := b.Cursor()
+				// 轉換後的 key 排在後面，每次都從第一條重新開始
+				for n := 0; n < historyMigrateBatch; n++ {
+					k, v := cur.First()
+					if len(k) != 8 {
+						done = true
+						return nil
+					}
+					msg := new(Message)
+					if err := json.Unmarshal(v, msg); err != nil {
+						return err
+					}
+					if err := unindexMessage(tx, msg, k); err != nil {
+						return err
+					}
+					key := historyKey(msg.MsgTime, binary.BigEndian.Uint64(k))
+					v = append([]byte(nil), v...)
+					if err := cur.Delete(); err != nil {
+						return err
+					}
+					if err := b.Put(key, v); err != nil {
+						return err
+					}
+					if err := indexMessage(tx, msg, key); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// get 按房間和 key 讀取一條消息，不存在時返回 nil
+func (h *historyStore) get(tx *bolt.Tx, room string, key []byte) (*Message, error) {
+	b := tx.Bucket(historyBucket).Bucket([]byte(room))
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	msg := new(Message)
+	return msg, json.Unmarshal(v, msg)
+}
+
+// LastSeq 房間中最後保存的消息序號，用於服務重啟後繼續分配序號
+func (h *historyStore) LastSeq(room string) int64 {
+	if db == nil {
+		return 0
+	}
+
+	var seq int64
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket([]byte(room))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var msg Message
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if msg.Seq > 0 {
+				seq = msg.Seq
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("load last seq error:", err)
+	}
+	return seq
+}
@@ -0,0 +1,134 @@
+package logic
+
+/*
+身份認證的結果：無論用戶通過哪種方式認證（昵稱 + token、OIDC、反向代理、API key），
+最終都得到一個 Identity，再由 NewUser 創建聊天室用戶。
+
+外部認證來源的用戶以「來源:外部ID」為 key 綁定到 identities bucket 中的 UID，
+UID 與帳號、遊客共用同一個自增序列，同一個外部用戶每次進入都得到相同的 UID。
+*/
+
+import (
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var identityBucket = []byte("identities")
+
+// Identity 通過認證的用戶身份
+type Identity struct {
+	UID      int
+	NickName string
+	// 本服務簽發的 token，客戶端重連時可以直接使用
+	Token string
+	Role  Role
+	// 是否是新分配的 UID
+	IsNew bool
+	// 是否是沒有註冊帳號的遊客
+	Guest bool
+}
+
+// AuthenticateToken 昵稱 + token 方式認證：
+// token 有效時沿用其中的 UID；否則在允許遊客時分配新的 UID。
+// 已註冊的昵稱必須持有該帳號的 token 才能使用。
+func AuthenticateToken(token, nickname string, allowGuest bool) (*Identity, error) {
+	if err := CheckNickname(nickname); err != nil {
+		return nil, err
+	}
+	if isBotName(nickname) {
+		return nil, errBotNickname
+	}
+
+	ident := &Identity{
+		NickName: nickname,
+		Token:    token,
+	}
+	if token != "" {
+		if uid, err := parseTokenAndValidate(token, nickname); err == nil {
+			ident.UID = uid
+		}
+	}
+
+	account, err := Accounts.Get(nickname)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil && account.UID != ident.UID {
+		return nil, errNicknameReserved
+	}
+
+	if ident.UID == 0 {
+		if !allowGuest {
+			return nil, errGuestNotAllowed
+		}
+		ident.UID, err = Accounts.NextUID()
+		if err != nil {
+			return nil, err
+		}
+		ident.Token = genToken(ident.UID, nickname)
+		ident.IsNew = true
+	}
+	ident.Guest = account == nil
+
+	// 只有註冊帳號才能成為管理員，遊客的 UID 不會與帳號的 UID 重複
+	if account != nil && isAdmin(account.UID) {
+		ident.Role = RoleAdmin
+	}
+
+	return ident, nil
+}
+
+// BindIdentity 將外部認證來源的用戶綁定到穩定的 UID，並簽發本服務的 token
+// provider 為認證來源名稱，subject 為該來源中用戶的唯一標識。
+// role 只由認證方式自己決定（例如 API key 的 admin 設置），不參考 admin-uids 列表，
+// 管理員列表只適用於本地註冊帳號
+func BindIdentity(provider, subject, nickname string, role Role) (*Identity, error) {
+	if err := CheckNickname(nickname); err != nil {
+		return nil, err
+	}
+	// 機器人的昵稱只能由機器人自己使用
+	if provider != botProvider && isBotName(nickname) {
+		return nil, errBotNickname
+	}
+	if db == nil {
+		return nil, errStoreClosed
+	}
+
+	ident := &Identity{
+		NickName: nickname,
+		Role:     role,
+	}
+	key := []byte(provider + ":" + subject)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(identityBucket)
+		if v := b.Get(key); v != nil {
+			uid, err := strconv.Atoi(string(v))
+			ident.UID = uid
+			return err
+		}
+
+		uid, err := tx.Bucket(accountBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		ident.UID = int(uid)
+		ident.IsNew = true
+		return b.Put(key, []byte(strconv.Itoa(ident.UID)))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 外部用戶不能冒用本地已註冊的昵稱
+	account, err := Accounts.Get(nickname)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil && account.UID != ident.UID {
+		return nil, errNicknameReserved
+	}
+
+	ident.Token = genToken(ident.UID, nickname)
+	return ident, nil
+}
@@ -0,0 +1,45 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAdminByUID(t *testing.T) {
+	openTestStore(t)
+
+	admin, err := Accounts.Register("root", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("admin-uids", []int{admin.UID})
+	t.Cleanup(func() { viper.Set("admin-uids", nil) })
+
+	// 管理員改名後放棄的昵稱被其他人註冊
+	if err = Accounts.Rename(admin.UID, "root", "boss"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Accounts.Register("root", "other-password"); err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := Accounts.Login("root", "other-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident, err := AuthenticateToken(token, "root", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.Role == RoleAdmin {
+		t.Errorf("the new owner of the admin's old nickname is an admin")
+	}
+
+	_, token, err = Accounts.Login("boss", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident, err = AuthenticateToken(token, "boss", false); err != nil || ident.Role != RoleAdmin {
+		t.Errorf("renamed admin = %+v, %v, want admin role", ident, err)
+	}
+}
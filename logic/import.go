@@ -0,0 +1,148 @@
+package logic
+
+/*
+聊天記錄導入：讀取 JSON Lines 格式的聊天記錄（與導出的 jsonl 格式相同，每行一條 ExportRecord），
+保存到消息歷史，保留原有的時間、作者和消息編號，並建立搜索索引。
+
+1、消息歷史按時間排序，導入的舊消息排在它們原來的時間位置，保留策略的 max-age 也按時間刪除它們。
+2、房間中已經存在的消息編號不會重複導入，同一個文件可以多次導入。
+3、導出時按 UID 顯示註冊帳號當前的昵稱，因此文件中的 UID 只在它確實是作者昵稱對應的帳號時保留，
+   否則清除為 0，避免偽造的記錄冒充其他帳號。
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// 聊天記錄中單行的最大長度
+const maxTranscriptLine = 1 << 20
+
+// ReadTranscript 逐行解析 JSON Lines 聊天記錄，空行忽略
+func ReadTranscript(r io.Reader, fn func(record *ExportRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxTranscriptLine)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		record := new(ExportRecord)
+		if err := json.Unmarshal([]byte(text), record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Message 把導出記錄還原為消息，作者昵稱使用記錄中的 author
+func (r *ExportRecord) Message() (*Message, error) {
+	msgType := -1
+	for t, name := range exportTypeNames {
+		if name == r.Type {
+			msgType = t
+			break
+		}
+	}
+	if msgType < 0 {
+		return nil, fmt.Errorf("unknown message type: %q", r.Type)
+	}
+	if err := CheckRoomName(r.Room); err != nil {
+		return nil, err
+	}
+	if r.Author == "" || r.Time.IsZero() {
+		return nil, fmt.Errorf("author and time are required")
+	}
+
+	return &Message{
+		ID:      r.ID,
+		User:    &User{UID: r.UID, NickName: r.Author},
+		Type:    msgType,
+		Content: r.Content,
+		MsgTime: r.Time,
+		Room:    r.Room,
+		ReplyTo: r.ReplyTo,
+
+		Attachments: r.Attachments,
+	}, nil
+}
+
+// ImportHistory 把聊天記錄導入消息歷史，room 不為空時全部導入到該房間，返回導入的消息數量
+func ImportHistory(r io.Reader, room string) (int, error) {
+	var (
+		batch []*Message
+		total int
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := History.Append(batch); err != nil {
+			return err
+		}
+		total += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	// 各房間已有的消息編號，第一次導入該房間的消息時加載
+	ids := make(map[string]map[string]bool)
+
+	err := ReadTranscript(r, func(record *ExportRecord) error {
+		if room != "" {
+			record.Room = room
+		}
+		msg, err := record.Message()
+		if err != nil {
+			return err
+		}
+		if uid, ok := Accounts.UID(msg.User.NickName); !ok || uid != msg.User.UID {
+			msg.User.UID = 0
+		}
+
+		if msg.ID != "" {
+			roomIDs, ok := ids[msg.Room]
+			if !ok {
+				if roomIDs, err = historyIDs(msg.Room); err != nil {
+					return err
+				}
+				ids[msg.Room] = roomIDs
+			}
+			if roomIDs[msg.ID] {
+				return nil
+			}
+			roomIDs[msg.ID] = true
+		} else if searchable(msg) {
+			// 普通消息和動作消息需要編號，回應才能指向它們
+			msg.ID = genTokenID()
+		}
+		batch = append(batch, msg)
+		if len(batch) >= historyBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return total, err
+	}
+	return total, flush()
+}
+
+// historyIDs 房間中已有的消息編號
+func historyIDs(room string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	err := History.Range(room, time.Time{}, time.Time{}, func(msg *Message) error {
+		if msg.ID != "" {
+			ids[msg.ID] = true
+		}
+		return nil
+	})
+	return ids, err
+}
@@ -0,0 +1,137 @@
+package logic
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// transcript 把記錄編碼為 JSON Lines
+func transcript(t *testing.T, records ...*ExportRecord) string {
+	t.Helper()
+
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sb.String()
+}
+
+// roomContents 按遍歷順序返回房間中消息的內容和作者 UID
+func roomContents(t *testing.T, room string) ([]string, []int) {
+	t.Helper()
+
+	var (
+		contents []string
+		uids     []int
+	)
+	err := History.Range(room, time.Time{}, time.Time{}, func(msg *Message) error {
+		contents = append(contents, msg.Content)
+		uids = append(uids, msg.User.UID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contents, uids
+}
+
+func TestImportHistory(t *testing.T) {
+	openTestStore(t)
+
+	account, err := Accounts.Register("carol", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendHistory(t, "lobby", "live")
+
+	old := time.Now().Add(-48 * time.Hour)
+	file := transcript(t,
+		&ExportRecord{Time: old, Room: "lobby", Type: "message", ID: "m1", UID: account.UID, Author: "carol", Content: "old 1"},
+		// 冒充 carol 的 UID
+		&ExportRecord{Time: old.Add(time.Second), Room: "lobby", Type: "message", ID: "m2", UID: account.UID, Author: "mallory", Content: "old 2"},
+	)
+	n, err := ImportHistory(strings.NewReader(file), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("imported %d, want 2", n)
+	}
+
+	// 再次導入同一個文件不會重複
+	if n, err = ImportHistory(strings.NewReader(file), ""); err != nil || n != 0 {
+		t.Errorf("re-import = %d, %v, want 0", n, err)
+	}
+
+	contents, uids := roomContents(t, "lobby")
+	if strings.Join(contents, ",") != "old 1,old 2,live" {
+		t.Errorf("contents = %v, want imported messages before the live one", contents)
+	}
+	if uids[0] != account.UID || uids[1] != 0 {
+		t.Errorf("uids = %v, want %d for carol and 0 for the impersonation", uids[:2], account.UID)
+	}
+}
+
+func TestMigrateHistoryKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatroom.db")
+	if err := OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 舊版本以序列為 key，保存順序與時間順序不同
+	now := time.Now()
+	legacy := []*Message{
+		{ID: "b", Type: MsgTypeNormal, Room: "lobby", Content: "second", MsgTime: now, User: &User{UID: 1, NickName: "alice"}},
+		{ID: "a", Type: MsgTypeNormal, Room: "lobby", Content: "first", MsgTime: now.Add(-time.Hour), User: &User{UID: 1, NickName: "alice"}},
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyBucket).CreateBucket([]byte("lobby"))
+		if err != nil {
+			return err
+		}
+		for _, msg := range legacy {
+			seq, _ := b.NextSequence()
+			key := historyKey(time.Time{}, seq)[8:]
+			v, _ := json.Marshal(msg)
+			if err = b.Put(key, v); err != nil {
+				return err
+			}
+			if err = indexMessage(tx, msg, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CloseStore()
+
+	// 重新打開時轉換
+	if err = OpenStore(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		CloseStore()
+		db = nil
+	})
+
+	if contents, _ := roomContents(t, "lobby"); strings.Join(contents, ",") != "first,second" {
+		t.Errorf("contents = %v, want time order", contents)
+	}
+	results, err := History.Search(&SearchQuery{Text: "second", Room: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Message.ID != "b" {
+		t.Errorf("search after migration = %d results, want the migrated message", len(results))
+	}
+}
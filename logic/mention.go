@@ -0,0 +1,188 @@
+package logic
+
+/*
+@ 提及：消息中的 @昵稱 只有對應到已知用戶（在線用戶、註冊帳號或機器人）時才算提及，
+以 UID、昵稱以及在消息中的位置保存到 Message.Ats。
+@all 提及房間中的所有人（包括曾經加入過房間、現在不在線的用戶），@here 只提及房間中在線的人。
+
+被提及的用戶在線時會單獨收到一條 MsgTypeHighlight 提醒，不在線時提及的消息保存為離線消息。
+*/
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 群組提及
+const (
+	MentionAll  = "all"
+	MentionHere = "here"
+)
+
+// 一條消息最多解析的提及數量
+const maxMentions = 20
+
+// Mention 消息中的一個 @
+type Mention struct {
+	UID      int    `json:"uid"`
+	NickName string `json:"nickname"`
+	// 群組提及 all 或 here，此時 UID 為 0
+	Group string `json:"group,omitempty"`
+	// @ 在 content 中的位置以及包含 @ 在內的長度，單位為字符
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// ParseMentions 解析 content 中的 @，lookup 返回昵稱對應的 UID，不是已知用戶時返回 false
+// @ 後面的內容可能帶有標點（例如 "@bob，"），因此從最長的前綴開始嘗試
+func ParseMentions(content string, lookup func(nickname string) (int, bool)) []Mention {
+	var (
+		mentions []Mention
+		prev     rune
+		offset   int
+	)
+	for i, r := range content {
+		offset++
+		if r != '@' || isMentionWordRune(prev) {
+			// 前面緊挨著 ASCII 字母或數字的 @（例如郵件地址）不是提及，中文等其他文字後面的 @ 仍然是提及
+			prev = r
+			continue
+		}
+		prev = r
+
+		// @ 後面到空白或下一個 @ 為止的部分
+		rest := content[i+1:]
+		if end := strings.IndexFunc(rest, func(r rune) bool { return unicode.IsSpace(r) || r == '@' }); end >= 0 {
+			rest = rest[:end]
+		}
+
+		if m, ok := resolveMention(rest, lookup); ok {
+			m.Offset = offset - 1
+			m.Length = utf8.RuneCountInString(m.NickName) + 1
+			mentions = append(mentions, m)
+			if len(mentions) >= maxMentions {
+				break
+			}
+		}
+	}
+	return mentions
+}
+
+// resolveMention 依次嘗試 word 最長的前綴，找到第一個群組名或已知用戶
+func resolveMention(word string, lookup func(nickname string) (int, bool)) (Mention, bool) {
+	// 每個字符的結束位置，昵稱長度為 2-20 字節
+	var ends []int
+	for i := range word {
+		if i >= 2 && i <= 20 {
+			ends = append(ends, i)
+		}
+	}
+	if l := len(word); l >= 2 && l <= 20 {
+		ends = append(ends, l)
+	}
+
+	for i := len(ends) - 1; i >= 0; i-- {
+		candidate := word[:ends[i]]
+		// 昵稱後面緊挨著英文字母或數字時不是完整的昵稱，例如 @allen 不是 @all
+		if tail := word[ends[i]:]; tail != "" && isASCIIWordByte(tail[0]) {
+			continue
+		}
+
+		switch group := strings.ToLower(candidate); group {
+		case MentionAll, MentionHere:
+			return Mention{NickName: candidate, Group: group}, true
+		}
+		if uid, ok := lookup(candidate); ok {
+			return Mention{UID: uid, NickName: candidate}, true
+		}
+	}
+	return Mention{}, false
+}
+
+func isASCIIWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// isMentionWordRune 只有郵件地址中可能出現的 ASCII 字符才會阻止其後的 @ 成為提及，
+// 中文等不用空格分詞的文字常常直接接 @（例如 "謝謝@bob"）
+func isMentionWordRune(r rune) bool {
+	return r < utf8.RuneSelf && (isASCIIWordByte(byte(r)) || r == '.' || r == '-')
+}
+
+// lookupKnownUser 查找昵稱對應的 UID：在線用戶、機器人、註冊帳號
+func lookupKnownUser(online map[string]*User) func(nickname string) (int, bool) {
+	return func(nickname string) (int, bool) {
+		if u, ok := online[nickname]; ok {
+			return u.UID, true
+		}
+		if r, ok := bots[nickname]; ok && r.ctx.user != nil {
+			return r.ctx.user.UID, true
+		}
+		if uid, ok := Accounts.UID(nickname); ok {
+			return uid, true
+		}
+		return 0, false
+	}
+}
+
+// mentionsMiddleware 解析 content 中的 @，並對應到已知用戶
+func mentionsMiddleware(msg *Message) (MiddlewareResult, error) {
+	msg.Ats = nil
+	if !strings.Contains(msg.Content, "@") {
+		return MiddlewareContinue, nil
+	}
+
+	online := make(map[string]*User)
+	for _, u := range Broadcaster.GetUserList() {
+		online[u.NickName] = u
+	}
+	msg.Ats = ParseMentions(msg.Content, lookupKnownUser(online))
+	return MiddlewareContinue, nil
+}
+
+// notifyMentions 廣播器調用：給在線的被提及者發送提醒，不在線的保存為離線消息
+func (b *broadcaster) notifyMentions(msg *Message) {
+	if len(msg.Ats) == 0 || msg.Room == "" {
+		return
+	}
+
+	highlighted := map[int]bool{msg.User.UID: true}
+	saved := make(map[string]bool)
+	highlight := func(u *User) {
+		if !highlighted[u.UID] {
+			highlighted[u.UID] = true
+			u.MessageChannel <- NewHighlightMessage(msg)
+		}
+	}
+	saveOffline := func(nickname string, uid int) {
+		if !saved[nickname] {
+			saved[nickname] = true
+			OfflineProcessor.SaveMention(nickname, uid, msg)
+		}
+	}
+
+	for _, m := range msg.Ats {
+		switch m.Group {
+		case MentionAll, MentionHere:
+			for _, u := range b.users {
+				if _, in := u.rooms[msg.Room]; in {
+					highlight(u)
+				}
+			}
+			if m.Group == MentionAll {
+				for _, nickname := range OfflineProcessor.RoomMembers(msg.Room) {
+					if _, online := b.users[nickname]; !online && nickname != msg.User.NickName {
+						saveOffline(nickname, 0)
+					}
+				}
+			}
+		default:
+			if u, ok := b.users[m.NickName]; ok && u.UID == m.UID {
+				highlight(u)
+			} else if !isBotName(m.NickName) {
+				saveOffline(m.NickName, m.UID)
+			}
+		}
+	}
+}
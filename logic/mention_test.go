@@ -0,0 +1,24 @@
+package logic
+
+import "testing"
+
+func TestParseMentionsBoundary(t *testing.T) {
+	lookup := func(nickname string) (int, bool) { return 2, nickname == "bob" }
+
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"@bob hi", true},
+		{"謝謝@bob", true},
+		{"（@bob）", true},
+		{"mail bob@bob", false},
+		{"a.@bob", false},
+		{"x_@bob", false},
+	}
+	for _, tt := range tests {
+		if got := len(ParseMentions(tt.content, lookup)) == 1; got != tt.want {
+			t.Errorf("ParseMentions(%q) mentions bob = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package logic
 
 import (
+	"errors"
 	"github.com/spf13/cast"
+	"strings"
 	"time"
 )
 
@@ -12,15 +14,41 @@ iota 是 Go 的常數計數器，從 0 開始，每定義一個新常數，值
 這種方式讓程式碼更 簡潔 且 易於擴展，如果未來要新增訊息類型，只需在 const 區塊內加一行即可。
 */
 const (
-	MsgTypeNormal    = iota // 普通 用戶訊息
-	MsgTypeWelcome          // 當前用户歡迎訊息
-	MsgTypeUserEnter        // 用戶進入聊天室
-	MsgTypeUserLeave        // 用戶離開聊天室
-	MsgTypeError            // 錯誤消息
+	MsgTypeNormal     = iota // 普通 用戶訊息
+	MsgTypeWelcome           // 當前用户歡迎訊息
+	MsgTypeUserEnter         // 用戶進入聊天室
+	MsgTypeUserLeave         // 用戶離開聊天室
+	MsgTypeError             // 錯誤消息
+	MsgTypeCommand           // 指令執行結果，只發給執行者
+	MsgTypeAction            // /me 動作消息
+	MsgTypeTopic             // 房間話題變更
+	MsgTypeUserRename        // 用戶改名
+	MsgTypeToken             // 刷新後的 token，只發給本人
+	MsgTypeRoomJoined        // 自己加入了房間，附帶房間成員和話題，只發給本人
+	MsgTypeReaction          // 對某條消息的回應（表情）
+	MsgTypeHighlight         // 有人 @ 了您，只發給被提及的人
+	MsgTypeRead              // 已讀回執，某個用戶已讀到房間的第 seq 條消息
 )
 
+// DefaultRoom 用戶進入聊天室時自動加入的房間
+const DefaultRoom = "lobby"
+
+// CheckRoomName 檢查房間名稱是否合法
+func CheckRoomName(room string) error {
+	if l := len(room); l < 1 || l > 32 {
+		return errors.New("房間名稱長度不合法，長度：1-32")
+	}
+	if strings.ContainsAny(room, " ,:#\r\n\t\x00\x07") {
+		return errors.New("房間名稱不能包含空白、逗號、冒號或 #")
+	}
+	return nil
+}
+
 // 給用戶發送的消息
 type Message struct {
+	// 消息的唯一編號，回應消息通過它指明回應的是哪條消息
+	ID string `json:"id,omitempty"`
+
 	// 哪個用戶發送的消息
 	User    *User     `json:"user"`
 	Type    int       `json:"type"`
@@ -30,16 +58,46 @@ type Message struct {
 	ClientSendTime time.Time `json:"client_send_time"`
 
 	// 消息 @ 了誰
-	Ats []string `json:"ats"`
+	Ats []Mention `json:"ats"`
+
+	// 消息所屬的房間，為空時表示與房間無關（例如離開聊天室、改名）
+	Room string `json:"room"`
+
+	// 房間內的消息序號，由廣播器分配，客戶端以它回報已讀位置；
+	// 加入房間消息中為房間最新的序號，已讀回執中為已讀到的序號
+	Seq int64 `json:"seq,omitempty"`
+
+	// 加入房間消息中的未讀數量
+	Unread int `json:"unread,omitempty"`
+
+	// 可靠投遞模式下的投遞序號，客戶端以 {"type": "ack", "seq": "N"} 確認收到
+	Delivery int64 `json:"delivery,omitempty"`
 
-	// 用戶列表不通過 WebSocket 下發
-	//Users []*User `json:"users"`
+	// 私聊消息的接收者昵稱，不為空時只發給該用戶
+	To string `json:"to,omitempty"`
+
+	// 回應消息所回應的消息編號
+	ReplyTo string `json:"reply_to,omitempty"`
+
+	// 改名消息中的舊昵稱
+	OldNickName string `json:"old_nickname,omitempty"`
+
+	// 消息附帶的附件
+	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	// 消息處理管道添加的標註，例如 links、spam_score
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+
+	// 用戶列表不通過 WebSocket 廣播，只在加入房間時發給本人
+	Users []*User `json:"users,omitempty"`
 }
 
 // NewMessage 創建消息
-func NewMessage(user *User, content, clientTime string) *Message {
+func NewMessage(user *User, room, content, clientTime string) *Message {
 	message := &Message{
-		User:    user,
+		ID:      genTokenID(),
+		User:    user.snapshot(),
+		Room:    room,
 		Type:    MsgTypeNormal,
 		Content: content,
 		MsgTime: time.Now(),
@@ -52,25 +110,38 @@ func NewMessage(user *User, content, clientTime string) *Message {
 
 func NewWelcomeMessage(user *User) *Message {
 	return &Message{
-		User:    user,
+		User:    user.snapshot(),
 		Type:    MsgTypeWelcome,
 		Content: user.NickName + " 您好，歡迎加入聊天室！",
 		MsgTime: time.Now(),
 	}
 }
 
-func NewUserEnterMessage(user *User) *Message {
+func NewUserEnterMessage(user *User, room string) *Message {
 	return &Message{
-		User:    user,
+		User:    user.snapshot(),
+		Room:    room,
 		Type:    MsgTypeUserEnter,
-		Content: user.NickName + " 加入了聊天室",
+		Content: user.NickName + " 加入了房間 " + room,
+		MsgTime: time.Now(),
+	}
+}
+
+// NewUserPartMessage 創建用戶離開某個房間的消息
+func NewUserPartMessage(user *User, room string) *Message {
+	return &Message{
+		User:    user.snapshot(),
+		Room:    room,
+		Type:    MsgTypeUserLeave,
+		Content: user.NickName + " 離開了房間 " + room,
 		MsgTime: time.Now(),
 	}
 }
 
+// NewUserLeaveMessage 創建用戶離開聊天室的消息，發給與他同在某個房間的用戶
 func NewUserLeaveMessage(user *User) *Message {
 	return &Message{
-		User:    user,
+		User:    user.snapshot(),
 		Type:    MsgTypeUserLeave,
 		Content: user.NickName + " 離開了聊天室",
 		MsgTime: time.Now(),
@@ -85,3 +156,130 @@ func NewErrorMessage(content string) *Message {
 		MsgTime: time.Now(),
 	}
 }
+
+// NewCommandMessage 創建指令執行結果消息
+func NewCommandMessage(content string) *Message {
+	return &Message{
+		User:    System,
+		Type:    MsgTypeCommand,
+		Content: content,
+		MsgTime: time.Now(),
+	}
+}
+
+func NewActionMessage(user *User, room, action string) *Message {
+	return &Message{
+		ID:      genTokenID(),
+		User:    user.snapshot(),
+		Room:    room,
+		Type:    MsgTypeAction,
+		Content: action,
+		MsgTime: time.Now(),
+	}
+}
+
+// NewTopicMessage 創建話題變更消息，Content 為新話題，由客戶端自行組織顯示內容
+func NewTopicMessage(user *User, room, topic string) *Message {
+	return &Message{
+		User:    user.snapshot(),
+		Room:    room,
+		Type:    MsgTypeTopic,
+		Content: topic,
+		MsgTime: time.Now(),
+	}
+}
+
+func NewUserRenameMessage(user *User, oldNickname string) *Message {
+	return &Message{
+		User:    user.snapshot(),
+		Type:    MsgTypeUserRename,
+		Content: oldNickname + " 改名為 " + user.NickName,
+		MsgTime: time.Now(),
+
+		OldNickName: oldNickname,
+	}
+}
+
+// NewTokenMessage 創建 token 刷新消息，user 需帶有新的 token
+func NewTokenMessage(user *User) *Message {
+	return &Message{
+		User:    user.snapshot(),
+		Type:    MsgTypeToken,
+		MsgTime: time.Now(),
+	}
+}
+
+// NewRoomJoinedMessage 創建加入房間成功的消息，Content 為房間話題，Users 為房間成員，
+// seq 為房間最新的消息序號，unread 為未讀數量
+func NewRoomJoinedMessage(user *User, room, topic string, members []*User, seq int64, unread int) *Message {
+	return &Message{
+		User:    user.snapshot(),
+		Room:    room,
+		Type:    MsgTypeRoomJoined,
+		Content: topic,
+		MsgTime: time.Now(),
+		Users:   members,
+		Seq:     seq,
+		Unread:  unread,
+	}
+}
+
+// NewReadReceiptMessage 創建已讀回執，user 已讀到 room 的第 seq 條消息
+func NewReadReceiptMessage(user *User, room string, seq int64) *Message {
+	return &Message{
+		User:    user.snapshot(),
+		Room:    room,
+		Type:    MsgTypeRead,
+		MsgTime: time.Now(),
+		Seq:     seq,
+	}
+}
+
+// NewDirectMessage 創建發給 to 的私聊消息
+func NewDirectMessage(user *User, to, content string) *Message {
+	return &Message{
+		ID:      genTokenID(),
+		User:    user.snapshot(),
+		To:      to,
+		Type:    MsgTypeNormal,
+		Content: content,
+		MsgTime: time.Now(),
+	}
+}
+
+// NewReactionMessage 創建對 target 的回應消息，Content 為表情
+// 回應房間消息時發到該房間，回應私聊時發回給私聊的發送者
+func NewReactionMessage(user *User, target *Message, emoji string) *Message {
+	msg := &Message{
+		User:    user.snapshot(),
+		Room:    target.Room,
+		Type:    MsgTypeReaction,
+		Content: emoji,
+		MsgTime: time.Now(),
+		ReplyTo: target.ID,
+	}
+	if target.To != "" {
+		msg.To = target.User.NickName
+	}
+	return msg
+}
+
+// Annotate 給消息添加標註
+func (m *Message) Annotate(key string, value interface{}) {
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]interface{})
+	}
+	m.Annotations[key] = value
+}
+
+// NewHighlightMessage 創建提及提醒，發給 msg 中被 @ 的在線用戶
+func NewHighlightMessage(msg *Message) *Message {
+	return &Message{
+		User:    msg.User,
+		Room:    msg.Room,
+		Type:    MsgTypeHighlight,
+		Content: msg.Content,
+		MsgTime: time.Now(),
+		ReplyTo: msg.ID,
+	}
+}
@@ -0,0 +1,308 @@
+package logic
+
+/*
+消息處理管道：用戶、機器人發出的消息在廣播之前，依次經過設定檔 message.pipeline 中配置的處理階段。
+每個階段可以：
+  - 修改消息內容（例如過濾敏感字）
+  - 給消息添加標註（例如 @ 了誰、消息中的鏈接、垃圾消息評分）
+  - 返回 error 拒絕消息，錯誤只回給發送者
+  - 返回 MiddlewareAccept 跳過後面的階段直接廣播，或返回 MiddlewareDrop 靜默丟棄
+
+內置的階段：filter、mentions、links、ratelimit、spam，
+其他團隊可以在自己的包中通過 RegisterMiddleware 註冊新的階段，再加入設定檔即可，不需要修改 user.go。
+*/
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/spf13/viper"
+)
+
+// MiddlewareResult 處理階段的結果
+type MiddlewareResult int
+
+const (
+	MiddlewareContinue MiddlewareResult = iota // 繼續下一個階段
+	MiddlewareAccept                           // 跳過後面的階段，直接廣播
+	MiddlewareDrop                             // 靜默丟棄，不告知發送者
+)
+
+// MessageMiddleware 消息處理階段，返回的 error 表示拒絕該消息
+type MessageMiddleware func(msg *Message) (MiddlewareResult, error)
+
+// middlewareFactories 處理階段註冊表，key 為設定檔中使用的名稱
+// 處理階段只在啟動階段註冊，運行期間只讀，因此不需要加鎖
+var middlewareFactories = make(map[string]func() MessageMiddleware)
+
+// RegisterMiddleware 註冊處理階段，factory 在第一次處理消息時調用，可以在其中讀取設定檔。
+// 管道在第一條消息時創建，之後註冊的階段不會生效，因此這時註冊會 panic
+func RegisterMiddleware(name string, factory func() MessageMiddleware) {
+	if pipelineBuilt.Load() {
+		panic("logic: RegisterMiddleware(" + name + ") called after the message pipeline was built")
+	}
+	middlewareFactories[name] = factory
+}
+
+// 沒有配置 message.pipeline 時的處理階段，與之前的行為相同
+var defaultPipeline = []string{"filter", "mentions"}
+
+var (
+	pipeline      []MessageMiddleware
+	pipelineOnce  sync.Once
+	pipelineBuilt atomic.Bool
+	// 管道中的 ratelimit 階段，指令也按它限制頻率，沒有配置 ratelimit 時為 nil
+	commandLimiter MessageMiddleware
+)
+
+// buildPipeline 按設定檔的順序創建處理階段，未知的名稱會被忽略並記錄日誌
+func buildPipeline() {
+	pipelineBuilt.Store(true)
+
+	names := viper.GetStringSlice("message.pipeline")
+	if len(names) == 0 {
+		names = defaultPipeline
+	}
+
+	for _, name := range names {
+		factory, ok := middlewareFactories[name]
+		if !ok {
+			log.Println("unknown message middleware:", name)
+			continue
+		}
+		m := factory()
+		if name == "ratelimit" {
+			commandLimiter = m
+		}
+		pipeline = append(pipeline, m)
+	}
+}
+
+// chargeCommand 執行指令與發言共用同一個按 UID 的頻率限制，超出時返回 error
+func chargeCommand(u *User) error {
+	pipelineOnce.Do(buildPipeline)
+
+	if commandLimiter == nil {
+		return nil
+	}
+	_, err := commandLimiter(&Message{User: u})
+	return err
+}
+
+// RunPipeline 讓消息依次經過各個處理階段，返回是否應該廣播；返回 error 時消息被拒絕
+func RunPipeline(msg *Message) (bool, error) {
+	pipelineOnce.Do(buildPipeline)
+
+	for _, m := range pipeline {
+		result, err := m(msg)
+		if err != nil {
+			return false, err
+		}
+		switch result {
+		case MiddlewareAccept:
+			return true, nil
+		case MiddlewareDrop:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func init() {
+	RegisterMiddleware("filter", func() MessageMiddleware { return filterMiddleware })
+	RegisterMiddleware("mentions", func() MessageMiddleware { return mentionsMiddleware })
+	RegisterMiddleware("links", func() MessageMiddleware { return linksMiddleware })
+	RegisterMiddleware("ratelimit", newRateLimitMiddleware)
+	RegisterMiddleware("spam", newSpamMiddleware)
+}
+
+// filterMiddleware 過濾敏感字
+func filterMiddleware(msg *Message) (MiddlewareResult, error) {
+	msg.Content = FilterSensitive(msg.Content)
+	return MiddlewareContinue, nil
+}
+
+// 匹配 content 中的鏈接
+var linkRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// linksMiddleware 把消息中的鏈接標註到 annotations.links
+func linksMiddleware(msg *Message) (MiddlewareResult, error) {
+	if links := linkRegexp.FindAllString(msg.Content, -1); len(links) > 0 {
+		msg.Annotate("links", links)
+	}
+	return MiddlewareContinue, nil
+}
+
+var errRateLimited = errors.New("發言太頻繁，請稍後再試")
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimitMiddleware 按 UID 限制發言頻率：每秒補充 message.rate-limit.rate 個令牌，最多累積 burst 個
+func newRateLimitMiddleware() MessageMiddleware {
+	rate := viper.GetFloat64("message.rate-limit.rate")
+	if rate <= 0 {
+		rate = 1
+	}
+	burst := viper.GetFloat64("message.rate-limit.burst")
+	if burst < 1 {
+		burst = 5
+	}
+
+	var (
+		mu      sync.Mutex
+		buckets = make(map[int]*tokenBucket)
+	)
+	return func(msg *Message) (MiddlewareResult, error) {
+		if isInProcessBot(msg.User) {
+			return MiddlewareContinue, nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		// 令牌已經補滿的桶與新建的桶沒有區別，用戶數較多時清理掉
+		if len(buckets) > 1024 {
+			for uid, b := range buckets {
+				if now.Sub(b.last).Seconds()*rate >= burst {
+					delete(buckets, uid)
+				}
+			}
+		}
+
+		b, ok := buckets[msg.User.UID]
+		if !ok {
+			b = &tokenBucket{tokens: burst, last: now}
+			buckets[msg.User.UID] = b
+		}
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+
+		if b.tokens < 1 {
+			return MiddlewareContinue, errRateLimited
+		}
+		b.tokens--
+		return MiddlewareContinue, nil
+	}
+}
+
+var errSpam = errors.New("消息被判定為垃圾消息")
+
+// 重複消息的計算窗口
+const spamRepeatWindow = 30 * time.Second
+
+// 短於該長度（字符數）的消息不計算重複，例如 ok、+1、哈哈 在聊天中經常重複出現，刷屏由 ratelimit 限制
+const spamRepeatMinLen = 8
+
+// lastContent 用戶上一條消息，用於判斷重複發送
+type lastContent struct {
+	content string
+	at      time.Time
+	repeats int
+}
+
+// newSpamMiddleware 根據簡單的規則給消息評分，標註到 annotations.spam_score，
+// 分數達到 message.spam.threshold 時拒絕
+func newSpamMiddleware() MessageMiddleware {
+	threshold := viper.GetInt("message.spam.threshold")
+	if threshold <= 0 {
+		threshold = 10
+	}
+
+	var (
+		mu   sync.Mutex
+		last = make(map[int]*lastContent)
+	)
+	return func(msg *Message) (MiddlewareResult, error) {
+		if isInProcessBot(msg.User) {
+			return MiddlewareContinue, nil
+		}
+		score := spamContentScore(msg.Content)
+
+		// 短時間內重複發送相同內容
+		if utf8.RuneCountInString(strings.TrimSpace(msg.Content)) >= spamRepeatMinLen {
+			now := time.Now()
+			mu.Lock()
+			if len(last) > 1024 {
+				for uid, l := range last {
+					if now.Sub(l.at) > spamRepeatWindow {
+						delete(last, uid)
+					}
+				}
+			}
+			l, ok := last[msg.User.UID]
+			if ok && l.content == msg.Content && now.Sub(l.at) < spamRepeatWindow {
+				l.repeats++
+			} else {
+				l = &lastContent{content: msg.Content}
+				last[msg.User.UID] = l
+			}
+			l.at = now
+			score += 4 * l.repeats
+			mu.Unlock()
+		}
+
+		msg.Annotate("spam_score", score)
+		if score >= threshold {
+			return MiddlewareContinue, errSpam
+		}
+		return MiddlewareContinue, nil
+	}
+}
+
+// spamContentScore 只根據內容本身評分：過多的鏈接、@、連續重複的字符以及大量大寫字母
+func spamContentScore(content string) int {
+	score := 0
+
+	if n := len(linkRegexp.FindAllString(content, -1)); n > 2 {
+		score += 2 * (n - 2)
+	}
+	if n := strings.Count(content, "@"); n > 5 {
+		score += n - 5
+	}
+
+	var (
+		prev       rune
+		run        int
+		letters    int
+		upper      int
+		longestRun int
+	)
+	for _, r := range content {
+		if r == prev {
+			run++
+		} else {
+			prev, run = r, 1
+		}
+		if run > longestRun {
+			longestRun = run
+		}
+		if unicode.IsLetter(r) && r < unicode.MaxASCII {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if longestRun >= 10 {
+		score += 3
+	}
+	if letters >= 20 && upper*10 >= letters*8 {
+		score += 2
+	}
+	return score
+}
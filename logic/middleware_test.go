@@ -0,0 +1,57 @@
+package logic
+
+import "testing"
+
+func TestSpamShortRepeats(t *testing.T) {
+	spam := newSpamMiddleware()
+	alice := &User{UID: 1, NickName: "alice"}
+
+	// 短消息重複發送不算垃圾消息
+	for i := 0; i < 10; i++ {
+		if _, err := spam(NewMessage(alice, "lobby", "ok", "")); err != nil {
+			t.Fatalf("ok #%d rejected: %v", i+1, err)
+		}
+	}
+
+	// 較長的消息短時間內重複發送會被拒絕
+	content := "buy cheap followers now"
+	var err error
+	for i := 0; i < 4 && err == nil; i++ {
+		_, err = spam(NewMessage(alice, "lobby", content, ""))
+	}
+	if err != errSpam {
+		t.Errorf("repeated %q: err = %v, want errSpam", content, err)
+	}
+}
+
+func TestRegisterMiddlewareAfterBuild(t *testing.T) {
+	pipelineOnce.Do(buildPipeline)
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering after the pipeline was built did not panic")
+		}
+	}()
+	RegisterMiddleware("late", func() MessageMiddleware { return nil })
+}
+
+func TestCommandsAreRateLimited(t *testing.T) {
+	pipelineOnce.Do(buildPipeline)
+	old := commandLimiter
+	commandLimiter = newRateLimitMiddleware()
+	t.Cleanup(func() { commandLimiter = old })
+
+	u := &User{UID: 1, NickName: "alice", Role: RoleUser, MessageChannel: make(chan *Message, 16)}
+	// 預設 burst 為 5，第 6 條指令被拒絕
+	for i := 0; i < 6; i++ {
+		u.ExecCommand("lobby", "/help")
+	}
+	for i := 0; i < 5; i++ {
+		if msg := <-u.MessageChannel; msg.Type == MsgTypeError {
+			t.Fatalf("command #%d rejected: %s", i+1, msg.Content)
+		}
+	}
+	if msg := <-u.MessageChannel; msg.Type != MsgTypeError || msg.Content != errRateLimited.Error() {
+		t.Errorf("command #6 = %q, want it rate limited", msg.Content)
+	}
+}
@@ -0,0 +1,152 @@
+package logic
+
+/*
+內置的通知方式：
+  - email：通過 SMTP 發送郵件到註冊用戶 /notify email 設置並確認過的地址，沒有確認地址的用戶不發送。
+  - http：把通知以 JSON POST 到 notify.http.url，由推送網關轉發到手機等設備，
+    請求體使用 notify.http.secret 做 HMAC-SHA256 簽名，放在 X-Chatroom-Signature 請求頭中。
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	RegisterNotifier("email", newEmailNotifier)
+	RegisterNotifier("http", newHTTPNotifier)
+}
+
+// notificationText 通知的標題和正文
+func notificationText(n *Notification) (string, string) {
+	from := n.Message.NickName
+	var subject string
+	if n.Kind == NotifyDirect {
+		subject = from + " 給您發送了私聊"
+	} else {
+		subject = from + " 在房間 " + n.Message.Room + " 中提到了您"
+	}
+	body := fmt.Sprintf("[%s] %s: %s", n.Message.MsgTime.Format("2006-01-02 15:04:05"), from, n.Message.Content)
+	return subject, body
+}
+
+type emailNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newEmailNotifier() (Notifier, error) {
+	n := &emailNotifier{
+		addr: viper.GetString("notify.email.addr"),
+		from: viper.GetString("notify.email.from"),
+	}
+	if n.addr == "" || n.from == "" {
+		return nil, errors.New("notify.email.addr and notify.email.from are required")
+	}
+	if username := viper.GetString("notify.email.username"); username != "" {
+		host, _, _ := strings.Cut(n.addr, ":")
+		n.auth = smtp.PlainAuth("", username, viper.GetString("notify.email.password"), host)
+	}
+	return n, nil
+}
+
+func (e *emailNotifier) Notify(n *Notification, prefs *NotifyPrefs) error {
+	if prefs.Email == "" {
+		return nil
+	}
+
+	subject, body := notificationText(n)
+	return e.send(prefs.Email, subject, body, n.Time)
+}
+
+// sendConfirm 發送確認郵件地址的確認碼
+func (e *emailNotifier) sendConfirm(to, code string) error {
+	body := "您的確認碼：" + code + "\n在聊天室中輸入 /notify confirm " + code + " 後，離線通知會發送到該地址。\n" +
+		"如果不是您本人的操作，請忽略這封郵件。"
+	return e.send(to, "聊天室通知郵件地址確認", body, time.Now())
+}
+
+// send 發送純文本郵件
+func (e *emailNotifier) send(to, subject, body string, t time.Time) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", t.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	return smtp.SendMail(e.addr, e.auth, e.from, []string{to}, msg.Bytes())
+}
+
+type httpNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newHTTPNotifier() (Notifier, error) {
+	n := &httpNotifier{
+		url:    viper.GetString("notify.http.url"),
+		secret: viper.GetString("notify.http.secret"),
+	}
+	if n.url == "" {
+		return nil, errors.New("notify.http.url is required")
+	}
+	timeout := viper.GetDuration("notify.http.timeout")
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	n.client = &http.Client{Timeout: timeout}
+	return n, nil
+}
+
+// httpNotification POST 給推送網關的內容
+type httpNotification struct {
+	*Notification
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+func (h *httpNotifier) Notify(n *Notification, prefs *NotifyPrefs) error {
+	title, body := notificationText(n)
+	data, err := json.Marshal(&httpNotification{Notification: n, Title: title, Body: body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-chatroom-notify")
+	req.Header.Set("X-Chatroom-Signature", "sha256="+hex.EncodeToString(macSha256(data, []byte(h.secret))))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", h.url, resp.Status)
+	}
+	return nil
+}
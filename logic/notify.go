@@ -0,0 +1,459 @@
+package logic
+
+/*
+離線通知：不在線的用戶被 @ 或收到私聊時，除了存入離線收件箱，還通過 Notifier 通知到聊天室之外（郵件、手機推送等）。
+
+1、通知方式在設定檔 notify.notifiers 中啟用，內置 email（SMTP）和 http（POST JSON，簽名方式與 webhook 相同），
+   其他團隊可以通過 RegisterNotifier 註冊新的方式。
+2、每個用戶可以用 /notify 指令設置：是否接收 @ 和私聊的通知、使用哪些通知方式、郵件地址以及免打擾時段，
+   設置按 UID 保存在 notify_prefs bucket 中。只有註冊用戶可以設置郵件地址；設置時先向該地址發送確認碼，
+   用戶用 /notify confirm <確認碼> 確認後才會收到通知郵件，避免把別人的郵箱設為收件地址。
+   確認碼每 emailConfirmInterval 最多發送一次，emailConfirmTTL 後失效。
+3、通知在獨立的 goroutine 中發送，不會阻塞廣播器；待發送隊列滿時直接丟棄並記錄日誌。
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var notifyPrefsBucket = []byte("notify_prefs")
+
+// 通知類型
+const (
+	NotifyMention = "mention"
+	NotifyDirect  = "direct"
+)
+
+// Notification 發給不在線用戶的一條通知
+type Notification struct {
+	Kind string `json:"kind"`
+	// 收件人
+	UID      int    `json:"uid"`
+	NickName string `json:"nickname"`
+	// 觸發通知的消息
+	Message *NotificationMessage `json:"message"`
+	Time    time.Time            `json:"time"`
+}
+
+// NotificationMessage 通知中的消息，只包含通知需要的字段，發送者只有 UID 和昵稱
+type NotificationMessage struct {
+	ID      string    `json:"id"`
+	Room    string    `json:"room,omitempty"`
+	Content string    `json:"content"`
+	MsgTime time.Time `json:"msg_time"`
+	// 發送者
+	UID      int    `json:"uid"`
+	NickName string `json:"nickname"`
+}
+
+func newNotificationMessage(msg *Message) *NotificationMessage {
+	return &NotificationMessage{
+		ID:       msg.ID,
+		Room:     msg.Room,
+		Content:  msg.Content,
+		MsgTime:  msg.MsgTime,
+		UID:      msg.User.UID,
+		NickName: msg.User.NickName,
+	}
+}
+
+// Notifier 通知方式，prefs 為收件人的通知設置
+type Notifier interface {
+	Notify(n *Notification, prefs *NotifyPrefs) error
+}
+
+// notifierFactories 通知方式註冊表，key 為設定檔中使用的名稱
+// 只在啟動階段註冊，運行期間只讀，因此不需要加鎖
+var notifierFactories = make(map[string]func() (Notifier, error))
+
+// RegisterNotifier 註冊通知方式，factory 在 Notifications.Start 時調用，可以在其中讀取設定檔
+func RegisterNotifier(name string, factory func() (Notifier, error)) {
+	notifierFactories[name] = factory
+}
+
+type notificationDispatcher struct {
+	// 已啟用的通知方式，key 為名稱
+	notifiers map[string]Notifier
+	queue     chan *Notification
+}
+
+// Notifications 離線通知分發器，需要調用 Start 後才會發送
+var Notifications = &notificationDispatcher{}
+
+// Start 按設定檔啟用通知方式並啟動發送 goroutine，沒有啟用任何方式時不做任何事
+func (d *notificationDispatcher) Start() error {
+	d.notifiers = make(map[string]Notifier)
+	for _, name := range viper.GetStringSlice("notify.notifiers") {
+		factory, ok := notifierFactories[name]
+		if !ok {
+			return fmt.Errorf("unknown notifier: %s", name)
+		}
+		notifier, err := factory()
+		if err != nil {
+			return fmt.Errorf("notifier %s: %w", name, err)
+		}
+		d.notifiers[name] = notifier
+	}
+	if len(d.notifiers) == 0 {
+		return nil
+	}
+
+	queueSize := viper.GetInt("notify.queue-size")
+	if queueSize <= 0 {
+		queueSize = 256
+	}
+	d.queue = make(chan *Notification, queueSize)
+	go d.work()
+	return nil
+}
+
+// Notify 由離線消息處理器調用，排隊發送通知，不會阻塞調用者
+func (d *notificationDispatcher) Notify(kind, nickname string, uid int, msg *Message) {
+	if d.queue == nil {
+		return
+	}
+
+	n := &Notification{Kind: kind, UID: uid, NickName: nickname, Message: newNotificationMessage(msg), Time: time.Now()}
+	select {
+	case d.queue <- n:
+	default:
+		log.Println("notification queue is full, drop notification to", nickname)
+	}
+}
+
+func (d *notificationDispatcher) work() {
+	for n := range d.queue {
+		prefs, err := NotifyPrefsStore.Get(n.UID)
+		if err != nil {
+			log.Println("load notify prefs error:", err)
+			continue
+		}
+		if !prefs.Wants(n.Kind) || prefs.InQuietHours(n.Time) {
+			continue
+		}
+
+		for name, notifier := range d.notifiers {
+			if !prefs.Uses(name) {
+				continue
+			}
+			if err := notifier.Notify(n, prefs); err != nil {
+				log.Println("notifier", name, "error:", err)
+			}
+		}
+	}
+}
+
+// NotifyPrefs 用戶的通知設置
+type NotifyPrefs struct {
+	// 關閉 @ 或私聊的通知
+	MuteMentions bool `json:"mute_mentions,omitempty"`
+	MuteDirect   bool `json:"mute_direct,omitempty"`
+	// 使用的通知方式，為空時使用全部已啟用的方式
+	Via []string `json:"via,omitempty"`
+	// email 通知方式的收件地址，已經過確認
+	Email string `json:"email,omitempty"`
+	// 等待確認的郵件地址、確認碼的 SHA-256 以及確認碼的發送時間
+	PendingEmail  string    `json:"pending_email,omitempty"`
+	EmailCodeHash string    `json:"email_code_hash,omitempty"`
+	EmailCodeSent time.Time `json:"email_code_sent,omitempty"`
+	// 免打擾時段，格式 HH:MM，開始晚於結束時表示跨越午夜，例如 22:00-07:00
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+	// 免打擾時段使用的時區，例如 Asia/Taipei，為空時使用服務器時區
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Wants 是否接收該類型的通知
+func (p *NotifyPrefs) Wants(kind string) bool {
+	switch kind {
+	case NotifyMention:
+		return !p.MuteMentions
+	case NotifyDirect:
+		return !p.MuteDirect
+	}
+	return true
+}
+
+// Uses 是否使用名稱為 name 的通知方式
+func (p *NotifyPrefs) Uses(name string) bool {
+	if len(p.Via) == 0 {
+		return true
+	}
+	for _, via := range p.Via {
+		if via == name {
+			return true
+		}
+	}
+	return false
+}
+
+// InQuietHours t 是否在免打擾時段內
+func (p *NotifyPrefs) InQuietHours(t time.Time) bool {
+	start, err1 := parseClock(p.QuietStart)
+	end, err2 := parseClock(p.QuietEnd)
+	if err1 != nil || err2 != nil || start == end {
+		return false
+	}
+
+	if p.Timezone != "" {
+		if loc, err := time.LoadLocation(p.Timezone); err == nil {
+			t = t.In(loc)
+		}
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// parseClock 解析 HH:MM，返回從午夜開始的分鐘數
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// String 通知設置的說明
+func (p *NotifyPrefs) String() string {
+	onOff := func(mute bool) string {
+		if mute {
+			return "關閉"
+		}
+		return "開啟"
+	}
+	via := "全部"
+	if len(p.Via) > 0 {
+		via = strings.Join(p.Via, ",")
+	}
+	email := p.Email
+	if email == "" {
+		email = "（未設置）"
+	}
+	if p.PendingEmail != "" {
+		email += "，" + p.PendingEmail + " 等待確認"
+	}
+	quiet := "（未設置）"
+	if p.QuietStart != "" {
+		quiet = p.QuietStart + "-" + p.QuietEnd
+		if p.Timezone != "" {
+			quiet += " " + p.Timezone
+		}
+	}
+	return fmt.Sprintf("@ 通知：%s\n私聊通知：%s\n通知方式：%s\n郵件地址：%s\n免打擾：%s",
+		onOff(p.MuteMentions), onOff(p.MuteDirect), via, email, quiet)
+}
+
+type notifyPrefsStore struct{}
+
+// NotifyPrefsStore 用戶通知設置的存儲
+var NotifyPrefsStore = &notifyPrefsStore{}
+
+// Get 獲取用戶的通知設置，沒有設置過時返回預設設置
+func (s *notifyPrefsStore) Get(uid int) (*NotifyPrefs, error) {
+	if db == nil {
+		return nil, errStoreClosed
+	}
+
+	prefs := new(NotifyPrefs)
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(notifyPrefsBucket).Get([]byte(strconv.Itoa(uid)))
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(v, prefs)
+	})
+	return prefs, err
+}
+
+// Put 保存用戶的通知設置
+func (s *notifyPrefsStore) Put(uid int, prefs *NotifyPrefs) error {
+	if db == nil {
+		return errStoreClosed
+	}
+
+	v, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(notifyPrefsBucket).Put([]byte(strconv.Itoa(uid)), v)
+	})
+}
+
+var (
+	errNotifyUsage      = errors.New("參數錯誤")
+	errNotifyEmailGuest = errors.New("只有註冊用戶可以設置郵件地址")
+	errNotifyNoEmail    = errors.New("未啟用郵件通知")
+	errNotifyEmailCode  = errors.New("確認碼錯誤或已失效")
+)
+
+const (
+	// 同一用戶兩次發送確認碼的最短間隔
+	emailConfirmInterval = 10 * time.Minute
+	// 確認碼的有效期
+	emailConfirmTTL = 24 * time.Hour
+)
+
+// emailCodeHash 確認碼的 SHA-256，設置中只保存雜湊值
+func emailCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestEmailConfirm 向 addr 發送確認碼，並記錄到 prefs 中等待確認
+func requestEmailConfirm(prefs *NotifyPrefs, addr string) error {
+	email, ok := Notifications.notifiers["email"].(*emailNotifier)
+	if !ok {
+		return errNotifyNoEmail
+	}
+	if wait := emailConfirmInterval - time.Since(prefs.EmailCodeSent); wait > 0 {
+		return fmt.Errorf("確認碼發送太頻繁，請 %d 分鐘後再試", int(wait.Minutes())+1)
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	if err = email.sendConfirm(addr, code); err != nil {
+		log.Println("send email confirmation error:", err)
+		return errors.New("確認郵件發送失敗")
+	}
+	prefs.PendingEmail = addr
+	prefs.EmailCodeHash = emailCodeHash(code)
+	prefs.EmailCodeSent = time.Now()
+	return nil
+}
+
+// confirmEmail 確認碼正確時，把等待確認的地址設為收件地址
+func confirmEmail(prefs *NotifyPrefs, code string) error {
+	if prefs.PendingEmail == "" || time.Since(prefs.EmailCodeSent) > emailConfirmTTL ||
+		subtle.ConstantTimeCompare([]byte(emailCodeHash(code)), []byte(prefs.EmailCodeHash)) != 1 {
+		return errNotifyEmailCode
+	}
+	prefs.Email = prefs.PendingEmail
+	prefs.PendingEmail, prefs.EmailCodeHash = "", ""
+	return nil
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:      "notify",
+		Usage:     "/notify [mentions|direct on|off] [via <方式,...>|all] [email <地址>|off] [confirm <確認碼>] [quiet <HH:MM-HH:MM> [時區]|off]",
+		Role:      RoleUser,
+		ParseArgs: fieldsArg,
+		Handler:   notifyCommand,
+	})
+}
+
+// notifyCommand 查看或修改自己的離線通知設置
+func notifyCommand(u *User, room string, args []string) error {
+	prefs, err := NotifyPrefsStore.Get(u.UID)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		u.MessageChannel <- NewCommandMessage("離線通知設置：\n" + prefs.String())
+		return nil
+	}
+	if len(args) < 2 {
+		return errNotifyUsage
+	}
+
+	switch setting, value := args[0], args[1]; setting {
+	case "mentions", "direct":
+		if value != "on" && value != "off" {
+			return errNotifyUsage
+		}
+		if setting == "mentions" {
+			prefs.MuteMentions = value == "off"
+		} else {
+			prefs.MuteDirect = value == "off"
+		}
+	case "via":
+		prefs.Via = nil
+		if value != "all" {
+			for _, name := range strings.Split(value, ",") {
+				if _, ok := notifierFactories[name]; !ok {
+					return errors.New("未知的通知方式：" + name + "，可用：" + strings.Join(notifierNames(), ","))
+				}
+				prefs.Via = append(prefs.Via, name)
+			}
+		}
+	case "email":
+		if value == "off" {
+			prefs.Email, prefs.PendingEmail, prefs.EmailCodeHash = "", "", ""
+			break
+		}
+		if u.guest {
+			return errNotifyEmailGuest
+		}
+		addr, err := mail.ParseAddress(value)
+		if err != nil {
+			return errors.New("郵件地址不合法")
+		}
+		// 確認前仍然使用原來已確認的地址
+		if err = requestEmailConfirm(prefs, addr.Address); err != nil {
+			return err
+		}
+	case "confirm":
+		if err = confirmEmail(prefs, value); err != nil {
+			return err
+		}
+	case "quiet":
+		prefs.QuietStart, prefs.QuietEnd, prefs.Timezone = "", "", ""
+		if value != "off" {
+			start, end, _ := strings.Cut(value, "-")
+			if _, err := parseClock(start); err != nil {
+				return errors.New("時間格式為 HH:MM-HH:MM")
+			}
+			if _, err := parseClock(end); err != nil {
+				return errors.New("時間格式為 HH:MM-HH:MM")
+			}
+			prefs.QuietStart, prefs.QuietEnd = start, end
+			if len(args) > 2 {
+				if _, err := time.LoadLocation(args[2]); err != nil {
+					return errors.New("未知的時區：" + args[2])
+				}
+				prefs.Timezone = args[2]
+			}
+		}
+	default:
+		return errNotifyUsage
+	}
+
+	if err = NotifyPrefsStore.Put(u.UID, prefs); err != nil {
+		return err
+	}
+	u.MessageChannel <- NewCommandMessage("離線通知設置已更新：\n" + prefs.String())
+	return nil
+}
+
+// notifierNames 已註冊的通知方式名稱
+func notifierNames() []string {
+	names := make([]string, 0, len(notifierFactories))
+	for name := range notifierFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,199 @@
+package logic
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestStore 在臨時目錄中打開存儲，測試結束時關閉
+func openTestStore(t *testing.T) {
+	t.Helper()
+
+	if err := OpenStore(filepath.Join(t.TempDir(), "chatroom.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		CloseStore()
+		db = nil
+	})
+}
+
+// smtpMail 本地 SMTP 服務器收到的一封郵件
+type smtpMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// startSMTP 在隨機端口上啟動只支持明文 SMTP 的本地服務器，收到的郵件交給返回的 channel
+func startSMTP(t *testing.T) (string, <-chan *smtpMail) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mails := make(chan *smtpMail, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func serveSMTP(conn net.Conn, mails chan<- *smtpMail) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost test")
+
+	mail := new(smtpMail)
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			mail.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			mail.to = append(mail.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data)
+			mails <- mail
+			mail = new(smtpMail)
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// confirmCode 從發給 to 的確認郵件中取出確認碼
+func confirmCode(t *testing.T, mails <-chan *smtpMail, to string) string {
+	t.Helper()
+
+	select {
+	case mail := <-mails:
+		if len(mail.to) != 1 || mail.to[0] != to {
+			t.Fatalf("confirmation sent to %v, want %s", mail.to, to)
+		}
+		code := regexp.MustCompile(`confirm (\d{6})`).FindStringSubmatch(mail.data)
+		if code == nil {
+			t.Fatalf("no code in confirmation mail: %q", mail.data)
+		}
+		return code[1]
+	case <-time.After(2 * time.Second):
+		t.Fatal("no confirmation mail received")
+	}
+	return ""
+}
+
+func TestEmailNotification(t *testing.T) {
+	openTestStore(t)
+	addr, mails := startSMTP(t)
+
+	d := &notificationDispatcher{
+		notifiers: map[string]Notifier{"email": &emailNotifier{addr: addr, from: "chatroom@example.com"}},
+		queue:     make(chan *Notification, 4),
+	}
+	go d.work()
+	t.Cleanup(func() { close(d.queue) })
+	// /notify 使用全局的 Notifications 發送確認碼
+	Notifications.notifiers = d.notifiers
+	t.Cleanup(func() { Notifications.notifiers = nil })
+
+	bob := &User{UID: 2, NickName: "bob", MessageChannel: make(chan *Message, 4)}
+	if err := notifyCommand(bob, "", []string{"email", "Bob <bob@example.com>"}); err != nil {
+		t.Fatal(err)
+	}
+	code := confirmCode(t, mails, "bob@example.com")
+
+	// 確認前不使用新地址，確認碼錯誤時不確認
+	if prefs, _ := NotifyPrefsStore.Get(bob.UID); prefs.Email != "" {
+		t.Errorf("email = %q before confirmation", prefs.Email)
+	}
+	if err := notifyCommand(bob, "", []string{"confirm", "not-the-code"}); err != errNotifyEmailCode {
+		t.Errorf("wrong code: err = %v, want errNotifyEmailCode", err)
+	}
+	// 短時間內不能再次發送確認碼
+	if err := notifyCommand(bob, "", []string{"email", "other@example.com"}); err == nil {
+		t.Error("a second confirmation was sent right away")
+	}
+	if err := notifyCommand(bob, "", []string{"confirm", code}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &User{UID: 1, NickName: "alice", Addr: "10.0.0.1:5555", Token: "secret-token"}
+	d.queue <- &Notification{
+		Kind:     NotifyMention,
+		UID:      bob.UID,
+		NickName: bob.NickName,
+		Message:  newNotificationMessage(NewMessage(alice, "lobby", "hi @bob", "")),
+		Time:     time.Now(),
+	}
+
+	var mail *smtpMail
+	select {
+	case mail = <-mails:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no mail received")
+	}
+	if mail.from != "chatroom@example.com" || len(mail.to) != 1 || mail.to[0] != "bob@example.com" {
+		t.Errorf("envelope = %s -> %v", mail.from, mail.to)
+	}
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(mail.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Get("To") != "bob@example.com" || !strings.HasPrefix(msg.Get("Subject"), "=?utf-8?b?") {
+		t.Errorf("header = %v", msg)
+	}
+	if !strings.Contains(mail.data, "alice: hi @bob") {
+		t.Errorf("body = %q", mail.data)
+	}
+	if strings.Contains(mail.data, "10.0.0.1") || strings.Contains(mail.data, "secret-token") {
+		t.Errorf("mail contains private sender fields: %q", mail.data)
+	}
+}
+
+func TestNotifyEmailGuest(t *testing.T) {
+	openTestStore(t)
+
+	guest := &User{UID: 3, NickName: "guest", guest: true, MessageChannel: make(chan *Message, 4)}
+	if err := notifyCommand(guest, "", []string{"email", "victim@example.com"}); err != errNotifyEmailGuest {
+		t.Errorf("err = %v, want errNotifyEmailGuest", err)
+	}
+	prefs, err := NotifyPrefsStore.Get(guest.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefs.Email != "" {
+		t.Errorf("guest email = %q, want none", prefs.Email)
+	}
+}
@@ -3,95 +3,366 @@ package logic
 /*
 這段程式碼實現了一個離線消息處理系統，其核心邏輯如下：
 
-1、recentRing（全局環形緩存）：存儲最近 n 條消息，所有用戶重新上線時都能收到這些消息。
-2、userRing（用戶專屬環形緩存）：用來存放某些特定用戶（被 @）的離線消息，讓被標記的用戶上線後可以看到這些對話。
-3、消息儲存 (Save)：
-   - 普通消息存入 recentRing。
-   - 如果消息包含 @，則存入 userRing。
-4、消息發送 (Send)：
-   - 用戶上線時，先發送 recentRing 的歷史消息。
-   - 如果該用戶曾被 @，則發送 userRing 的專屬離線消息，然後刪除記錄。
+1、recentRings（房間環形緩存）：每個房間存儲最近 offline-num 條消息，用戶加入房間時都能收到這些消息。
+2、inboxes（用戶離線收件箱）：不在線的用戶被 @ 或收到私聊時，消息存入他的收件箱，上線後補發，
+   同時交給 Notifications 通過郵件、推送等方式通知他。
+   - 每個用戶最多保留 offline.inbox.max-messages 條，超出時丟棄最舊的。
+   - 超過 offline.inbox.max-age 的消息過期刪除。
+   - 所有收件箱合計約佔 offline.inbox.max-bytes 字節，超出時從最舊的消息開始丟棄。
+   - 只為已知用戶保存：註冊帳號，或者在 offline.inbox.guest-ttl 內離開的遊客；
+     其他昵稱的收件箱在定期清理時刪除。
+3、消息儲存 (Save / SaveMention / SaveDirect)：
+   - 普通消息存入所屬房間的 recentRing。
+   - 如果消息 @ 了不在線的用戶，則由廣播器存入該用戶的收件箱。
+   - 私聊的接收者不在線時，存入接收者的收件箱。
+4、消息發送 (Send / SendRecent)：
+   - 用戶上線時，發送收件箱中的離線消息，然後刪除收件箱。
+   - 用戶加入房間時，發送該房間 recentRing 中序號大於已讀位置的歷史消息。
 這樣的設計能夠確保：
 
    - 用戶不會錯過聊天室的最新對話。
-   - @某人的消息不會被忽略，讓用戶重新上線時能補足未讀消息。
+   - @某人的消息和私聊不會被忽略，讓用戶重新上線時能補足未讀消息。
+
+離線消息處理器只在廣播器 goroutine 中使用，不需要加鎖；只有統計數據使用原子操作，供 expvar 讀取。
 */
 
 import (
-	"container/ring"
+	"container/ring" // 這是一個標準庫，提供**環形緩存（Ring Buffer）**結構，可用於儲存固定數量的最近消息，當超過容量時會自動覆蓋最舊的數據。
+	"expvar"
+	"sync/atomic"
+	"time"
+
 	"github.com/spf13/viper"
-) // 這是一個標準庫，提供**環形緩存（Ring Buffer）**結構，可用於儲存固定數量的最近消息，當超過容量時會自動覆蓋最舊的數據。
+)
+
+func init() {
+	expvar.Publish("offline_inbox", expvar.Func(func() interface{} {
+		return map[string]int64{
+			"messages": atomic.LoadInt64(&OfflineProcessor.messages),
+			"bytes":    atomic.LoadInt64(&OfflineProcessor.bytes),
+		}
+	}))
+}
+
+// inboxEntry 收件箱中的一條消息
+type inboxEntry struct {
+	msg  *Message
+	at   time.Time
+	size int64
+}
+
+// inbox 一個用戶的離線收件箱，uid 為收件人的 UID，同一個昵稱換了人時收件箱作廢
+type inbox struct {
+	uid     int
+	entries []inboxEntry
+}
+
+// seenUser 離開聊天室的用戶
+type seenUser struct {
+	uid int
+	at  time.Time
+}
 
 type offlineProcessor struct {
-	n int // 這是一個標準庫，提供**環形緩存（Ring Buffer）**結構，可用於儲存固定數量的最近消息，當超過容量時會自動覆蓋最舊的數據。
+	n int // 每個房間 recentRing 的大小
+
+	// key 為房間名稱，value 是環形緩衝區（ring.Ring），用於存放該房間最近的 n 條消息。
+	recentRings map[string]*ring.Ring
+
+	// key 為收件人昵稱
+	inboxes map[string]*inbox
 
-	// 這是一個環形緩衝區（ring.Ring），用於存放所有用戶最近的 n 條消息。
-	recentRing *ring.Ring
+	maxPerUser int
+	maxAge     time.Duration
+	maxBytes   int64
+	guestTTL   time.Duration
 
-	// 這是一個映射（map），key 為用戶名稱（string），value 是 ring.Ring，用來存放該用戶的個人離線消息（最多 n 條）。
-	userRing map[string]*ring.Ring
+	// 所有收件箱中的消息數量和估算的內存佔用
+	messages int64
+	bytes    int64
+
+	// 離開聊天室的用戶，用於判斷遊客是否仍然是已知用戶，key 為昵稱
+	seen map[string]seenUser
+
+	// 曾經加入過各房間的用戶昵稱，@all 時不在線的成員也能收到離線消息
+	roomMembers map[string]map[string]struct{}
 }
 
+// 每個房間最多記錄的成員數量
+const maxRoomMembers = 1000
+
+// 清理過期消息和未知用戶的間隔
+const inboxSweepInterval = time.Minute
+
 var OfflineProcessor = newOfflineProcessor()
 
 func newOfflineProcessor() *offlineProcessor {
-	n := viper.GetInt("offline-num") // 從設定檔中讀取 offline-num，確定環形緩存的大小（n）。
+	o := &offlineProcessor{
+		n:           viper.GetInt("offline-num"), // 從設定檔中讀取 offline-num，確定環形緩存的大小（n）。
+		recentRings: make(map[string]*ring.Ring), // 房間第一次有消息時，才建立一個大小為 n 的 recentRing。
+		inboxes:     make(map[string]*inbox),     // 用戶第一次收到離線消息時才建立收件箱。
+		seen:        make(map[string]seenUser),
+		roomMembers: make(map[string]map[string]struct{}),
 
-	return &offlineProcessor{
-		n:          n,
-		recentRing: ring.New(n),                 // 建立一個大小為 n 的 recentRing，用來存最近的 n 條全局消息。
-		userRing:   make(map[string]*ring.Ring), // 初始化 userRing，用於存放特定用戶的個人消息。
+		maxPerUser: viper.GetInt("offline.inbox.max-messages"),
+		maxAge:     viper.GetDuration("offline.inbox.max-age"),
+		maxBytes:   viper.GetInt64("offline.inbox.max-bytes"),
+		guestTTL:   viper.GetDuration("offline.inbox.guest-ttl"),
+	}
+	if o.n <= 0 {
+		o.n = 10
+	}
+	if o.maxPerUser <= 0 {
+		o.maxPerUser = 50
 	}
+	if o.maxAge <= 0 {
+		o.maxAge = 72 * time.Hour
+	}
+	if o.maxBytes <= 0 {
+		o.maxBytes = 16 << 20
+	}
+	if o.guestTTL <= 0 {
+		o.guestTTL = 24 * time.Hour
+	}
+	return o
 }
 
 // 儲存離線消息
 func (o *offlineProcessor) Save(msg *Message) {
-	// 負責存儲新的聊天消息，但只儲存普通類型（MsgTypeNormal）的消息，其他類型的消息會被忽略。
-	if msg.Type != MsgTypeNormal {
+	// 負責存儲新的聊天消息，但只儲存普通類型（MsgTypeNormal）的房間消息，其他類型的消息會被忽略。
+	if msg.Type != MsgTypeNormal || msg.Room == "" {
+		return
+	}
+	recentRing, ok := o.recentRings[msg.Room]
+	if !ok {
+		recentRing = ring.New(o.n)
+	}
+	recentRing.Value = msg                      // 將 msg 儲存在目前的 ring 節點中。
+	o.recentRings[msg.Room] = recentRing.Next() // 移動到下一個節點，這樣當緩存滿時，最舊的數據會被覆蓋。
+}
+
+// SaveMention 這段程式碼處理「@提及某個用戶」的情況，把消息存入不在線的被提及用戶的收件箱。
+// uid 為 0 時（例如 @all）根據昵稱查找用戶
+func (o *offlineProcessor) SaveMention(nickname string, uid int, msg *Message) {
+	known, ok := o.knownUser(nickname)
+	if !ok || uid != 0 && uid != known {
 		return
 	}
-	o.recentRing.Value = msg           // 將 msg 儲存在目前的 ring 節點中。
-	o.recentRing = o.recentRing.Next() // 移動到下一個節點，這樣當緩存滿時，最舊的數據會被覆蓋。
-
-	// 這段程式碼處理「@提及某個用戶」的情況，msg.Ats 代表消息中所有被 @ 提及的用戶列表。
-	for _, nickname := range msg.Ats {
-		nickname = nickname[1:] // 去掉 @ 符号，得到真正的用户名
-		var (
-			r  *ring.Ring
-			ok bool
-		)
-		if r, ok = o.userRing[nickname]; !ok {
-			r = ring.New(o.n)
+	o.push(nickname, known, msg)
+	Notifications.Notify(NotifyMention, nickname, known, msg)
+}
+
+// SaveDirect 私聊的接收者不在線時存入他的收件箱，接收者不是已知用戶時返回 false
+func (o *offlineProcessor) SaveDirect(msg *Message) bool {
+	uid, ok := o.knownUser(msg.To)
+	if !ok {
+		return false
+	}
+	o.push(msg.To, uid, msg)
+	Notifications.Notify(NotifyDirect, msg.To, uid, msg)
+	return true
+}
+
+// knownUser 已知用戶的 UID：註冊帳號，或者在 guest-ttl 內離開的遊客
+func (o *offlineProcessor) knownUser(nickname string) (int, bool) {
+	if uid, ok := Accounts.UID(nickname); ok {
+		return uid, true
+	}
+	if s, ok := o.seen[nickname]; ok && time.Since(s.at) < o.guestTTL {
+		return s.uid, true
+	}
+	return 0, false
+}
+
+// push 把消息放入收件箱，並維持單個用戶和全部收件箱的上限
+func (o *offlineProcessor) push(nickname string, uid int, msg *Message) {
+	box, ok := o.inboxes[nickname]
+	if ok && box.uid != uid {
+		o.dropInbox(nickname)
+		ok = false
+	}
+	if !ok {
+		box = &inbox{uid: uid}
+		o.inboxes[nickname] = box
+	}
+
+	entry := inboxEntry{msg: msg, at: time.Now(), size: messageSize(msg)}
+	box.entries = append(box.entries, entry)
+	o.account(1, entry.size)
+
+	if len(box.entries) > o.maxPerUser {
+		o.dropOldest(box, len(box.entries)-o.maxPerUser)
+	}
+	for atomic.LoadInt64(&o.bytes) > o.maxBytes && o.dropGlobalOldest() {
+	}
+}
+
+// messageSize 估算一條消息佔用的內存
+func messageSize(msg *Message) int64 {
+	return int64(len(msg.ID) + len(msg.Content) + len(msg.Room) + len(msg.To) + len(msg.User.NickName) + 256)
+}
+
+func (o *offlineProcessor) account(messages, bytes int64) {
+	atomic.AddInt64(&o.messages, messages)
+	atomic.AddInt64(&o.bytes, bytes)
+}
+
+// dropOldest 丟棄收件箱中最舊的 n 條消息
+func (o *offlineProcessor) dropOldest(box *inbox, n int) {
+	for _, entry := range box.entries[:n] {
+		o.account(-1, -entry.size)
+	}
+	box.entries = append(box.entries[:0:0], box.entries[n:]...)
+}
+
+// dropGlobalOldest 丟棄所有收件箱中最舊的一條消息，沒有消息可丟時返回 false
+func (o *offlineProcessor) dropGlobalOldest() bool {
+	var (
+		oldest     *inbox
+		oldestName string
+	)
+	for nickname, box := range o.inboxes {
+		if len(box.entries) > 0 && (oldest == nil || box.entries[0].at.Before(oldest.entries[0].at)) {
+			oldest, oldestName = box, nickname
 		}
-		r.Value = msg
-		o.userRing[nickname] = r.Next()
+	}
+	if oldest == nil {
+		return false
+	}
+
+	o.dropOldest(oldest, 1)
+	if len(oldest.entries) == 0 {
+		delete(o.inboxes, oldestName)
+	}
+	return true
+}
+
+func (o *offlineProcessor) dropInbox(nickname string) {
+	if box, ok := o.inboxes[nickname]; ok {
+		o.dropOldest(box, len(box.entries))
+		delete(o.inboxes, nickname)
 	}
 }
 
+// Sweep 由廣播器每隔 inboxSweepInterval 調用一次，沒有消息時也會清理：
+// 過期的消息、未知用戶的收件箱、過期的遊客記錄和既不在線也不是已知用戶的房間成員
+func (o *offlineProcessor) Sweep(online map[string]*User) {
+	now := time.Now()
+
+	for nickname, box := range o.inboxes {
+		if uid, ok := o.knownUser(nickname); !ok || uid != box.uid {
+			o.dropInbox(nickname)
+			continue
+		}
+
+		expired := 0
+		for expired < len(box.entries) && now.Sub(box.entries[expired].at) > o.maxAge {
+			expired++
+		}
+		o.dropOldest(box, expired)
+		if len(box.entries) == 0 {
+			delete(o.inboxes, nickname)
+		}
+	}
+
+	for nickname, s := range o.seen {
+		if now.Sub(s.at) >= o.guestTTL {
+			delete(o.seen, nickname)
+		}
+	}
+
+	for room, members := range o.roomMembers {
+		for nickname := range members {
+			if _, ok := online[nickname]; ok {
+				continue
+			}
+			if _, ok := o.knownUser(nickname); !ok {
+				delete(members, nickname)
+			}
+		}
+		if len(members) == 0 {
+			delete(o.roomMembers, room)
+		}
+	}
+}
+
+// Seen 記錄離開聊天室的用戶
+func (o *offlineProcessor) Seen(user *User) {
+	o.seen[user.NickName] = seenUser{uid: user.UID, at: time.Now()}
+}
+
+// AddRoomMember 記錄加入過房間的用戶
+func (o *offlineProcessor) AddRoomMember(room, nickname string) {
+	members, ok := o.roomMembers[room]
+	if !ok {
+		members = make(map[string]struct{})
+		o.roomMembers[room] = members
+	}
+	if len(members) < maxRoomMembers {
+		members[nickname] = struct{}{}
+	}
+}
+
+// RoomMembers 曾經加入過房間的用戶昵稱
+func (o *offlineProcessor) RoomMembers(room string) []string {
+	nicknames := make([]string, 0, len(o.roomMembers[room]))
+	for nickname := range o.roomMembers[room] {
+		nicknames = append(nicknames, nickname)
+	}
+	return nicknames
+}
+
 // 發送離線消息
 func (o *offlineProcessor) Send(user *User) {
 	// 這個方法在用戶重新連接聊天室時執行，它會發送該用戶應該接收到的離線消息。
-	// 這段程式碼會遍歷 recentRing 中的所有消息，然後逐條發送到 user.MessageChannel，讓用戶收到這些歷史消息。
-	o.recentRing.Do(func(value interface{}) {
-		if value != nil {
-			user.MessageChannel <- value.(*Message)
-		}
-	})
-
-	// 如果用戶是新加入的 (isNew == true)，則不需要發送私人歷史消息，直接返回。
-	if user.isNew {
+	// 收件箱屬於其他 UID（例如遊客的昵稱被別人使用了）時不發送，直接刪除。
+	box, ok := o.inboxes[user.NickName]
+	if !ok {
 		return
 	}
+	if box.uid == user.UID {
+		for _, entry := range box.entries {
+			if time.Since(entry.at) <= o.maxAge {
+				user.MessageChannel <- entry.msg
+			}
+		}
+	}
+
+	// 發送完後，刪除該用戶的收件箱，避免重複發送。
+	o.dropInbox(user.NickName)
+}
 
-	// 如果該用戶曾被 @ 過，則從 userRing 取出所有消息，發送到 user.MessageChannel。
-	// 發送完後，刪除該用戶的記錄，避免重複發送。
-	if r, ok := o.userRing[user.NickName]; ok {
+// SendRecent 用戶加入房間時，發送該房間最近的消息中序號大於 after 的消息
+func (o *offlineProcessor) SendRecent(user *User, room string, after int64) {
+	// 這段程式碼會遍歷 recentRing 中的所有消息，然後逐條發送到 user.MessageChannel，讓用戶收到這些歷史消息。
+	if r, ok := o.recentRings[room]; ok {
 		r.Do(func(value interface{}) {
-			if value != nil {
-				user.MessageChannel <- value.(*Message)
+			if msg, ok := value.(*Message); ok && msg.Seq > after {
+				user.MessageChannel <- msg
 			}
 		})
+	}
+}
+
+// Rename 用戶改名後，把舊昵稱下待發送的離線消息遷移到新昵稱
+// 新昵稱下原有的記錄屬於之前使用該昵稱的人，直接丟棄
+func (o *offlineProcessor) Rename(oldNickname, newNickname string) {
+	o.dropInbox(newNickname)
+	delete(o.seen, newNickname)
+
+	if box, ok := o.inboxes[oldNickname]; ok {
+		o.inboxes[newNickname] = box
+		delete(o.inboxes, oldNickname)
+	}
+	if s, ok := o.seen[oldNickname]; ok {
+		o.seen[newNickname] = s
+		delete(o.seen, oldNickname)
+	}
 
-		delete(o.userRing, user.NickName)
+	for _, members := range o.roomMembers {
+		if _, ok := members[oldNickname]; ok {
+			delete(members, oldNickname)
+			members[newNickname] = struct{}{}
+		}
 	}
 }
@@ -0,0 +1,164 @@
+package logic
+
+/*
+已讀狀態：房間內的普通消息和動作消息由廣播器按房間分配遞增的序號 Seq，
+客戶端顯示消息後回報已讀到的最大序號（{"type": "read", "room": "lobby", "seq": "42"}），
+廣播器記錄每個用戶（按 UID）在每個房間的已讀位置。
+
+1、加入房間時根據已讀位置計算未讀數量，放在 MsgTypeRoomJoined 消息的 unread 中，
+   並且只補發 recentRing 中未讀的消息；從未加入過該房間的用戶仍然收到全部最近消息，
+   已讀位置從加入時房間的最新序號開始記錄。
+2、用戶自己發出的消息視為已讀。
+3、房間在線人數不超過 read-receipts.max-room-size 時，已讀位置會以 MsgTypeRead 消息發給房間內的其他人。
+4、遊客的 UID 不會再被其他人使用，離開超過 offline.inbox.guest-ttl 後刪除其已讀位置，
+   與離線收件箱遺忘遊客的時間一致；期間帶著 token 重新進入則保留。
+
+已讀狀態只在廣播器 goroutine 中讀寫，不需要加鎖。
+*/
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type readTracker struct {
+	// 各房間最新分配的序號
+	roomSeqs map[string]int64
+
+	// key 為 UID，value 為該用戶在各房間已讀到的序號
+	lastRead map[int]map[string]int64
+
+	// 已離開的遊客的 UID 和離開的時間
+	guestsLeft map[int]time.Time
+}
+
+func newReadTracker() *readTracker {
+	return &readTracker{
+		roomSeqs:   make(map[string]int64),
+		lastRead:   make(map[int]map[string]int64),
+		guestsLeft: make(map[int]time.Time),
+	}
+}
+
+// enter 用戶進入聊天室，遊客重新進入時不再過期
+func (r *readTracker) enter(u *User) {
+	delete(r.guestsLeft, u.UID)
+}
+
+// leave 用戶離開聊天室，記錄遊客離開的時間
+func (r *readTracker) leave(u *User) {
+	if u.guest {
+		r.guestsLeft[u.UID] = time.Now()
+	}
+}
+
+// sweep 刪除離開超過 ttl 的遊客的已讀位置，與離線消息一起由廣播器定期調用
+func (r *readTracker) sweep(ttl time.Duration) {
+	now := time.Now()
+
+	for uid, at := range r.guestsLeft {
+		if now.Sub(at) >= ttl {
+			delete(r.lastRead, uid)
+			delete(r.guestsLeft, uid)
+		}
+	}
+}
+
+// hasSeq 需要分配序號（計入未讀）的消息
+func hasSeq(msg *Message) bool {
+	return msg.Room != "" && msg.To == "" && (msg.Type == MsgTypeNormal || msg.Type == MsgTypeAction)
+}
+
+// latest 房間最新分配的序號，第一次訪問時從消息歷史中恢復，服務重啟後序號不會重複
+func (r *readTracker) latest(room string) int64 {
+	seq, ok := r.roomSeqs[room]
+	if !ok {
+		seq = History.LastSeq(room)
+		r.roomSeqs[room] = seq
+	}
+	return seq
+}
+
+// next 給房間分配下一個序號
+func (r *readTracker) next(room string) int64 {
+	r.roomSeqs[room] = r.latest(room) + 1
+	return r.roomSeqs[room]
+}
+
+// get 用戶在房間的已讀位置，ok 為 false 表示從未記錄過
+func (r *readTracker) get(uid int, room string) (int64, bool) {
+	seq, ok := r.lastRead[uid][room]
+	return seq, ok
+}
+
+// mark 記錄已讀位置，序號超出房間最新序號時以最新序號為準，返回已讀位置是否前進了
+func (r *readTracker) mark(uid int, room string, seq int64) bool {
+	if latest := r.latest(room); seq > latest {
+		seq = latest
+	}
+
+	rooms, ok := r.lastRead[uid]
+	if !ok {
+		rooms = make(map[string]int64)
+		r.lastRead[uid] = rooms
+	}
+	if last, ok := rooms[room]; ok && seq <= last {
+		return false
+	}
+	rooms[room] = seq
+	return true
+}
+
+// unread 用戶在房間的未讀數量，從未記錄過時返回 0
+func (r *readTracker) unread(uid int, room string) int {
+	last, ok := r.get(uid, room)
+	if !ok {
+		return 0
+	}
+	return int(r.latest(room) - last)
+}
+
+// readRequest 客戶端回報的已讀位置
+type readRequest struct {
+	user *User
+	room string
+	seq  int64
+}
+
+// MarkRead 記錄用戶在房間已讀到的序號
+func (b *broadcaster) MarkRead(u *User, room string, seq int64) {
+	b.readChannel <- &readRequest{user: u, room: room, seq: seq}
+}
+
+// handleRead 廣播器 goroutine 中處理已讀回報，小房間中把已讀回執發給其他成員
+func (b *broadcaster) handleRead(req *readRequest) {
+	if _, in := req.user.rooms[req.room]; !in || req.seq <= 0 {
+		return
+	}
+	if !b.reads.mark(req.user.UID, req.room, req.seq) {
+		return
+	}
+
+	maxRoomSize := viper.GetInt("read-receipts.max-room-size")
+	if maxRoomSize <= 0 {
+		return
+	}
+	members := make([]*User, 0, maxRoomSize)
+	for _, user := range b.users {
+		if _, in := user.rooms[req.room]; in {
+			if len(members) == maxRoomSize {
+				return
+			}
+			members = append(members, user)
+		}
+	}
+
+	seq, _ := b.reads.get(req.user.UID, req.room)
+	receipt := NewReadReceiptMessage(req.user, req.room, seq)
+	for _, user := range members {
+		if user.UID != req.user.UID {
+			user.MessageChannel <- receipt
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadTrackerForgetsGuests(t *testing.T) {
+	r := newReadTracker()
+	guest := &User{UID: 1, guest: true}
+	member := &User{UID: 2}
+	back := &User{UID: 3, guest: true}
+
+	for _, u := range []*User{guest, member, back} {
+		r.next("lobby")
+		r.mark(u.UID, "lobby", 1)
+		r.leave(u)
+	}
+	// back 在過期之前帶著 token 重新進入
+	r.enter(back)
+
+	for uid := range r.guestsLeft {
+		r.guestsLeft[uid] = time.Now().Add(-2 * time.Hour)
+	}
+	r.sweep(time.Hour)
+
+	if _, ok := r.get(guest.UID, "lobby"); ok {
+		t.Error("the read position of a guest who left was kept")
+	}
+	if _, ok := r.get(member.UID, "lobby"); !ok {
+		t.Error("the read position of a registered user was dropped")
+	}
+	if _, ok := r.get(back.UID, "lobby"); !ok {
+		t.Error("the read position of a guest who came back was dropped")
+	}
+	if len(r.guestsLeft) != 0 {
+		t.Errorf("guestsLeft = %v, want empty", r.guestsLeft)
+	}
+}
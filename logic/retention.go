@@ -0,0 +1,475 @@
+package logic
+
+/*
+消息保留策略：按房間配置消息歷史最長保留的時間、條數和字節數，後台整理器定期刪除超出限制的舊消息。
+
+1、每個房間使用 retention.rooms 中的策略，沒有配置的房間使用 retention.default；各項為 0 時表示不限制。
+2、從最舊的消息開始刪除，直到滿足全部限制；刪除消息時同時刪除它的搜索索引，
+   以及回應了被刪除消息的回應（回應總是比原消息新，否則會留下指向不存在消息的回應）。
+3、處於法律保留（legal hold）的房間不會被刪除任何消息。保留標記可以在設定檔 retention.legal-hold 中配置，
+   也可以由管理員使用 /hold 指令設置，指令設置的標記保存在 legal_holds bucket 中。
+   整理分多個事務進行，每個刪除事務都會重新檢查保留標記，整理期間設置的保留立即生效。
+4、每次整理後統計各房間的消息數量、字節數以及數據庫文件大小，通過 expvar 的 store 變量發布，
+   其中包含房間名稱，只能由管理員通過 /debug/vars 查看。
+5、每個寫入事務最多刪除 retentionBatchSize 條消息，查找孤立的回應也分批在讀事務中進行，
+   避免長時間佔用寫鎖阻塞歷史寫入。
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+var legalHoldBucket = []byte("legal_holds")
+
+// 一個事務最多刪除的消息數量
+const retentionBatchSize = 1000
+
+// errRoomHeld 整理期間房間被設置了法律保留，停止刪除
+var errRoomHeld = errors.New("room is under legal hold")
+
+func init() {
+	expvar.Publish("store", expvar.Func(func() interface{} {
+		return Retention.Stats()
+	}))
+}
+
+// RetentionPolicy 房間消息的保留策略，各項為 0 時表示不限制
+type RetentionPolicy struct {
+	// 只在 retention.rooms 中使用
+	Room     string        `mapstructure:"room"`
+	MaxAge   time.Duration `mapstructure:"max-age"`
+	MaxCount int           `mapstructure:"max-count"`
+	MaxBytes int64         `mapstructure:"max-bytes"`
+}
+
+// unlimited 是否不需要刪除任何消息
+func (p *RetentionPolicy) unlimited() bool {
+	return p.MaxAge <= 0 && p.MaxCount <= 0 && p.MaxBytes <= 0
+}
+
+// RoomStats 房間的消息統計
+type RoomStats struct {
+	Messages int   `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	Held     bool  `json:"legal_hold,omitempty"`
+}
+
+// StoreStats 存儲的統計數據
+type StoreStats struct {
+	// 數據庫文件大小
+	FileBytes int64 `json:"file_bytes"`
+	// 搜索索引的條數
+	SearchKeys int                   `json:"search_keys"`
+	Rooms      map[string]*RoomStats `json:"rooms"`
+	// 啟動以來刪除的消息總數
+	Pruned         int64     `json:"pruned_messages"`
+	LastCompaction time.Time `json:"last_compaction"`
+}
+
+type retentionCompactor struct {
+	defaults RetentionPolicy
+	rooms    map[string]*RetentionPolicy
+	// 設定檔中配置的法律保留
+	configHolds map[string]bool
+
+	// 保護 stats
+	mu    sync.Mutex
+	stats StoreStats
+}
+
+// Retention 消息保留策略的整理器，需要調用 Start 後才會整理
+var Retention = &retentionCompactor{}
+
+// Start 讀取設定檔，啟動整理 goroutine：啟動時整理一次，之後每隔 retention.interval 整理一次
+func (c *retentionCompactor) Start() {
+	if err := viper.UnmarshalKey("retention.default", &c.defaults); err != nil {
+		log.Println("retention.default config error:", err)
+	}
+	var rooms []*RetentionPolicy
+	if err := viper.UnmarshalKey("retention.rooms", &rooms); err != nil {
+		log.Println("retention.rooms config error:", err)
+	}
+	c.rooms = make(map[string]*RetentionPolicy, len(rooms))
+	for _, policy := range rooms {
+		c.rooms[policy.Room] = policy
+	}
+	c.configHolds = make(map[string]bool)
+	for _, room := range viper.GetStringSlice("retention.legal-hold") {
+		c.configHolds[room] = true
+	}
+
+	interval := viper.GetDuration("retention.interval")
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		for {
+			if err := c.Compact(); err != nil {
+				log.Println("compact history error:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// policy 房間使用的保留策略
+func (c *retentionCompactor) policy(room string) *RetentionPolicy {
+	if policy, ok := c.rooms[room]; ok {
+		return policy
+	}
+	return &c.defaults
+}
+
+// LegalHold 房間是否處於法律保留
+func (c *retentionCompactor) LegalHold(room string) (bool, error) {
+	if c.configHolds[room] {
+		return true, nil
+	}
+	if db == nil {
+		return false, errStoreClosed
+	}
+
+	var held bool
+	err := db.View(func(tx *bolt.Tx) error {
+		held = c.heldIn(tx, room)
+		return nil
+	})
+	return held, err
+}
+
+// heldIn 在事務 tx 中檢查房間是否處於法律保留
+func (c *retentionCompactor) heldIn(tx *bolt.Tx, room string) bool {
+	return c.configHolds[room] || tx.Bucket(legalHoldBucket).Get([]byte(room)) != nil
+}
+
+// SetLegalHold 設置或解除房間的法律保留，設定檔中配置的保留不能解除
+func (c *retentionCompactor) SetLegalHold(room string, held bool) error {
+	if !held && c.configHolds[room] {
+		return errors.New("房間 " + room + " 的法律保留在設定檔中配置，不能通過指令解除")
+	}
+	if db == nil {
+		return errStoreClosed
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(legalHoldBucket)
+		if held {
+			return b.Put([]byte(room), []byte(time.Now().Format(time.RFC3339)))
+		}
+		return b.Delete([]byte(room))
+	})
+}
+
+// Compact 按保留策略整理所有房間的消息歷史，並更新統計數據
+func (c *retentionCompactor) Compact() error {
+	if db == nil {
+		return errStoreClosed
+	}
+
+	var rooms []string
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEach(func(k, v []byte) error {
+			// 值為 nil 的是房間的子 bucket
+			if v == nil {
+				rooms = append(rooms, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var pruned int64
+	for _, room := range rooms {
+		policy := c.policy(room)
+		if policy.unlimited() {
+			continue
+		}
+		held, err := c.LegalHold(room)
+		if err != nil {
+			return err
+		}
+		if held {
+			continue
+		}
+
+		n, err := c.compactRoom(room, policy)
+		pruned += int64(n)
+		if errors.Is(err, errRoomHeld) {
+			log.Println("room", room, "was put under legal hold during compaction, stop pruning")
+		} else if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Println("pruned", n, "messages from room", room)
+		}
+	}
+
+	stats, err := c.collectStats()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	stats.Pruned = c.stats.Pruned + pruned
+	stats.LastCompaction = time.Now()
+	c.stats = *stats
+	c.mu.Unlock()
+	return nil
+}
+
+// roomSize 房間中的消息數量和字節數
+func roomSize(b *bolt.Bucket) (count int, size int64) {
+	b.ForEach(func(k, v []byte) error {
+		count++
+		size += int64(len(v))
+		return nil
+	})
+	return count, size
+}
+
+// compactRoom 刪除房間中超出保留策略的舊消息以及回應了它們的回應，返回刪除的消息數量
+func (c *retentionCompactor) compactRoom(room string, policy *RetentionPolicy) (int, error) {
+	var (
+		cutoff  time.Time
+		count   int
+		size    int64
+		deleted = make(map[string]bool)
+		total   int
+	)
+	if policy.MaxAge > 0 {
+		cutoff = time.Now().Add(-policy.MaxAge)
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(historyBucket).Bucket([]byte(room)); b != nil {
+			count, size = roomSize(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// 從最舊的消息開始，分批刪除直到滿足全部限制
+	for done := false; !done; {
+		err = db.Update(func(tx *bolt.Tx) error {
+			if c.heldIn(tx, room) {
+				return errRoomHeld
+			}
+			b := tx.Bucket(historyBucket).Bucket([]byte(room))
+			if b == nil {
+				done = true
+				return nil
+			}
+			cur := b.Cursor()
+			// 刪除後游標的位置不可靠，每次都從第一條重新開始
+			for n := 0; n < retentionBatchSize; n++ {
+				k, v := cur.First()
+				if k == nil {
+					done = true
+					return nil
+				}
+				msg := new(Message)
+				if err := json.Unmarshal(v, msg); err != nil {
+					return err
+				}
+				expired := !cutoff.IsZero() && msg.MsgTime.Before(cutoff)
+				over := policy.MaxCount > 0 && count > policy.MaxCount || policy.MaxBytes > 0 && size > policy.MaxBytes
+				if !expired && !over {
+					done = true
+					return nil
+				}
+
+				if err := unindexMessage(tx, msg, k); err != nil {
+					return err
+				}
+				count--
+				size -= int64(len(v))
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+				if msg.ID != "" {
+					deleted[msg.ID] = true
+				}
+				total++
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+	if len(deleted) == 0 {
+		return total, nil
+	}
+
+	// 回應了已刪除消息的回應：先分批在讀事務中查找，再分批刪除
+	orphans, err := c.findOrphanReactions(room, deleted)
+	if err != nil {
+		return total, err
+	}
+	for len(orphans) > 0 {
+		n := len(orphans)
+		if n > retentionBatchSize {
+			n = retentionBatchSize
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			if c.heldIn(tx, room) {
+				return errRoomHeld
+			}
+			b := tx.Bucket(historyBucket).Bucket([]byte(room))
+			if b == nil {
+				return nil
+			}
+			for _, k := range orphans[:n] {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += n
+		orphans = orphans[n:]
+	}
+	return total, nil
+}
+
+// findOrphanReactions 查找房間中回應了 deleted 中消息的回應，返回它們的 key
+func (c *retentionCompactor) findOrphanReactions(room string, deleted map[string]bool) ([][]byte, error) {
+	var (
+		orphans [][]byte
+		after   []byte
+		done    bool
+	)
+	for !done {
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket(historyBucket).Bucket([]byte(room))
+			if b == nil {
+				done = true
+				return nil
+			}
+			cur := b.Cursor()
+			k, v := cur.First()
+			if after != nil {
+				if k, v = cur.Seek(after); bytes.Equal(k, after) {
+					k, v = cur.Next()
+				}
+			}
+			for n := 0; k != nil && n < retentionBatchSize; k, v = cur.Next() {
+				n++
+				after = append(after[:0], k...)
+				var msg Message
+				if err := json.Unmarshal(v, &msg); err != nil {
+					return err
+				}
+				if msg.Type == MsgTypeReaction && deleted[msg.ReplyTo] {
+					orphans = append(orphans, append([]byte(nil), k...))
+				}
+			}
+			done = k == nil
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
+// collectStats 統計各房間的消息數量、字節數以及數據庫文件大小
+func (c *retentionCompactor) collectStats() (*StoreStats, error) {
+	stats := &StoreStats{Rooms: make(map[string]*RoomStats)}
+	err := db.View(func(tx *bolt.Tx) error {
+		stats.FileBytes = tx.Size()
+		stats.SearchKeys = tx.Bucket(searchBucket).Stats().KeyN
+		return tx.Bucket(historyBucket).ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			count, size := roomSize(tx.Bucket(historyBucket).Bucket(k))
+			stats.Rooms[string(k)] = &RoomStats{
+				Messages: count,
+				Bytes:    size,
+				Held:     c.heldIn(tx, string(k)),
+			}
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// Stats 最近一次整理時的統計數據
+func (c *retentionCompactor) Stats() StoreStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:      "hold",
+		Usage:     "/hold [on|off] [房間]",
+		Role:      RoleAdmin,
+		ParseArgs: fieldsArg,
+		Handler:   holdCommand,
+	})
+}
+
+// holdCommand 查看或設置房間（預設為當前房間）的法律保留，保留中的房間不會按保留策略刪除消息
+func holdCommand(u *User, room string, args []string) error {
+	if len(args) > 2 || len(args) > 0 && args[0] != "on" && args[0] != "off" {
+		return errors.New("參數錯誤")
+	}
+	if len(args) == 2 {
+		if err := CheckRoomName(args[1]); err != nil {
+			return err
+		}
+		room = args[1]
+	}
+
+	if len(args) > 0 {
+		if err := Retention.SetLegalHold(room, args[0] == "on"); err != nil {
+			return err
+		}
+	}
+	held, err := Retention.LegalHold(room)
+	if err != nil {
+		return err
+	}
+
+	policy := Retention.policy(room)
+	var limits []string
+	if policy.MaxAge > 0 {
+		limits = append(limits, "保留 "+policy.MaxAge.String())
+	}
+	if policy.MaxCount > 0 {
+		limits = append(limits, "最多 "+strconv.Itoa(policy.MaxCount)+" 條")
+	}
+	if policy.MaxBytes > 0 {
+		limits = append(limits, "最多 "+strconv.FormatInt(policy.MaxBytes, 10)+" 字節")
+	}
+	desc := "不限制"
+	if len(limits) > 0 {
+		desc = strings.Join(limits, "，")
+	}
+	status := "未保留"
+	if held {
+		status = "保留中，不會刪除任何消息"
+	}
+	u.MessageChannel <- NewCommandMessage("房間 " + room + " 的保留策略：" + desc + "\n法律保留：" + status)
+	return nil
+}
@@ -0,0 +1,51 @@
+package logic
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompactRoomPrunesOrphanReactions(t *testing.T) {
+	openTestStore(t)
+
+	msgs := appendHistory(t, "lobby", "one", "two", "three", "four")
+	bob := &User{UID: 2, NickName: "bob"}
+	reactions := []*Message{
+		NewReactionMessage(bob, msgs[0], "+1"),
+		NewReactionMessage(bob, msgs[3], "+1"),
+	}
+	if err := History.Append(reactions); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保留最新的 3 條，刪除 one、two 之後回應 one 的回應也被刪除
+	n, err := Retention.compactRoom("lobby", &RetentionPolicy{MaxCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("pruned %d, want 4", n)
+	}
+	if contents, _ := roomContents(t, "lobby"); strings.Join(contents, ",") != "four,+1" {
+		t.Errorf("contents = %v, want the newest message and its reaction", contents)
+	}
+}
+
+func TestCompactRoomStopsUnderLegalHold(t *testing.T) {
+	openTestStore(t)
+
+	appendHistory(t, "lobby", "one", "two", "three")
+	// 整理開始後才設置的保留：compactRoom 在刪除事務中重新檢查
+	if err := Retention.SetLegalHold("lobby", true); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Retention.compactRoom("lobby", &RetentionPolicy{MaxCount: 1})
+	if !errors.Is(err, errRoomHeld) || n != 0 {
+		t.Errorf("compactRoom = %d, %v, want 0, %v", n, err, errRoomHeld)
+	}
+	if contents, _ := roomContents(t, "lobby"); len(contents) != 3 {
+		t.Errorf("contents = %v, want nothing pruned", contents)
+	}
+}
@@ -0,0 +1,405 @@
+package logic
+
+/*
+全文搜索：普通消息和動作消息保存到歷史時，同時寫入 search bucket 中的倒排索引。
+
+1、分詞：英文、數字按單詞切分並轉為小寫；中日韓文字沒有空格分隔，按單字和相鄰兩字（bigram）建立索引，
+   例如「聊天室」索引為「聊」「天」「室」「聊天」「天室」。
+   查詢時長度為 1 的中文詞使用單字，其他使用 bigram，因此「聊天室」能匹配「歡迎加入聊天室」。
+2、索引的 key 為「詞 \x00 房間 \x00 消息 key」，value 為空，同一個詞的所有消息在 key 上相鄰，可以按前綴掃描。
+3、查詢的所有詞都必須出現（AND）；結果按詞頻、詞的稀有程度以及消息的新舊排序，並帶有高亮的摘要。
+*/
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var searchBucket = []byte("search")
+
+// 每個詞在每個房間最多掃描的索引條數（從最新的消息開始），避免常見詞拖慢查詢
+var maxSearchPostings = 20000
+
+// 摘要中匹配位置前後保留的字符數
+const snippetRadius = 30
+
+// SearchQuery 搜索條件
+type SearchQuery struct {
+	// 搜索的內容
+	Text string
+	// 只搜索該用戶發送的消息
+	From string
+	// 只搜索該房間的消息
+	Room string
+	// 只搜索該時間之前的消息
+	Before time.Time
+	// 最多返回的結果數量
+	Limit int
+}
+
+// SearchResult 一條搜索結果
+type SearchResult struct {
+	Message *Message `json:"message"`
+	Score   float64  `json:"score"`
+	// 匹配位置附近的內容，匹配的部分用 <mark></mark> 標記，其餘部分已經做過 HTML 轉義
+	Snippet string `json:"snippet"`
+}
+
+var errEmptySearch = errors.New("搜索內容不能為空")
+
+// isCJK 中日韓文字
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// splitSearchText 把文本切分為英文單詞（小寫）和連續的中日韓文字片段
+func splitSearchText(text string) (words, cjkRuns []string) {
+	var (
+		word []rune
+		cjk  []rune
+	)
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, string(word))
+			word = word[:0]
+		}
+		if len(cjk) > 0 {
+			cjkRuns = append(cjkRuns, string(cjk))
+			cjk = cjk[:0]
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words, cjkRuns
+}
+
+// indexTerms 建立索引使用的詞：英文單詞，以及中文的單字和 bigram
+func indexTerms(text string) []string {
+	words, cjkRuns := splitSearchText(text)
+	terms := words
+	for _, run := range cjkRuns {
+		runes := []rune(run)
+		for i := range runes {
+			terms = append(terms, string(runes[i]))
+			if i+1 < len(runes) {
+				terms = append(terms, string(runes[i:i+2]))
+			}
+		}
+	}
+	return uniqueStrings(terms)
+}
+
+// queryTerms 查詢使用的詞：英文單詞，長度為 1 的中文使用單字，其他使用 bigram
+func queryTerms(text string) []string {
+	words, cjkRuns := splitSearchText(text)
+	terms := words
+	for _, run := range cjkRuns {
+		runes := []rune(run)
+		if len(runes) == 1 {
+			terms = append(terms, run)
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			terms = append(terms, string(runes[i:i+2]))
+		}
+	}
+	return uniqueStrings(terms)
+}
+
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	result := s[:0]
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// searchable 需要建立索引的消息
+func searchable(msg *Message) bool {
+	return msg.Type == MsgTypeNormal || msg.Type == MsgTypeAction
+}
+
+func searchKey(term, room string, key []byte) []byte {
+	k := make([]byte, 0, len(term)+len(room)+2+len(key))
+	k = append(k, term...)
+	k = append(k, 0)
+	k = append(k, room...)
+	k = append(k, 0)
+	return append(k, key...)
+}
+
+// indexMessage 為歷史中 key 對應的消息建立索引，在保存消息的事務中調用
+func indexMessage(tx *bolt.Tx, msg *Message, key []byte) error {
+	if !searchable(msg) {
+		return nil
+	}
+	b := tx.Bucket(searchBucket)
+	for _, term := range indexTerms(msg.Content) {
+		if err := b.Put(searchKey(term, msg.Room, key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexMessage 刪除消息的索引
+func unindexMessage(tx *bolt.Tx, msg *Message, key []byte) error {
+	if !searchable(msg) {
+		return nil
+	}
+	b := tx.Bucket(searchBucket)
+	for _, term := range indexTerms(msg.Content) {
+		if err := b.Delete(searchKey(term, msg.Room, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageRef 索引指向的消息
+type messageRef struct {
+	room string
+	key  string
+}
+
+// postings 掃描包含 term 的消息，room 不為空時只掃描該房間，否則掃描所有房間
+func postings(tx *bolt.Tx, term, room string) map[messageRef]bool {
+	refs := make(map[messageRef]bool)
+	if room != "" {
+		roomPostings(tx, term, room, refs)
+		return refs
+	}
+
+	tx.Bucket(historyBucket).ForEach(func(k, v []byte) error {
+		// 值為 nil 的是房間的子 bucket
+		if v == nil {
+			roomPostings(tx, term, string(k), refs)
+		}
+		return nil
+	})
+	return refs
+}
+
+// roomPostings 從最新的消息開始向前掃描房間中包含 term 的消息，最多 maxSearchPostings 條，
+// 索引 key 的末尾是消息的 key（見 historyKey：8 字節消息時間 + 8 字節序號），按消息時間排序，
+// 導入的舊消息也排在它的時間位置上，因此達到上限時捨棄的是時間最早的消息
+func roomPostings(tx *bolt.Tx, term, room string, refs map[messageRef]bool) {
+	prefix := searchKey(term, room, nil)
+	// 前綴以 0 結尾，把它換成 1 得到所有以該前綴開頭的 key 之後的第一個 key
+	end := append(prefix[:len(prefix)-1:len(prefix)-1], 1)
+
+	c := tx.Bucket(searchBucket).Cursor()
+	k, _ := c.Seek(end)
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	for n := 0; k != nil && bytes.HasPrefix(k, prefix) && n < maxSearchPostings; k, _ = c.Prev() {
+		refs[messageRef{room: room, key: string(k[len(prefix):])}] = true
+		n++
+	}
+}
+
+// Search 搜索消息歷史
+func (h *historyStore) Search(q *SearchQuery) ([]*SearchResult, error) {
+	terms := queryTerms(q.Text)
+	if len(terms) == 0 {
+		return nil, errEmptySearch
+	}
+	if db == nil {
+		return nil, errStoreClosed
+	}
+	if q.Limit <= 0 || q.Limit > 100 {
+		q.Limit = 20
+	}
+
+	var results []*SearchResult
+	err := db.View(func(tx *bolt.Tx) error {
+		// 每個詞的消息集合，從最小的集合開始求交集
+		sets := make([]map[messageRef]bool, len(terms))
+		idf := make(map[string]float64, len(terms))
+		for i, term := range terms {
+			sets[i] = postings(tx, term, q.Room)
+			idf[term] = 1 + math.Log(1+float64(maxSearchPostings)/float64(len(sets[i])+1))
+		}
+		sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+		now := time.Now()
+		words, cjkRuns := splitSearchText(q.Text)
+		needles := append(words, cjkRuns...)
+		for ref := range sets[0] {
+			matched := true
+			for _, set := range sets[1:] {
+				if !set[ref] {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+
+			msg, err := h.get(tx, ref.room, []byte(ref.key))
+			if err != nil {
+				return err
+			}
+			if msg == nil ||
+				q.From != "" && !strings.EqualFold(msg.User.NickName, q.From) ||
+				!q.Before.IsZero() && !msg.MsgTime.Before(q.Before) {
+				continue
+			}
+
+			// 詞頻 * 稀有程度，越新的消息分數越高
+			content := strings.ToLower(msg.Content)
+			score := 0.0
+			for _, term := range terms {
+				score += float64(strings.Count(content, term)) * idf[term]
+			}
+			score /= 1 + now.Sub(msg.MsgTime).Hours()/24/30
+
+			results = append(results, &SearchResult{
+				Message: msg,
+				Score:   math.Round(score*1000) / 1000,
+				Snippet: highlight(msg.Content, needles, "<mark>", "</mark>", html.EscapeString),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Message.MsgTime.After(results[j].Message.MsgTime)
+	})
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+// highlight 截取 content 中第一個匹配位置附近的內容，用 pre、post 包圍所有匹配的部分，其餘部分經過 escape
+func highlight(content string, needles []string, pre, post string, escape func(string) string) string {
+	runes := []rune(content)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// 標記每個字符是否屬於匹配的部分
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, needle := range needles {
+		n := []rune(needle)
+		if len(n) == 0 {
+			continue
+		}
+		for i := 0; i+len(n) <= len(lower); i++ {
+			if string(lower[i:i+len(n)]) != needle {
+				continue
+			}
+			for j := i; j < i+len(n); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+
+	start, end := first-snippetRadius, first+snippetRadius*2
+	if start < 0 {
+		start = 0
+	}
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		if marked[i] {
+			sb.WriteString(pre + escape(string(runes[i:j])) + post)
+		} else {
+			sb.WriteString(escape(string(runes[i:j])))
+		}
+		i = j
+	}
+	if end < len(runes) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
+
+func init() {
+	RegisterCommand(&Command{
+		Name:      "search",
+		Usage:     "/search <關鍵字>",
+		Role:      RoleUser,
+		ParseArgs: restArg,
+		Handler:   searchCommand,
+	})
+}
+
+// searchCommand 搜索當前房間的消息歷史，顯示最相關的幾條
+func searchCommand(u *User, room string, args []string) error {
+	results, err := History.Search(&SearchQuery{Text: args[0], Room: room, Limit: 5})
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		u.MessageChannel <- NewCommandMessage("房間 " + room + " 中沒有找到：" + args[0])
+		return nil
+	}
+
+	words, cjkRuns := splitSearchText(args[0])
+	needles := append(words, cjkRuns...)
+	lines := make([]string, 0, len(results))
+	for _, r := range results {
+		lines = append(lines, "["+r.Message.MsgTime.Format("01-02 15:04")+"] "+r.Message.User.NickName+": "+
+			highlight(r.Message.Content, needles, "【", "】", func(s string) string { return s }))
+	}
+	u.MessageChannel <- NewCommandMessage("房間 " + room + " 的搜索結果：\n" + strings.Join(lines, "\n"))
+	return nil
+}
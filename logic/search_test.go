@@ -0,0 +1,57 @@
+package logic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSearchKeepsNewest(t *testing.T) {
+	openTestStore(t)
+	old := maxSearchPostings
+	maxSearchPostings = 100
+	t.Cleanup(func() { maxSearchPostings = old })
+
+	alice := &User{UID: 1, NickName: "alice"}
+	start := time.Now().Add(-time.Hour)
+	msgs := make([]*Message, 0, maxSearchPostings+10)
+	for i := 0; i < cap(msgs); i++ {
+		msg := NewMessage(alice, "lobby", fmt.Sprintf("deploy %d", i), "")
+		msg.MsgTime = start.Add(time.Duration(i) * time.Millisecond)
+		msgs = append(msgs, msg)
+	}
+	if err := History.Append(msgs); err != nil {
+		t.Fatal(err)
+	}
+	other := NewMessage(alice, "dev", "deploy elsewhere", "")
+	if err := History.Append([]*Message{other}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超過掃描上限時保留最新的消息
+	newest := msgs[len(msgs)-1]
+	results, err := History.Search(&SearchQuery{Text: "deploy " + newest.Content[len("deploy "):], Room: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Message.ID != newest.ID {
+		t.Errorf("results = %d, want the newest message", len(results))
+	}
+
+	results, err = History.Search(&SearchQuery{Text: "deploy 0", Room: "lobby"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("the oldest message was scanned instead of the newest")
+	}
+
+	// 不指定房間時每個房間都掃描
+	results, err = History.Search(&SearchQuery{Text: "elsewhere"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Message.ID != other.ID {
+		t.Errorf("results in all rooms = %d, want the message in dev", len(results))
+	}
+}
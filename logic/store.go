@@ -0,0 +1,79 @@
+package logic
+
+/*
+持久化存儲：使用嵌入式數據庫 bbolt，整個服務只打開一個數據庫文件。
+不同類型的數據放在不同的 bucket 中，由各自的模塊負責讀寫。
+*/
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var errStoreClosed = errors.New("存儲尚未打開")
+
+// db 全局唯一的數據庫，由 OpenStore 打開
+var db *bolt.DB
+
+// storeBuckets 啟動時需要確保存在的 bucket
+var storeBuckets = [][]byte{
+	accountBucket,
+	identityBucket,
+	notifyPrefsBucket,
+	historyBucket,
+	searchBucket,
+	legalHoldBucket,
+	attachmentBucket,
+	revokedTokenBucket,
+}
+
+// OpenStore 打開（不存在則創建）數據庫文件
+func OpenStore(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// 數據庫文件有排他鎖，另一個進程已經打開時，1 秒後返回錯誤而不是一直等待
+	d, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = d.Update(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		d.Close()
+		return err
+	}
+
+	db = d
+	if err = migrateHistoryKeys(); err != nil {
+		d.Close()
+		db = nil
+		return err
+	}
+	if err = Accounts.load(); err != nil {
+		d.Close()
+		db = nil
+		return err
+	}
+	return nil
+}
+
+// CloseStore 關閉數據庫
+func CloseStore() error {
+	if db == nil {
+		return nil
+	}
+	return db.Close()
+}
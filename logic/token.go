@@ -0,0 +1,332 @@
+package logic
+
+/*
+Token 採用 JWT 格式（HS256）：base64url(header).base64url(claims).base64url(signature)
+
+1、header 中的 kid 指明簽名用的密鑰，設定檔 token.keys 中可以同時配置多個密鑰：
+   第一個用於簽發新 token，其餘的仍可用於驗證，實現密鑰輪換。
+2、claims 包含 sub（UID）、name（昵稱）、iat（簽發時間）、exp（過期時間）和 jti（唯一編號）。
+3、被撤銷的 token 以 jti 記錄在撤銷列表中，直到其過期為止；撤銷列表同時保存在 revoked_tokens bucket 中，重啟後仍然有效。
+4、客戶端可在 WebSocket 上發送 {"type": "refresh", "token": "..."} 換取新 token，舊 token 隨即撤銷。
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// revokedTokenBucket 已撤銷的 token，key 為 jti，value 為 8 字節大端序的過期時間（Unix 秒）
+var revokedTokenBucket = []byte("revoked_tokens")
+
+// TokenClockSkew 驗證簽發時間和過期時間時允許的時鐘偏差，外部 token（例如 OIDC）也使用同樣的偏差
+const TokenClockSkew = time.Minute
+
+var (
+	errTokenMalformed = errors.New("token 格式錯誤")
+	errTokenSignature = errors.New("token 簽名無效")
+	errTokenExpired   = errors.New("token 已過期")
+	errTokenRevoked   = errors.New("token 已被撤銷")
+	errTokenNickname  = errors.New("token 與昵稱不符")
+)
+
+// tokenHeader JWT header
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// TokenClaims token 中攜帶的聲明
+type TokenClaims struct {
+	Sub  string `json:"sub"`
+	Name string `json:"name"`
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+	Jti  string `json:"jti"`
+}
+
+// tokenKey 簽名密鑰
+type tokenKey struct {
+	ID     string `mapstructure:"id"`
+	Secret string `mapstructure:"secret"`
+}
+
+// tokenKeys 從設定檔讀取密鑰列表，每次讀取以便密鑰輪換時不用重啟
+// 沒有配置 token.keys 時，兼容舊的 token-secret 配置
+func tokenKeys() []tokenKey {
+	var keys []tokenKey
+	if err := viper.UnmarshalKey("token.keys", &keys); err != nil {
+		log.Println("token.keys config error:", err)
+	}
+	if len(keys) == 0 {
+		if secret := viper.GetString("token-secret"); secret != "" {
+			keys = append(keys, tokenKey{ID: "default", Secret: secret})
+		}
+	}
+	return keys
+}
+
+// tokenTTL token 有效期，預設 24 小時
+func tokenTTL() time.Duration {
+	if ttl := viper.GetDuration("token.ttl"); ttl > 0 {
+		return ttl
+	}
+	return 24 * time.Hour
+}
+
+// genToken 生成 token
+func genToken(uid int, nickname string) string {
+	keys := tokenKeys()
+	if len(keys) == 0 {
+		log.Println("no token key configured")
+		return ""
+	}
+	key := keys[0]
+
+	now := time.Now()
+	claims := &TokenClaims{
+		Sub:  strconv.Itoa(uid),
+		Name: nickname,
+		Iat:  now.Unix(),
+		Exp:  now.Add(tokenTTL()).Unix(),
+		Jti:  genTokenID(),
+	}
+
+	header, _ := json.Marshal(&tokenHeader{Alg: "HS256", Typ: "JWT", Kid: key.ID})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	signature := macSha256([]byte(signingInput), []byte(key.Secret))
+
+	return signingInput + "." + encodeSegment(signature)
+}
+
+// ParseToken 解析 token 並驗證簽名、有效期和撤銷狀態
+func ParseToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header tokenHeader
+	if err := DecodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	if header.Alg != "HS256" {
+		return nil, errTokenMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	var secret []byte
+	for _, key := range tokenKeys() {
+		if key.ID == header.Kid {
+			secret = []byte(key.Secret)
+			break
+		}
+	}
+	// 驗證 Token 是否有效 (確保簽名與 header + claims 匹配)。
+	if secret == nil || !validateMAC([]byte(parts[0]+"."+parts[1]), signature, secret) {
+		return nil, errTokenSignature
+	}
+
+	var claims TokenClaims
+	if err = DecodeSegment(parts[1], &claims); err != nil {
+		return nil, errTokenMalformed
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(claims.Exp, 0).Add(TokenClockSkew)) {
+		return nil, errTokenExpired
+	}
+	if now.Add(TokenClockSkew).Before(time.Unix(claims.Iat, 0)) {
+		return nil, errTokenMalformed
+	}
+	if RevokedTokens.IsRevoked(claims.Jti) {
+		return nil, errTokenRevoked
+	}
+
+	return &claims, nil
+}
+
+// parseTokenAndValidate 解析 token 並驗證其屬於 nickname，返回 UID
+func parseTokenAndValidate(token, nickname string) (int, error) {
+	claims, err := ParseToken(token)
+	if err != nil {
+		return 0, err
+	}
+	if claims.Name != nickname {
+		return 0, errTokenNickname
+	}
+
+	uid := claims.UID()
+	if uid <= 0 {
+		return 0, errTokenMalformed
+	}
+	return uid, nil
+}
+
+// UID 返回 sub 中的 UID，格式錯誤時返回 0
+func (c *TokenClaims) UID() int {
+	uid, _ := strconv.Atoi(c.Sub)
+	return uid
+}
+
+// RefreshToken 用仍然有效的舊 token 換取新 token，舊 token 會被撤銷
+func (u *User) RefreshToken(token string) error {
+	claims, err := ParseToken(token)
+	if err != nil {
+		return err
+	}
+	if claims.UID() != u.UID {
+		return errTokenNickname
+	}
+	RevokedTokens.Revoke(claims.Jti, time.Unix(claims.Exp, 0))
+
+	userHasToken := *u
+	userHasToken.Token = genToken(u.UID, u.NickName)
+	u.token = userHasToken.Token
+	u.MessageChannel <- NewTokenMessage(&userHasToken)
+	return nil
+}
+
+// RevokeToken 撤銷 token，無效的 token 直接忽略
+func RevokeToken(token string) {
+	if claims, err := ParseToken(token); err == nil {
+		RevokedTokens.Revoke(claims.Jti, time.Unix(claims.Exp, 0))
+	}
+}
+
+// revocationList token 撤銷列表，記錄 jti 及其過期時間，過期後自動清理
+// 內存中的記錄用於快速判斷，數據庫中的記錄用於重啟後恢復
+type revocationList struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+var RevokedTokens = &revocationList{
+	revoked: make(map[string]time.Time),
+}
+
+// Load 從數據庫中載入尚未過期的撤銷記錄，並刪除已經過期的記錄，需要在 OpenStore 之後調用
+func (r *revocationList) Load() error {
+	if db == nil {
+		return errStoreClosed
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(revokedTokenBucket).Cursor()
+		for k, v := c.First(); k != nil; {
+			exp := time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			if now.After(exp.Add(TokenClockSkew)) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				// 刪除後游標已指向下一條記錄
+				k, v = c.Seek(k)
+				continue
+			}
+			r.revoked[string(k)] = exp
+			k, v = c.Next()
+		}
+		return nil
+	})
+}
+
+// Revoke 撤銷 jti，exp 之後該記錄不再需要保留
+func (r *revocationList) Revoke(jti string, exp time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var expired []string
+	for id, e := range r.revoked {
+		if now.After(e.Add(TokenClockSkew)) {
+			delete(r.revoked, id)
+			expired = append(expired, id)
+		}
+	}
+	r.revoked[jti] = exp
+
+	if db == nil {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revokedTokenBucket)
+		for _, id := range expired {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(exp.Unix()))
+		return b.Put([]byte(jti), v)
+	})
+	if err != nil {
+		log.Println("save revoked token error:", err)
+	}
+}
+
+// IsRevoked 判斷 jti 是否已被撤銷
+func (r *revocationList) IsRevoked(jti string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.revoked[jti]
+	return ok
+}
+
+func genTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeSegment 解碼 JWT 中 base64url 編碼的 JSON 段落到 v
+func DecodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// 使用 HMAC-SHA256 來簽名 Token，確保其不可偽造。
+func macSha256(message, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// 驗證 MAC (Message Authentication Code) 是否有效。
+func validateMAC(message, messageMAC, secret []byte) bool {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	expectedMAC := mac.Sum(nil)
+	return hmac.Equal(messageMAC, expectedMAC)
+}
@@ -2,23 +2,24 @@ package logic
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"errors"
-	"fmt"
 	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	"io"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
-	"regexp"
+	"log"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 )
 
-var globalUID uint32 = 0
+// Role 用戶角色，數值越大權限越高
+type Role int
+
+const (
+	RoleUser  Role = iota // 普通用戶
+	RoleAdmin             // 管理員
+)
 
 type User struct {
 	UID            int           `json:"uid"`
@@ -27,50 +28,151 @@ type User struct {
 	Addr           string        `json:"addr"`
 	MessageChannel chan *Message `json:"-"`
 	Token          string        `json:"token"`
+	Role           Role          `json:"role"`
+	// 是否是通過 HTTP 接口發消息的機器人
+	Bot bool `json:"bot,omitempty"`
+
+	conn Conn
+
+	// 客戶端當前持有的 token，改名或刷新時撤銷，只在用戶自己的讀取 goroutine 中讀寫
+	token string
 
-	conn *websocket.Conn
+	// 是否是遊客，遊客離開後其已讀位置等記錄會過期刪除
+	guest bool
 
-	isNew bool
+	// 已加入的房間，只在廣播器 goroutine 中讀寫
+	rooms map[string]struct{}
+
+	// 可靠投遞模式下未確認的消息，未啟用時為 nil
+	deliveries *deliveryWindow
+
+	// 是否已被同一用戶的新連接取代，由廣播器 goroutine 設置，使用 atomic 讀寫
+	replaced int32
 }
 
 // System 系統用戶, 代表系統主動發送的消息
 var System = &User{}
 
-// NewUser 創建用戶
-func NewUser(conn *websocket.Conn, token, nickname, addr string) *User {
-	user := &User{
-		NickName:       nickname,
+// NewUser 根據認證後的身份創建用戶
+func NewUser(conn Conn, ident *Identity, addr string) *User {
+	return &User{
+		UID:            ident.UID,
+		NickName:       ident.NickName,
 		Addr:           addr,
 		EnterAt:        time.Now(),
 		MessageChannel: make(chan *Message, 32),
-		Token:          token,
+		Token:          ident.Token,
+		Role:           ident.Role,
 
-		conn: conn,
+		conn:  conn,
+		token: ident.Token,
+		guest: ident.Guest,
+
+		rooms: make(map[string]struct{}),
 	}
+}
 
-	if user.Token != "" {
-		uid, err := parseTokenAndValidate(token, nickname)
-		if err == nil {
-			user.UID = uid
-		}
+// snapshot 複製用戶當前的信息，交給消息、用戶列表等在其他 goroutine 中使用，之後改名不會影響已經發出的副本。
+// 昵稱只在廣播器 goroutine 中修改，而且修改時用戶自己的讀取 goroutine 正在等待結果，
+// 因此只能在這兩個 goroutine 中調用
+func (u *User) snapshot() *User {
+	cp := *u
+	return &cp
+}
+
+// CheckNickname 檢查昵稱是否合法
+func CheckNickname(nickname string) error {
+	if l := len(nickname); l < 2 || l > 20 {
+		return errors.New("昵稱長度不合法，昵稱長度：2-20")
 	}
+	return nil
+}
 
-	if user.UID == 0 {
-		user.UID = int(atomic.AddUint32(&globalUID, 1))
-		user.Token = genToken(user.UID, user.NickName)
-		user.isNew = true
+// Rename 在線改名：UID 不變，重新簽發 token，並通知聊天室所有用戶
+func (u *User) Rename(nickname string) error {
+	if err := CheckNickname(nickname); err != nil {
+		return err
+	}
+	if nickname == u.NickName {
+		return nil
 	}
 
-	return user
+	// 先在帳號存儲中改名，新昵稱是否已註冊在同一個事務中檢查，不會與並發的註冊衝突；遊客沒有帳號，只做檢查
+	oldNickname := u.NickName
+	if err := Accounts.Rename(u.UID, oldNickname, nickname); err != nil {
+		if err == errAccountExists {
+			return errNicknameReserved
+		}
+		return err
+	}
+	if err := Broadcaster.Rename(u, nickname); err != nil {
+		// 新昵稱被在線用戶佔用，帳號改回原昵稱
+		if err := Accounts.Rename(u.UID, nickname, oldNickname); err != nil {
+			log.Println("rollback account rename error:", err)
+		}
+		return err
+	}
+	// 遊客改名期間新昵稱可能剛被註冊，此時改回原昵稱
+	if uid, ok := Accounts.UID(nickname); ok && uid != u.UID {
+		if err := Broadcaster.Rename(u, oldNickname); err != nil {
+			log.Println("rollback rename error:", err)
+		}
+		return errNicknameReserved
+	}
+
+	// 新 token 只發給自己，廣播的用戶信息不帶 token，舊昵稱的 token 不再有效
+	userHasToken := *u
+	userHasToken.Token = genToken(u.UID, u.NickName)
+	RevokeToken(u.token)
+	u.token = userHasToken.Token
+	u.MessageChannel <- NewUserRenameMessage(&userHasToken, oldNickname)
+
+	Broadcaster.Broadcast(NewUserRenameMessage(u, oldNickname))
+	return nil
 }
 
-// SendMessage 發送消息
+// SendMessage 發送消息，寫入失敗時關閉連接，並繼續讀取消息通道直到關閉，避免阻塞廣播器
+// 可靠投遞模式下，寫入失敗後的消息仍然記入未確認窗口，重新連接時重發
 func (u *User) SendMessage(ctx context.Context) {
+	var failed error
 	for msg := range u.MessageChannel {
-		wsjson.Write(ctx, u.conn, msg)
+		if u.deliveries != nil {
+			msg = u.deliveries.track(msg)
+		}
+		if failed != nil {
+			continue
+		}
+
+		failed = u.conn.WriteMessage(ctx, msg)
+		// 歡迎消息之後重發上次連接未確認的消息
+		if failed == nil && msg.Type == MsgTypeWelcome && u.deliveries != nil {
+			for _, pending := range u.deliveries.unacked() {
+				if failed = u.conn.WriteMessage(ctx, pending); failed != nil {
+					break
+				}
+			}
+		}
+		if failed != nil {
+			log.Println("write to", u.NickName, "error:", failed)
+			u.conn.Close(CloseInternalError, "write error")
+		}
+	}
+}
+
+// replace 標記用戶已被新連接取代並斷開舊連接，只在廣播器 goroutine 中調用
+// 關閉連接可能需要等待網絡，因此不在廣播器 goroutine 中同步進行
+func (u *User) replace() {
+	atomic.StoreInt32(&u.replaced, 1)
+	if u.conn != nil {
+		go u.conn.Close(CloseNormal, "replaced by a new connection")
 	}
 }
 
+// Replaced 用戶是否已被同一用戶的新連接取代
+func (u *User) Replaced() bool {
+	return atomic.LoadInt32(&u.replaced) == 1
+}
+
 // CloseMessageChannel 關閉消息通道，避免 goroutine 泄漏
 func (u *User) CloseMessageChannel() {
 	close(u.MessageChannel)
@@ -78,78 +180,123 @@ func (u *User) CloseMessageChannel() {
 
 // ReceiveMessage 接收消息
 func (u *User) ReceiveMessage(ctx context.Context) error {
-	var (
-		receiveMsg map[string]string
-		err        error
-	)
 	for {
-		err = wsjson.Read(ctx, u.conn, &receiveMsg)
+		receiveMsg, err := u.conn.ReadMessage(ctx)
 		if err != nil {
 			// 判定連接是否關閉了，如正常關閉，不判定為是錯誤
-			var closeErr websocket.CloseError
-			if errors.As(err, &closeErr) {
-				return nil
-			} else if errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) {
 				return nil
 			}
 
 			return err
 		}
 
-		// 內容發送到聊天室
-		sendMsg := NewMessage(u, receiveMsg["content"], receiveMsg["send_time"])
-		sendMsg.Content = FilterSensitive(sendMsg.Content) // 過濾敏感字
+		u.HandleClientMessage(receiveMsg)
+	}
+}
 
-		// 解析 content，看 @ 誰了
-		reg := regexp.MustCompile(`@[^\s@]{2,20}`)
-		sendMsg.Ats = reg.FindAllString(sendMsg.Content, -1)
+// HandleClientMessage 處理客戶端發來的一條消息，與連接方式無關
+func (u *User) HandleClientMessage(receiveMsg map[string]string) {
+	// 刷新 token，新 token 只發給自己
+	if receiveMsg["type"] == "refresh" {
+		if err := u.RefreshToken(receiveMsg["token"]); err != nil {
+			u.MessageChannel <- NewErrorMessage("刷新 token 失敗：" + err.Error())
+		}
+		return
+	}
 
-		Broadcaster.Broadcast(sendMsg)
+	// 沒有指明房間的客戶端（例如瀏覽器、TCP）都在預設房間中
+	room := receiveMsg["room"]
+	if room == "" {
+		room = DefaultRoom
 	}
-}
 
-// genToken 生成 token
-func genToken(uid int, nickname string) string {
-	secret := viper.GetString("token-secret")
-	message := fmt.Sprintf("%s%s%d", nickname, secret, uid)
+	// 加入、離開房間
+	switch receiveMsg["type"] {
+	case "join":
+		if err := Broadcaster.JoinRoom(u, room); err != nil {
+			u.MessageChannel <- NewErrorMessage(err.Error())
+		}
+		return
+	case "part":
+		if err := Broadcaster.LeaveRoom(u, room); err != nil {
+			u.MessageChannel <- NewErrorMessage(err.Error())
+		}
+		return
+	case "read":
+		// 已讀位置不需要回覆
+		Broadcaster.MarkRead(u, room, cast.ToInt64(receiveMsg["seq"]))
+		return
+	case "ack":
+		if u.deliveries != nil {
+			u.deliveries.ack(cast.ToInt64(receiveMsg["seq"]))
+		}
+		return
+	}
 
-	messageMAC := macSha256([]byte(message), []byte(secret))
+	// 私聊
+	if to := receiveMsg["to"]; to != "" {
+		if receiveMsg["attachments"] != "" {
+			u.MessageChannel <- NewErrorMessage("私聊暫不支持附件")
+			return
+		}
+		if err := u.SendDirect(to, receiveMsg["content"]); err != nil {
+			u.MessageChannel <- NewErrorMessage(err.Error())
+		}
+		return
+	}
+
+	// 斜線指令交給指令註冊表處理，不廣播
+	if IsCommand(receiveMsg["content"]) {
+		u.ExecCommand(room, receiveMsg["content"])
+		return
+	}
 
-	return fmt.Sprintf("%suid%d", base64.StdEncoding.EncodeToString(messageMAC), uid)
+	// 內容經過處理管道後發送到房間
+	sendMsg := NewMessage(u, room, receiveMsg["content"], receiveMsg["send_time"])
+	if ids := receiveMsg["attachments"]; ids != "" {
+		attachments, err := Attachments.Resolve(ids)
+		if err != nil {
+			u.MessageChannel <- NewErrorMessage(err.Error())
+			return
+		}
+		sendMsg.Attachments = attachments
+	}
+	if err := u.broadcastProcessed(sendMsg); err != nil {
+		u.MessageChannel <- NewErrorMessage(err.Error())
+	}
 }
 
-// parseTokenAndValidate 解析 token 並驗證
-func parseTokenAndValidate(token, nickname string) (int, error) {
-	pos := strings.LastIndex(token, "uid")
-	messageMAC, err := base64.StdEncoding.DecodeString(token[:pos]) // messageMAC 是 nickname + secret + uid 的 HMAC 雜湊值。
+// broadcastProcessed 消息經過處理管道後廣播，被拒絕時返回 error
+func (u *User) broadcastProcessed(msg *Message) error {
+	ok, err := RunPipeline(msg)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	uid := cast.ToInt(token[pos+3:])
-
-	secret := viper.GetString("token-secret")
-	message := fmt.Sprintf("%s%s%d", nickname, secret, uid)
-
-	// 驗證 Token 是否有效 (確保 messageMAC 與 nickname + secret + uid 匹配)。
-	ok := validateMAC([]byte(message), messageMAC, []byte(secret))
 	if ok {
-		return uid, nil
+		Broadcaster.Broadcast(msg)
 	}
-
-	return 0, errors.New("token is illegal")
+	return nil
 }
 
-// 使用 HMAC-SHA256 來加密 Token，確保其不可偽造。
-func macSha256(message, secret []byte) []byte {
-	mac := hmac.New(sha256.New, secret)
-	mac.Write(message)
-	return mac.Sum(nil)
+// SendDirect 給在線用戶或機器人發送私聊
+func (u *User) SendDirect(to, content string) error {
+	if to == u.NickName {
+		return errors.New("不能給自己發私聊")
+	}
+	if strings.TrimSpace(content) == "" {
+		return errors.New("消息內容不能為空")
+	}
+	return u.broadcastProcessed(NewDirectMessage(u, to, content))
 }
 
-// 驗證 MAC (Message Authentication Code) 是否有效。
-func validateMAC(message, messageMAC, secret []byte) bool {
-	mac := hmac.New(sha256.New, secret)
-	mac.Write(message)
-	expectedMAC := mac.Sum(nil)
-	return hmac.Equal(messageMAC, expectedMAC)
+// isAdmin 判斷帳號的 UID 是否在設定檔的管理員列表中
+// 按 UID 而不是昵稱判斷：註冊是開放的，任何人都可以搶先註冊管理員尚未註冊或通過 /nick 放棄的昵稱
+func isAdmin(uid int) bool {
+	for _, admin := range viper.GetStringSlice("admin-uids") {
+		if admin == strconv.Itoa(uid) {
+			return true
+		}
+	}
+	return false
 }
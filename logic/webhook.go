@@ -0,0 +1,308 @@
+package logic
+
+/*
+外發 Webhook：廣播器在消息、加入房間、離開房間和 @ 提及時產生事件，
+以 JSON POST 到設定檔 webhooks.endpoints 中訂閱了該事件的 URL。
+
+1、請求體使用 endpoint 的 secret 做 HMAC-SHA256 簽名，放在 X-Chatroom-Signature 請求頭中（sha256=十六進制）。
+2、投遞在獨立的 goroutine 中進行，不會阻塞廣播器；待投遞隊列有上限，隊列滿時事件直接記入死信。
+3、投遞失敗（網絡錯誤、5xx、408、429）時按指數退避重試，超過重試次數或遇到其他 4xx 時記入死信日誌。
+4、事件中的用戶和消息只包含對外公開的字段，不會帶出用戶的地址、token 等信息。
+*/
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rorast/go-chatroom/global"
+	"github.com/spf13/viper"
+)
+
+// Webhook 事件類型
+const (
+	WebhookEventMessage = "message"
+	WebhookEventJoin    = "join"
+	WebhookEventLeave   = "leave"
+	WebhookEventMention = "mention"
+)
+
+// WebhookEvent 發送給 webhook 的事件
+type WebhookEvent struct {
+	ID    string       `json:"id"`
+	Event string       `json:"event"`
+	Time  time.Time    `json:"time"`
+	Room  string       `json:"room"`
+	User  *WebhookUser `json:"user"`
+	// 消息和提及事件中的消息
+	Message *WebhookMessage `json:"message,omitempty"`
+	// 提及事件中被 @ 的昵稱，群組提及時為 @all 或 @here
+	Mentioned string `json:"mentioned,omitempty"`
+}
+
+// WebhookUser 事件中的用戶
+type WebhookUser struct {
+	UID      int    `json:"uid"`
+	NickName string `json:"nickname"`
+	Role     Role   `json:"role"`
+}
+
+func newWebhookUser(u *User) *WebhookUser {
+	return &WebhookUser{UID: u.UID, NickName: u.NickName, Role: u.Role}
+}
+
+// WebhookMessage 事件中的消息
+type WebhookMessage struct {
+	ID          string                 `json:"id"`
+	Type        int                    `json:"type"`
+	Content     string                 `json:"content"`
+	MsgTime     time.Time              `json:"msg_time"`
+	Seq         int64                  `json:"seq,omitempty"`
+	Ats         []Mention              `json:"ats,omitempty"`
+	ReplyTo     string                 `json:"reply_to,omitempty"`
+	Attachments []*Attachment          `json:"attachments,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+func newWebhookMessage(msg *Message) *WebhookMessage {
+	return &WebhookMessage{
+		ID:          msg.ID,
+		Type:        msg.Type,
+		Content:     msg.Content,
+		MsgTime:     msg.MsgTime,
+		Seq:         msg.Seq,
+		Ats:         msg.Ats,
+		ReplyTo:     msg.ReplyTo,
+		Attachments: msg.Attachments,
+		Annotations: msg.Annotations,
+	}
+}
+
+// webhookEndpoint 設定檔中配置的 webhook
+type webhookEndpoint struct {
+	URL    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+	// 訂閱的事件，為空時訂閱全部事件
+	Events []string `mapstructure:"events"`
+}
+
+func (e *webhookEndpoint) subscribed(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, ev := range e.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDelivery 一次投遞：一個事件發往一個 endpoint
+type webhookDelivery struct {
+	endpoint *webhookEndpoint
+	event    *WebhookEvent
+	body     []byte
+	attempts int
+}
+
+type webhookDispatcher struct {
+	endpoints  []webhookEndpoint
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	deadLetter string
+
+	client *http.Client
+	queue  chan *webhookDelivery
+
+	// 保護死信日誌文件的寫入
+	deadMu sync.Mutex
+}
+
+// Webhooks 外發 webhook 分發器，需要調用 Start 後才會投遞
+var Webhooks = &webhookDispatcher{}
+
+// Start 讀取設定檔並啟動投遞 goroutine，沒有配置 endpoint 時不做任何事
+func (d *webhookDispatcher) Start() {
+	if err := viper.UnmarshalKey("webhooks.endpoints", &d.endpoints); err != nil {
+		log.Println("webhooks.endpoints config error:", err)
+	}
+	if len(d.endpoints) == 0 {
+		return
+	}
+
+	d.maxRetries = viper.GetInt("webhooks.max-retries")
+	d.backoff = viper.GetDuration("webhooks.backoff")
+	if d.backoff <= 0 {
+		d.backoff = time.Second
+	}
+	d.maxBackoff = viper.GetDuration("webhooks.max-backoff")
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = time.Minute
+	}
+	if d.deadLetter = viper.GetString("webhooks.dead-letter"); d.deadLetter != "" && !filepath.IsAbs(d.deadLetter) {
+		d.deadLetter = filepath.Join(global.RootDir, d.deadLetter)
+	}
+
+	timeout := viper.GetDuration("webhooks.timeout")
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	d.client = &http.Client{Timeout: timeout}
+
+	queueSize := viper.GetInt("webhooks.queue-size")
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+	d.queue = make(chan *webhookDelivery, queueSize)
+
+	workers := viper.GetInt("webhooks.workers")
+	if workers <= 0 {
+		workers = 2
+	}
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+}
+
+// Fire 為訂閱了該事件的 endpoint 排隊投遞，不會阻塞調用者
+func (d *webhookDispatcher) Fire(event *WebhookEvent) {
+	if d.queue == nil {
+		return
+	}
+
+	event.ID = genTokenID()
+	event.Time = time.Now()
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println("webhook marshal error:", err)
+		return
+	}
+
+	for i := range d.endpoints {
+		endpoint := &d.endpoints[i]
+		if endpoint.subscribed(event.Event) {
+			d.enqueue(&webhookDelivery{endpoint: endpoint, event: event, body: body})
+		}
+	}
+}
+
+// enqueue 隊列滿時直接記入死信
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		d.dead(delivery, "delivery queue is full")
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	for delivery := range d.queue {
+		delivery.attempts++
+		retry, err := d.post(delivery)
+		if err == nil {
+			continue
+		}
+
+		if !retry || delivery.attempts > d.maxRetries {
+			d.dead(delivery, err.Error())
+			continue
+		}
+
+		// 指數退避：backoff、2*backoff、4*backoff……，不超過 maxBackoff
+		wait := d.backoff << (delivery.attempts - 1)
+		if wait <= 0 || wait > d.maxBackoff {
+			wait = d.maxBackoff
+		}
+		time.AfterFunc(wait, func() {
+			d.enqueue(delivery)
+		})
+	}
+}
+
+// post 發送一次請求，返回失敗時是否值得重試
+func (d *webhookDispatcher) post(delivery *webhookDelivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, delivery.endpoint.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-chatroom-webhook")
+	req.Header.Set("X-Chatroom-Event", delivery.event.Event)
+	req.Header.Set("X-Chatroom-Delivery", delivery.event.ID)
+	req.Header.Set("X-Chatroom-Signature", "sha256="+hex.EncodeToString(macSha256(delivery.body, []byte(delivery.endpoint.Secret))))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("POST %s: %s", delivery.endpoint.URL, resp.Status)
+	default:
+		return false, fmt.Errorf("POST %s: %s", delivery.endpoint.URL, resp.Status)
+	}
+}
+
+// dead 把投遞失敗的事件以 JSON Lines 格式追加到死信日誌，沒有配置死信文件時只打印日誌
+func (d *webhookDispatcher) dead(delivery *webhookDelivery, reason string) {
+	record, _ := json.Marshal(map[string]interface{}{
+		"time":     time.Now(),
+		"url":      delivery.endpoint.URL,
+		"attempts": delivery.attempts,
+		"error":    reason,
+		"event":    json.RawMessage(delivery.body),
+	})
+	if d.deadLetter == "" {
+		log.Println("webhook dead letter:", string(record))
+		return
+	}
+
+	d.deadMu.Lock()
+	defer d.deadMu.Unlock()
+
+	f, err := os.OpenFile(d.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("open webhook dead letter error:", err, string(record))
+		return
+	}
+	defer f.Close()
+	f.Write(append(record, '\n'))
+}
+
+// fireMessageWebhooks 消息事件，以及消息中每個被 @ 用戶的提及事件
+func fireMessageWebhooks(msg *Message) {
+	if msg.Type != MsgTypeNormal && msg.Type != MsgTypeAction {
+		return
+	}
+	user, message := newWebhookUser(msg.User), newWebhookMessage(msg)
+	Webhooks.Fire(&WebhookEvent{Event: WebhookEventMessage, Room: msg.Room, User: user, Message: message})
+
+	for _, at := range msg.Ats {
+		mentioned := at.NickName
+		if at.Group != "" {
+			mentioned = "@" + at.Group
+		}
+		Webhooks.Fire(&WebhookEvent{
+			Event:     WebhookEventMention,
+			Room:      msg.Room,
+			User:      user,
+			Message:   message,
+			Mentioned: mentioned,
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package logic
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver 本地的 webhook 接收端，驗證簽名後把事件交給 events
+type webhookReceiver struct {
+	t      *testing.T
+	secret string
+	// 返回給每次請求的狀態碼，用完之後返回 200
+	statuses []int
+	calls    int32
+	events   chan map[string]interface{}
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	want := "sha256=" + hex.EncodeToString(macSha256(body, []byte(r.secret)))
+	if got := req.Header.Get("X-Chatroom-Signature"); got != want {
+		r.t.Errorf("signature = %q, want %q", got, want)
+	}
+
+	call := int(atomic.AddInt32(&r.calls, 1)) - 1
+	if call < len(r.statuses) && r.statuses[call] != http.StatusOK {
+		w.WriteHeader(r.statuses[call])
+		return
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		r.t.Errorf("decode event: %v", err)
+	}
+	r.events <- event
+}
+
+// startWebhooks 以 receiver 為唯一 endpoint 啟動分發器，並替換全局的 Webhooks
+func startWebhooks(t *testing.T, receiver *webhookReceiver, events ...string) *webhookDispatcher {
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	d := &webhookDispatcher{
+		endpoints:  []webhookEndpoint{{URL: srv.URL, Secret: receiver.secret, Events: events}},
+		maxRetries: 2,
+		backoff:    10 * time.Millisecond,
+		maxBackoff: 50 * time.Millisecond,
+		deadLetter: filepath.Join(t.TempDir(), "dead.log"),
+		client:     srv.Client(),
+		queue:      make(chan *webhookDelivery, 16),
+	}
+	go d.work()
+
+	old := Webhooks
+	Webhooks = d
+	t.Cleanup(func() { Webhooks = old })
+	return d
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	return &webhookReceiver{
+		t:        t,
+		secret:   "test-secret",
+		statuses: statuses,
+		events:   make(chan map[string]interface{}, 16),
+	}
+}
+
+func (r *webhookReceiver) next() map[string]interface{} {
+	r.t.Helper()
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(2 * time.Second):
+		r.t.Fatal("no webhook event received")
+		return nil
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	receiver := newWebhookReceiver(t)
+	startWebhooks(t, receiver)
+
+	alice := &User{UID: 7, NickName: "alice", Addr: "10.0.0.1:5555", Token: "secret-token", Role: RoleAdmin}
+	msg := NewMessage(alice, "lobby", "hi @bob", "")
+	msg.Ats = []Mention{{UID: 8, NickName: "bob", Offset: 3, Length: 4}}
+	fireMessageWebhooks(msg)
+
+	for _, want := range []string{WebhookEventMessage, WebhookEventMention} {
+		event := receiver.next()
+		if event["event"] != want {
+			t.Fatalf("event = %v, want %s", event["event"], want)
+		}
+		user := event["user"].(map[string]interface{})
+		if len(user) != 3 || user["uid"] != 7.0 || user["nickname"] != "alice" || user["role"] != 1.0 {
+			t.Errorf("user = %v, want only uid, nickname and role", user)
+		}
+		message := event["message"].(map[string]interface{})
+		if message["content"] != "hi @bob" || message["id"] != msg.ID {
+			t.Errorf("message = %v", message)
+		}
+		if _, ok := message["user"]; ok {
+			t.Errorf("message contains the sender: %v", message)
+		}
+	}
+}
+
+func TestWebhookRetryAndSubscription(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	startWebhooks(t, receiver, WebhookEventJoin)
+
+	// 沒有訂閱的事件不投遞
+	Webhooks.Fire(&WebhookEvent{Event: WebhookEventLeave, Room: "lobby", User: &WebhookUser{UID: 1}})
+	Webhooks.Fire(&WebhookEvent{Event: WebhookEventJoin, Room: "lobby", User: &WebhookUser{UID: 2}})
+
+	event := receiver.next()
+	if event["event"] != WebhookEventJoin {
+		t.Errorf("event = %v, want join", event["event"])
+	}
+	if calls := atomic.LoadInt32(&receiver.calls); calls != 3 {
+		t.Errorf("calls = %d, want 2 failures and 1 success", calls)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusBadRequest)
+	d := startWebhooks(t, receiver)
+
+	Webhooks.Fire(&WebhookEvent{Event: WebhookEventJoin, Room: "lobby", User: &WebhookUser{UID: 1}})
+
+	// 4xx 不重試，直接記入死信
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f, err := os.Open(d.deadLetter)
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			scanner.Scan()
+			var record map[string]interface{}
+			err = json.Unmarshal(scanner.Bytes(), &record)
+			f.Close()
+			if err == nil {
+				if record["attempts"] != 1.0 {
+					t.Errorf("attempts = %v, want 1", record["attempts"])
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dead letter not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := atomic.LoadInt32(&receiver.calls); calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// registerHandleFunc 註冊帳號：POST /register，表單參數 nickname、password
+func registerHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 POST 請求"})
+		return
+	}
+
+	account, err := logic.Accounts.Register(req.FormValue("nickname"), req.FormValue("password"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Println("account registered:", account.NickName, "uid:", account.UID)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"uid":      account.UID,
+		"nickname": account.NickName,
+	})
+}
+
+// loginHandleFunc 密碼登入：POST /login，表單參數 nickname、password，成功返回 token
+func loginHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 POST 請求"})
+		return
+	}
+
+	account, token, err := logic.Accounts.Login(req.FormValue("nickname"), req.FormValue("password"))
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uid":      account.UID,
+		"nickname": account.NickName,
+		"token":    token,
+	})
+}
+
+// writeJSON 以 JSON 格式輸出響應
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
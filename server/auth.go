@@ -0,0 +1,239 @@
+package server
+
+/*
+認證：websocketHandleFunc 在創建用戶之前，按設定檔 auth.providers 的順序依次嘗試各個 Authenticator。
+請求中沒有某種方式的憑證時，該方式返回 errNoCredentials，交給下一個；
+憑證存在但無效時直接拒絕，不再嘗試後面的方式。
+
+支持的認證方式：
+  - token：原有的昵稱 + token 方式，可選擇是否允許遊客
+  - oidc：OIDC ID token，使用 JWKS 文件或 issuer 的公鑰驗證簽名
+  - proxy：受信任的反向代理通過請求頭傳入的用戶名
+  - apikey：設定檔中的靜態 API key，供機器人使用
+*/
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/spf13/viper"
+)
+
+var (
+	errNoCredentials = errors.New("沒有提供憑證")
+	errUnauthorized  = errors.New("認證失敗")
+)
+
+// Authenticator 從 HTTP 請求中取出憑證並驗證
+type Authenticator interface {
+	// Authenticate 請求中沒有該方式的憑證時返回 errNoCredentials
+	Authenticate(req *http.Request) (*logic.Identity, error)
+}
+
+// authenticators 按順序嘗試的認證方式，由 initAuthenticators 根據設定檔創建
+var authenticators []Authenticator
+
+func initAuthenticators() {
+	if len(viper.GetStringSlice("admins")) > 0 {
+		log.Println("admins (nicknames) is no longer supported, use admin-uids instead")
+	}
+
+	providers := viper.GetStringSlice("auth.providers")
+	if len(providers) == 0 {
+		providers = []string{"token"}
+	}
+
+	authenticators = authenticators[:0]
+	for _, name := range providers {
+		switch name {
+		case "token":
+			authenticators = append(authenticators, &tokenAuthenticator{
+				allowGuest: allowGuest(),
+			})
+		case "oidc":
+			a, err := newOIDCAuthenticator()
+			if err != nil {
+				log.Fatal("oidc authenticator error:", err)
+			}
+			authenticators = append(authenticators, a)
+		case "proxy":
+			a, err := newProxyAuthenticator()
+			if err != nil {
+				log.Fatal("proxy authenticator error:", err)
+			}
+			authenticators = append(authenticators, a)
+		case "apikey":
+			authenticators = append(authenticators, newAPIKeyAuthenticator())
+		default:
+			log.Fatal("unknown auth provider:", name)
+		}
+	}
+}
+
+// allowGuest 是否允許未註冊的昵稱以遊客身份進入，預設允許
+func allowGuest() bool {
+	return !viper.IsSet("auth.allow-guest") || viper.GetBool("auth.allow-guest")
+}
+
+// authenticate 依次嘗試各個認證方式
+func authenticate(req *http.Request) (*logic.Identity, error) {
+	for _, a := range authenticators {
+		ident, err := a.Authenticate(req)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return ident, err
+	}
+	return nil, errUnauthorized
+}
+
+// authenticateWithoutBody 只根據請求頭和 URL 查詢參數認證，不讀取請求體
+// 認證方式通過 FormValue 讀取參數，對 POST 請求會解析整個請求體，因此用不帶請求體的副本認證
+func authenticateWithoutBody(req *http.Request) (*logic.Identity, error) {
+	r := req.Clone(req.Context())
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.Header.Del("Content-Type")
+	return authenticate(r)
+}
+
+// adminOnly 只允許管理員訪問 h
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ident, err := authenticate(req)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		if ident.Role < logic.RoleAdmin {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "只有管理員可以訪問"})
+			return
+		}
+		h(w, req)
+	}
+}
+
+// tokenAuthenticator 昵稱 + 本服務簽發的 token
+type tokenAuthenticator struct {
+	allowGuest bool
+}
+
+func (a *tokenAuthenticator) Authenticate(req *http.Request) (*logic.Identity, error) {
+	nickname := req.FormValue("nickname")
+	if nickname == "" {
+		return nil, errNoCredentials
+	}
+	return logic.AuthenticateToken(req.FormValue("token"), nickname, a.allowGuest)
+}
+
+// proxyAuthenticator 信任反向代理（例如接入了公司 SSO 的 nginx）設置的用戶名請求頭
+// 只有來自 trusted 網段的請求才會讀取該請求頭，防止客戶端直接偽造
+type proxyAuthenticator struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newProxyAuthenticator() (*proxyAuthenticator, error) {
+	a := &proxyAuthenticator{
+		header: viper.GetString("auth.proxy.header"),
+	}
+	if a.header == "" {
+		a.header = "X-Forwarded-User"
+	}
+
+	for _, cidr := range viper.GetStringSlice("auth.proxy.trusted") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		a.trusted = append(a.trusted, ipNet)
+	}
+	return a, nil
+}
+
+func (a *proxyAuthenticator) Authenticate(req *http.Request) (*logic.Identity, error) {
+	username := req.Header.Get(a.header)
+	if username == "" {
+		return nil, errNoCredentials
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range a.trusted {
+		if ip != nil && ipNet.Contains(ip) {
+			return logic.BindIdentity("proxy", username, username, logic.RoleUser)
+		}
+	}
+
+	log.Println("untrusted proxy header from:", req.RemoteAddr)
+	return nil, errUnauthorized
+}
+
+// apiKey 設定檔中配置的靜態 API key
+type apiKey struct {
+	Key      string `mapstructure:"key"`
+	NickName string `mapstructure:"nickname"`
+	Admin    bool   `mapstructure:"admin"`
+}
+
+// apiKeyAuthenticator 靜態 API key，通過 X-API-Key 請求頭或 api_key 參數傳入
+type apiKeyAuthenticator struct {
+	keys []apiKey
+}
+
+func newAPIKeyAuthenticator() *apiKeyAuthenticator {
+	a := new(apiKeyAuthenticator)
+	if err := viper.UnmarshalKey("auth.apikeys", &a.keys); err != nil {
+		log.Println("auth.apikeys config error:", err)
+	}
+	return a
+}
+
+func (a *apiKeyAuthenticator) Authenticate(req *http.Request) (*logic.Identity, error) {
+	key := req.Header.Get("X-API-Key")
+	if key == "" {
+		key = req.FormValue("api_key")
+	}
+	if key == "" {
+		return nil, errNoCredentials
+	}
+
+	k := a.lookup(key)
+	if k == nil {
+		return nil, errUnauthorized
+	}
+
+	role := logic.RoleUser
+	if k.Admin {
+		role = logic.RoleAdmin
+	}
+	return logic.BindIdentity("apikey", k.NickName, k.NickName, role)
+}
+
+// lookup 查找 key 對應的配置，使用常數時間比較
+func (a *apiKeyAuthenticator) lookup(key string) *apiKey {
+	var found *apiKey
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(a.keys[i].Key), []byte(key)) == 1 {
+			found = &a.keys[i]
+		}
+	}
+	return found
+}
+
+// bearerToken 取出 Authorization: Bearer 請求頭中的 token
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
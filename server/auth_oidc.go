@@ -0,0 +1,312 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/spf13/viper"
+)
+
+// oidcAuthenticator 驗證 OIDC ID token（RS256 / ES256）
+// 公鑰來自 jwks-file 指定的 JWKS 文件；未配置時通過 issuer 的 discovery 文檔獲取 jwks_uri。
+// ID token 通過 id_token 參數或 Authorization: Bearer 請求頭傳入（瀏覽器的 WebSocket 無法設置請求頭）。
+type oidcAuthenticator struct {
+	issuer        string
+	audience      string
+	jwksFile      string
+	nicknameClaim string
+
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+	// 上次從 issuer 獲取公鑰的時間，避免未知 kid 的 token 頻繁觸發請求
+	fetchedAt time.Time
+}
+
+func newOIDCAuthenticator() (*oidcAuthenticator, error) {
+	a := &oidcAuthenticator{
+		issuer:        viper.GetString("auth.oidc.issuer"),
+		audience:      viper.GetString("auth.oidc.audience"),
+		jwksFile:      viper.GetString("auth.oidc.jwks-file"),
+		nicknameClaim: viper.GetString("auth.oidc.nickname-claim"),
+	}
+	if a.issuer == "" {
+		return nil, errors.New("auth.oidc.issuer is required")
+	}
+	if a.nicknameClaim == "" {
+		a.nicknameClaim = "preferred_username"
+	}
+
+	if err := a.loadKeys(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *oidcAuthenticator) Authenticate(req *http.Request) (*logic.Identity, error) {
+	token := req.FormValue("id_token")
+	if token == "" {
+		token = bearerToken(req)
+	}
+	if token == "" {
+		return nil, errNoCredentials
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		log.Println("oidc verify error:", err)
+		return nil, errUnauthorized
+	}
+
+	sub, _ := claims["sub"].(string)
+	nickname, _ := claims[a.nicknameClaim].(string)
+	if sub == "" || nickname == "" {
+		return nil, errUnauthorized
+	}
+
+	return logic.BindIdentity("oidc:"+a.issuer, sub, nickname, logic.RoleUser)
+}
+
+// verify 驗證簽名及 iss、aud、exp、nbf，返回 claims
+func (a *oidcAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := logic.DecodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected alg %s for RSA key", header.Alg)
+		}
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature); err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("unexpected alg %s for EC key", header.Alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hashed[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	var claims map[string]interface{}
+	if err = logic.DecodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if a.audience != "" && !audienceContains(claims["aud"], a.audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(logic.TokenClockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(logic.TokenClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	return claims, nil
+}
+
+// key 查找 kid 對應的公鑰，找不到時（可能是 issuer 輪換了密鑰）重新加載一次
+func (a *oidcAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	reload := !ok && a.jwksFile == "" && time.Since(a.fetchedAt) > time.Minute
+	a.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	if reload {
+		if err := a.loadKeys(); err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		key, ok = a.keys[kid]
+		a.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// loadKeys 從 JWKS 文件或 issuer 加載公鑰
+func (a *oidcAuthenticator) loadKeys() error {
+	var (
+		data []byte
+		err  error
+	)
+	if a.jwksFile != "" {
+		data, err = os.ReadFile(a.jwksFile)
+	} else {
+		data, err = fetchIssuerJWKS(a.issuer)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	a.mu.Unlock()
+	return nil
+}
+
+// fetchIssuerJWKS 通過 issuer 的 discovery 文檔獲取 JWKS
+func fetchIssuerJWKS(issuer string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("jwks_uri not found in discovery document")
+	}
+
+	var raw json.RawMessage
+	if err := getJSON(client, discovery.JWKSURI, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// parseJWKS 解析 JWKS 中的 RSA 和 P-256 公鑰
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key in jwks")
+	}
+	return keys, nil
+}
+
+// audienceContains aud 可以是字符串或字符串數組
+func audienceContains(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package server
+
+/*
+機器人消息接口：POST /api/rooms/{room}/messages
+請求頭 X-API-Key 為設定檔 auth.apikeys 中的 key，請求體為 {"content": "..."}，
+消息以該 key 對應昵稱的機器人用戶發送到房間 room。
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// botAuthenticator 機器人接口只接受 API key，與 auth.providers 是否啟用 apikey 無關
+var botAuthenticator *apiKeyAuthenticator
+
+func initBotAuthenticator() {
+	botAuthenticator = newAPIKeyAuthenticator()
+}
+
+// botMessagesHandleFunc 處理 /api/rooms/ 下的請求
+func botMessagesHandleFunc(w http.ResponseWriter, req *http.Request) {
+	room, ok := parseRoomMessagesPath(req.URL.Path)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "接口不存在"})
+		return
+	}
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 POST 請求"})
+		return
+	}
+
+	ident, err := botAuthenticator.Authenticate(req)
+	if err != nil {
+		if errors.Is(err, errNoCredentials) {
+			err = errUnauthorized
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var body struct {
+		Content string `json:"content"`
+	}
+	if err = json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "消息格式錯誤"})
+		return
+	}
+
+	msg, err := logic.PostBotMessage(logic.NewBotUser(ident), room, body.Content)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, msg)
+}
+
+// parseRoomMessagesPath 從 /api/rooms/{room}/messages 中取出 room
+func parseRoomMessagesPath(path string) (string, bool) {
+	rest := strings.TrimPrefix(path, "/api/rooms/")
+	if rest == path {
+		return "", false
+	}
+	room, tail, found := strings.Cut(rest, "/")
+	if !found || tail != "messages" || room == "" {
+		return "", false
+	}
+	return room, true
+}
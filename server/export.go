@@ -0,0 +1,77 @@
+package server
+
+/*
+聊天記錄導出：GET /export?room=房間&since=時間&until=時間&format=jsonl|csv|text|html&system=1
+只有管理員可以導出，認證方式與進入聊天室相同（昵稱 + token、API key 等）。
+*/
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+func exportHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 GET 請求"})
+		return
+	}
+
+	ident, err := authenticate(req)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	if ident.Role < logic.RoleAdmin {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "只有管理員可以導出聊天記錄"})
+		return
+	}
+
+	opts := &logic.ExportOptions{
+		Room:          req.FormValue("room"),
+		Format:        req.FormValue("format"),
+		IncludeSystem: req.FormValue("system") == "1",
+	}
+	if opts.Room == "" {
+		opts.Room = logic.DefaultRoom
+	}
+	if opts.Format == "" {
+		opts.Format = logic.ExportJSONL
+	}
+	format, ok := logic.ExportFormats[opts.Format]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "不支持的導出格式：" + opts.Format})
+		return
+	}
+	for name, t := range map[string]*time.Time{"since": &opts.Since, "until": &opts.Until} {
+		if v := req.FormValue(name); v != "" {
+			if *t, err = logic.ParseTime(v); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+	}
+	if err = logic.CheckRoomName(opts.Room); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Println("export room", opts.Room, "by", ident.NickName)
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", exportDisposition(opts.Room+"-"+time.Now().Format("20060102")+"."+format.Ext))
+	if err = logic.ExportHistory(w, opts); err != nil {
+		// 響應頭已經發出，只能記錄日誌
+		log.Println("export error:", err)
+	}
+}
+
+// exportDisposition 下載文件名的 Content-Disposition，房間名稱可以包含引號、分號等字符，需要按規則轉義
+func exportDisposition(filename string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return "attachment"
+}
@@ -0,0 +1,16 @@
+package server
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestExportDisposition(t *testing.T) {
+	for _, filename := range []string{`a";x=1.csv`, "大廳-20240101.html"} {
+		v := exportDisposition(filename)
+		disposition, params, err := mime.ParseMediaType(v)
+		if err != nil || disposition != "attachment" || params["filename"] != filename || params["x"] != "" {
+			t.Errorf("%q: %q parsed as %q %v, %v", filename, v, disposition, params, err)
+		}
+	}
+}
@@ -1,16 +1,77 @@
 package server
 
 import (
+	"expvar"
 	"github.com/rorast/go-chatroom/logic"
+	"log"
 	"net/http"
+	"net/http/pprof"
 )
 
+// mux 聊天室的路由。不使用 http.DefaultServeMux：導入 expvar 和 net/http/pprof 時
+// 它們會在其中註冊不需要認證的 /debug/ 路由，這裡改為只對管理員開放
+var mux = http.NewServeMux()
+
 func RegisterHandle() {
+	// 重啟前撤銷的 token
+	if err := logic.RevokedTokens.Load(); err != nil {
+		log.Fatal("load revoked tokens error:", err)
+	}
+
+	// 按設定檔創建認證方式
+	initAuthenticators()
+	initBotAuthenticator()
+
+	// 進程內機器人
+	if err := logic.StartBots(); err != nil {
+		log.Fatal("start bots error:", err)
+	}
+
+	// 消息歷史
+	logic.History.Start()
+	logic.Retention.Start()
+
+	// 外發 webhook
+	logic.Webhooks.Start()
+
+	// 離線通知
+	if err := logic.Notifications.Start(); err != nil {
+		log.Fatal("start notifiers error:", err)
+	}
+
+	// 附件
+	if err := logic.Attachments.Start(); err != nil {
+		log.Fatal("start attachments error:", err)
+	}
+
 	// 廣播消息處理
 	go logic.Broadcaster.Start()
 
 	// 聊天室服務器處理路由
-	http.HandleFunc("/", indexHandleFunc)
-	http.HandleFunc("/users", userHandleFunc)
-	http.HandleFunc("/ws", websocketHandleFunc)
+	mux.HandleFunc("/", indexHandleFunc)
+	mux.HandleFunc("/users", cors(userHandleFunc))
+	mux.HandleFunc("/ws", websocketHandleFunc)
+	mux.HandleFunc("/events", cors(eventsHandleFunc))
+	mux.HandleFunc("/messages", cors(messagesHandleFunc))
+	mux.HandleFunc("/register", cors(registerHandleFunc))
+	mux.HandleFunc("/login", cors(loginHandleFunc))
+	mux.HandleFunc("/api/rooms/", cors(botMessagesHandleFunc))
+	mux.HandleFunc("/search", cors(searchHandleFunc))
+	mux.HandleFunc("/export", exportHandleFunc)
+	mux.HandleFunc("/upload", cors(uploadHandleFunc))
+	mux.HandleFunc("/files/", fileHandleFunc)
+
+	mux.HandleFunc("/debug/", adminOnly(debugMux().ServeHTTP))
+}
+
+// debugMux 運行狀態（消息隊列、離線收件箱、各房間的存儲統計等）和性能分析，包含房間名稱等內部信息
+func debugMux() *http.ServeMux {
+	m := http.NewServeMux()
+	m.Handle("/debug/vars", expvar.Handler())
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return m
 }
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/spf13/viper"
+)
+
+func TestDebugVarsAdminOnly(t *testing.T) {
+	initAuthenticators()
+
+	// 同一個存儲中多次運行時帳號已經存在
+	logic.Accounts.Register("debugadmin", "secret-password")
+	admin, adminToken, err := logic.Accounts.Login("debugadmin", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("admin-uids", []int{admin.UID})
+	t.Cleanup(func() { viper.Set("admin-uids", nil) })
+
+	h := adminOnly(debugMux().ServeHTTP)
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"guest", url.Values{"nickname": {"debugguest"}}, http.StatusForbidden},
+		{"admin", url.Values{"nickname": {"debugadmin"}, "token": {adminToken}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars?"+tt.query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		// 存儲統計中有房間名稱，只有管理員能看到
+		if got := strings.Contains(rec.Body.String(), `"store"`); got != (tt.status == http.StatusOK) {
+			t.Errorf("%s: body contains store stats = %v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+/*
+IRC 網關：IRC 客戶端（irssi、WeeChat 等）可以直接連接聊天室。
+IRC 頻道 #name 對應聊天室的房間 name，IRC 用戶與 WebSocket、TCP 用戶一樣登記到 logic.Broadcaster，
+例如 IRC 客戶端 JOIN #lobby 後，就能和瀏覽器用戶在預設房間中聊天。
+
+已註冊的昵稱需要通過 PASS 提供密碼或本服務簽發的 token。
+*/
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/rorast/go-chatroom/transport"
+	"github.com/spf13/viper"
+)
+
+var errIRCQuit = errors.New("client quit")
+
+// ServeIRC 在 addr 上提供 IRC 服務
+func ServeIRC(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return acceptLoop(listener, "irc", handleIRCConn)
+}
+
+// handleIRCConn 處理一個 IRC 連接：完成註冊後進入與 WebSocket 相同的會話流程，不自動加入任何房間
+func handleIRCConn(conn net.Conn) {
+	serverName := viper.GetString("irc.server-name")
+	if serverName == "" {
+		serverName = "chatroom"
+	}
+	ircConn := transport.NewIRCConn(conn, serverName, viper.GetDuration("irc.idle-timeout"))
+
+	// 1. 等待 NICK、USER 完成註冊並認證身份
+	ident, err := registerIRCUser(ircConn)
+	if err != nil {
+		ircConn.Close(logic.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	serveConn(context.Background(), ircConn, ident, conn.RemoteAddr().String(), false)
+}
+
+// registerIRCUser 處理註冊階段的命令，直到收到 NICK 和 USER
+func registerIRCUser(conn *transport.IRCConn) (*logic.Identity, error) {
+	var (
+		nickname, password string
+		gotUser            bool
+	)
+
+	for nickname == "" || !gotUser {
+		m, err := conn.ReadCommand()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.Command {
+		case "CAP":
+			// 不支持任何擴展能力
+			switch m.Param(0) {
+			case "LS":
+				conn.Send("CAP", "*", "LS", "")
+			case "REQ":
+				conn.Send("CAP", "*", "NAK", m.Param(1))
+			}
+		case "PASS":
+			password = m.Param(0)
+		case "NICK":
+			nick := m.Param(0)
+			if err = logic.CheckNickname(nick); err != nil {
+				conn.Reply("432", nick, err.Error())
+				continue
+			}
+			if !logic.Broadcaster.CanEnterRoom(nick) {
+				conn.Reply("433", nick, "Nickname is already in use")
+				continue
+			}
+			nickname = nick
+		case "USER":
+			if len(m.Params) < 4 {
+				conn.Reply("461", "USER", "Not enough parameters")
+				continue
+			}
+			gotUser = true
+		case "PING":
+			conn.Send("PONG", m.Param(0))
+		case "QUIT":
+			return nil, errIRCQuit
+		default:
+			conn.Reply("451", "You have not registered")
+		}
+	}
+	conn.SetNick(nickname)
+
+	ident, err := authenticateIRCUser(nickname, password)
+	if err != nil {
+		conn.Reply("464", "Password incorrect: "+err.Error())
+		return nil, err
+	}
+	return ident, nil
+}
+
+// authenticateIRCUser 已註冊的昵稱使用 PASS 中的密碼登入，PASS 也可以是本服務簽發的 token
+func authenticateIRCUser(nickname, password string) (*logic.Identity, error) {
+	token := password
+
+	account, err := logic.Accounts.Get(nickname)
+	if err != nil {
+		return nil, err
+	}
+	if account != nil && password != "" {
+		if _, t, err := logic.Accounts.Login(nickname, password); err == nil {
+			token = t
+		}
+	}
+
+	return logic.AuthenticateToken(token, nickname, allowGuest())
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// ircClient 腳本化的 IRC 客戶端，直接通過 TCP 收發協議行
+type ircClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startIRC 在隨機端口上啟動 IRC 網關，返回監聽地址，測試結束時關閉
+func startIRC(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptLoop(listener, "irc", handleIRCConn)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func dialIRC(t *testing.T, addr string) *ircClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &ircClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *ircClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect 讀取服務器發來的行，直到某一行包含 substr，返回該行（不含行尾）
+func (c *ircClient) expect(substr string) string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(testWait))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %q: %v", substr, err)
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		// 服務器發出的每一行都帶有前綴，否則說明有內容被拆成了新的命令
+		if !strings.HasPrefix(line, ":") && !strings.HasPrefix(line, "ERROR") {
+			c.t.Fatalf("line without prefix: %q", line)
+		}
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+}
+
+func TestIRCGateway(t *testing.T) {
+	irc := dialIRC(t, startIRC(t))
+	irc.send("NICK ircbob")
+	irc.send("USER ircbob 0 * :IRC Bob")
+	irc.expect(" 001 ircbob ")
+
+	irc.send("JOIN #" + logic.DefaultRoom)
+	if line := irc.expect(" JOIN :#" + logic.DefaultRoom); !strings.HasPrefix(line, ":ircbob!") {
+		t.Errorf("join = %q, want prefix :ircbob!", line)
+	}
+	irc.expect(" 366 ")
+
+	web := connect(t, "webalice", logic.DefaultRoom)
+	if line := irc.expect(" JOIN :#" + logic.DefaultRoom); !strings.HasPrefix(line, ":webalice!") {
+		t.Errorf("join = %q, want prefix :webalice!", line)
+	}
+
+	// IRC 用戶的消息出現在房間中
+	irc.send("PRIVMSG #" + logic.DefaultRoom + " :hello from irc")
+	web.expect(normal("ircbob", "hello from irc"))
+
+	// 瀏覽器用戶的多行消息拆成多條 PRIVMSG，內容中的 CR 不能結束一行
+	web.say(logic.DefaultRoom, "hi irc\rQUIT :injected\nsecond line")
+	line := irc.expect("PRIVMSG #" + logic.DefaultRoom)
+	if want := " PRIVMSG #" + logic.DefaultRoom + " :hi irc QUIT :injected"; !strings.HasSuffix(line, want) {
+		t.Errorf("first line = %q, want suffix %q", line, want)
+	}
+	if !strings.HasPrefix(line, ":webalice!") {
+		t.Errorf("first line = %q, want prefix :webalice!", line)
+	}
+	line = irc.expect("PRIVMSG #" + logic.DefaultRoom)
+	if !strings.HasSuffix(line, " :second line") {
+		t.Errorf("second line = %q", line)
+	}
+
+	irc.send("QUIT :bye")
+	web.expect(func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeUserLeave && msg.User.NickName == "ircbob"
+	})
+}
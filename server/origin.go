@@ -0,0 +1,81 @@
+package server
+
+/*
+跨域策略：設定檔 allowed-origins 配置允許的來源，WebSocket 握手和 HTTP 接口的 CORS 使用同一份配置。
+  - 同源請求（Origin 的 host 與請求的 Host 相同）始終允許
+  - 不帶 scheme 的規則匹配 Origin 的 host（含端口），例如 "*.example.com"、"localhost:8080"
+  - 帶 scheme 的規則匹配完整的 Origin，例如 "https://chat.example.com"
+  - 規則使用 path.Match 的通配符語法，"*" 表示允許任何來源
+*/
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// originAllowed 判斷請求的 Origin 是否被允許；沒有 Origin 的請求（非瀏覽器客戶端）總是允許
+func originAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	host := strings.ToLower(u.Host)
+	for _, pattern := range viper.GetStringSlice("allowed-origins") {
+		pattern = strings.ToLower(pattern)
+
+		target := host
+		if strings.Contains(pattern, "://") {
+			target = origin
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cors 為 HTTP 接口加上跨域處理：拒絕不允許的來源，允許的來源返回 CORS 響應頭，並直接響應預檢請求
+func cors(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			h(w, req)
+			return
+		}
+
+		// 不允許的來源直接拒絕，而不只是讓瀏覽器攔截響應，避免跨站提交的表單被執行
+		if !originAllowed(req) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		header.Add("Vary", "Origin")
+
+		if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+			header.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h(w, req)
+	}
+}
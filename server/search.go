@@ -0,0 +1,65 @@
+package server
+
+/*
+消息歷史搜索：GET /search?q=關鍵字&from=昵稱&room=房間&before=時間&limit=數量
+before 可以是 RFC 3339 時間（2006-01-02T15:04:05+08:00）、日期（2006-01-02）或 Unix 秒數。
+需要與進入聊天室相同的憑證；房間都可以自由加入，因此用戶可以搜索任意一個房間，
+不指定房間搜索全部房間只對管理員開放。
+*/
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+func searchHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 GET 請求"})
+		return
+	}
+
+	ident, err := authenticate(req)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	q := &logic.SearchQuery{
+		Text: req.FormValue("q"),
+		From: req.FormValue("from"),
+		Room: req.FormValue("room"),
+	}
+	if q.Room == "" {
+		if ident.Role < logic.RoleAdmin {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "只有管理員可以搜索全部房間，請指定 room"})
+			return
+		}
+	} else if err = logic.CheckRoomName(q.Room); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if before := req.FormValue("before"); before != "" {
+		if q.Before, err = logic.ParseTime(before); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if limit := req.FormValue("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit 不合法"})
+			return
+		}
+	}
+
+	results, err := logic.History.Search(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if results == nil {
+		results = []*logic.SearchResult{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/spf13/viper"
+)
+
+func TestSearchRequiresAuth(t *testing.T) {
+	initAuthenticators()
+
+	// 同一個存儲中多次運行時帳號已經存在
+	logic.Accounts.Register("searchadmin", "secret-password")
+	admin, adminToken, err := logic.Accounts.Login("searchadmin", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("admin-uids", []int{admin.UID})
+	t.Cleanup(func() { viper.Set("admin-uids", nil) })
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"anonymous", url.Values{"q": {"hello"}, "room": {logic.DefaultRoom}}, http.StatusUnauthorized},
+		{"guest in all rooms", url.Values{"nickname": {"searchguest"}, "q": {"hello"}}, http.StatusForbidden},
+		{"guest in a room", url.Values{"nickname": {"searchguest"}, "q": {"hello"}, "room": {logic.DefaultRoom}}, http.StatusOK},
+		{"admin in all rooms", url.Values{"nickname": {"searchadmin"}, "token": {adminToken}, "q": {"hello"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		searchHandleFunc(rec, httptest.NewRequest(http.MethodGet, "/search?"+tt.query.Encode(), nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+}
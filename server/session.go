@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// 用戶離開後，等待寫入 goroutine 把剩餘消息寫完的最長時間
+const drainTimeout = time.Second
+
+// serveConn 已認證用戶的完整會話，與傳輸方式無關：進入聊天室並加入 rooms、收發消息直到連接斷開、離開聊天室
+// reliable 為 true 時啟用可靠投遞，客戶端需要確認收到的消息
+func serveConn(ctx context.Context, conn logic.Conn, ident *logic.Identity, addr string, reliable bool, rooms ...string) {
+	nickname := ident.NickName
+	userHasToken := logic.NewUser(conn, ident, addr)
+	if reliable {
+		userHasToken.EnableReliableDelivery()
+		defer userHasToken.ReleaseDeliveries()
+	}
+
+	// 2. 啟動用戶寫入數據的 goroutine
+	done := make(chan struct{})
+	go func() {
+		userHasToken.SendMessage(ctx)
+		close(done)
+	}()
+
+	// 3. 給當前用戶發送歡迎消息
+	userHasToken.MessageChannel <- logic.NewWelcomeMessage(userHasToken)
+
+	// 避免 token 泄露
+	tmpUser := *userHasToken
+	user := &tmpUser
+	user.Token = ""
+
+	// 4. 將該用戶加入到廣播器的用戶列表中，昵稱被其他用戶佔用時拒絕；同一用戶的舊連接會被斷開
+	if err := logic.Broadcaster.UserEntering(user); err != nil {
+		userHasToken.CloseMessageChannel()
+		<-done
+		rejectConn(ctx, conn, err)
+		return
+	}
+	log.Println("user:", nickname, "joins chat")
+
+	// 加入房間，並通知房間內的用戶
+	for _, room := range rooms {
+		if err := logic.Broadcaster.JoinRoom(user, room); err != nil {
+			log.Println("join room error:", err)
+		}
+	}
+
+	// 5. 接收用戶消息
+	err := user.ReceiveMessage(ctx)
+
+	// 6. 用戶離開，廣播器會關閉消息通道，寫入 goroutine 寫完剩餘消息後退出
+	logic.Broadcaster.UserLeaving(user)
+	if user.Replaced() {
+		log.Println("user:", nickname, "reconnected, old connection closed")
+	} else {
+		logic.Broadcaster.Broadcast(logic.NewUserLeaveMessage(user))
+		log.Println("user:", nickname, "Leaves Chat")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+	}
+
+	// 根據取到的錯誤執行同的 Close
+	if err == nil {
+		conn.Close(logic.CloseNormal, "")
+	} else {
+		log.Println("Read from client error:", err)
+		conn.Close(logic.CloseInternalError, "Read from client error")
+	}
+}
+
+// rejectConn 認證失敗時，告知客戶端原因並關閉連接
+func rejectConn(ctx context.Context, conn logic.Conn, err error) {
+	conn.WriteMessage(ctx, logic.NewErrorMessage(err.Error()))
+	conn.Close(logic.ClosePolicyViolation, "authenticate error")
+}
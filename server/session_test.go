@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/rorast/go-chatroom/transport"
+)
+
+// 等待期望的消息的最長時間
+const testWait = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "chatroom-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = logic.OpenStore(filepath.Join(dir, "chatroom.db")); err != nil {
+		log.Fatal(err)
+	}
+	go logic.Broadcaster.Start()
+
+	code := m.Run()
+
+	logic.CloseStore()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testClient 通過內存管道進入聊天室的客戶端，與 WebSocket 用戶走相同的會話流程
+type testClient struct {
+	t        *testing.T
+	nickname string
+	pipe     *transport.Pipe
+	done     chan struct{}
+}
+
+// connect 以遊客身份進入聊天室並加入 rooms，等待所有房間加入成功後返回，測試結束時自動離開
+func connect(t *testing.T, nickname string, rooms ...string) *testClient {
+	t.Helper()
+
+	ident, err := logic.AuthenticateToken("", nickname, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connectAs(t, ident, false, rooms...)
+}
+
+// connectAs 以已認證的身份 ident 進入聊天室，reliable 為 true 時啟用可靠投遞
+func connectAs(t *testing.T, ident *logic.Identity, reliable bool, rooms ...string) *testClient {
+	t.Helper()
+
+	c := &testClient{
+		t:        t,
+		nickname: ident.NickName,
+		pipe:     transport.NewPipe(64),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		serveConn(context.Background(), c.pipe, ident, "pipe", reliable, rooms...)
+		close(c.done)
+	}()
+	t.Cleanup(c.close)
+
+	c.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeWelcome })
+	for _, room := range rooms {
+		c.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeRoomJoined && msg.Room == room })
+	}
+	return c
+}
+
+// close 客戶端斷開連接，並等待會話結束
+func (c *testClient) close() {
+	c.pipe.CloseClient()
+	select {
+	case <-c.done:
+	case <-time.After(testWait):
+		c.t.Errorf("%s: session did not end", c.nickname)
+	}
+}
+
+// send 發送一條消息
+func (c *testClient) send(msg map[string]string) {
+	c.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	if err := c.pipe.Send(ctx, msg); err != nil {
+		c.t.Fatalf("%s: send %v: %v", c.nickname, msg, err)
+	}
+}
+
+// say 在 room 中發言或執行指令
+func (c *testClient) say(room, content string) {
+	c.t.Helper()
+	c.send(map[string]string{"room": room, "content": content})
+}
+
+// receive 在 wait 時間內讀取消息，直到 match 返回 true，沒有讀到時返回 nil
+func (c *testClient) receive(wait time.Duration, match func(*logic.Message) bool) *logic.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	for {
+		msg, err := c.pipe.Receive(ctx)
+		if err != nil {
+			return nil
+		}
+		if match(msg) {
+			return msg
+		}
+	}
+}
+
+// expect 讀取消息直到 match 返回 true，超時則測試失敗
+func (c *testClient) expect(match func(*logic.Message) bool) *logic.Message {
+	c.t.Helper()
+
+	msg := c.receive(testWait, match)
+	if msg == nil {
+		c.t.Fatalf("%s: expected message not received", c.nickname)
+	}
+	return msg
+}
+
+// expectNone 在短時間內沒有讀到 match 的消息，否則測試失敗
+func (c *testClient) expectNone(match func(*logic.Message) bool) {
+	c.t.Helper()
+
+	if msg := c.receive(200*time.Millisecond, match); msg != nil {
+		c.t.Fatalf("%s: unexpected message %+v", c.nickname, msg)
+	}
+}
+
+// withID 匹配 ID 為 id 的消息
+func withID(id string) func(*logic.Message) bool {
+	return func(msg *logic.Message) bool { return msg.ID == id }
+}
+
+// normal 匹配 from 發出的、內容為 content 的普通消息
+func normal(from, content string) func(*logic.Message) bool {
+	return func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeNormal && msg.User.NickName == from && msg.Content == content
+	}
+}
+
+func TestBroadcastToRoomMembers(t *testing.T) {
+	alice := connect(t, "alice", logic.DefaultRoom)
+	bob := connect(t, "bob", logic.DefaultRoom)
+	carol := connect(t, "carol", "dev")
+
+	// 加入房間時會補發最近的消息，內容帶上時間以免匹配到之前運行的測試發出的消息
+	content := "hello " + time.Now().Format(time.RFC3339Nano)
+	alice.say(logic.DefaultRoom, content)
+	msg := bob.expect(normal("alice", content))
+	if msg.Room != logic.DefaultRoom || msg.Seq == 0 {
+		t.Errorf("message = room %q seq %d, want room %q with a seq", msg.Room, msg.Seq, logic.DefaultRoom)
+	}
+	// 不在房間中的用戶和發送者自己都收不到
+	carol.expectNone(withID(msg.ID))
+	alice.expectNone(withID(msg.ID))
+}
+
+func TestJoinAndPart(t *testing.T) {
+	dave := connect(t, "dave", logic.DefaultRoom)
+	erin := connect(t, "erin", logic.DefaultRoom)
+
+	erin.send(map[string]string{"type": "join", "room": "ops"})
+	joined := erin.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeRoomJoined && msg.Room == "ops" })
+	if len(joined.Users) != 1 || joined.Users[0].NickName != "erin" {
+		t.Errorf("ops members = %v, want only erin", joined.Users)
+	}
+
+	dave.send(map[string]string{"type": "join", "room": "ops"})
+	erin.expect(func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeUserEnter && msg.Room == "ops" && msg.User.NickName == "dave"
+	})
+
+	dave.send(map[string]string{"type": "part", "room": "ops"})
+	erin.expect(func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeUserLeave && msg.Room == "ops" && msg.User.NickName == "dave"
+	})
+
+	// 離開房間後不能再在其中發言
+	dave.say("ops", "still here?")
+	dave.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeError })
+	erin.expectNone(func(msg *logic.Message) bool { return msg.Room == "ops" && msg.Type == logic.MsgTypeNormal })
+}
+
+func TestRenameAndLeave(t *testing.T) {
+	frank := connect(t, "frank", logic.DefaultRoom)
+	grace := connect(t, "grace", logic.DefaultRoom)
+
+	grace.say(logic.DefaultRoom, "/nick grace2")
+	renamed := frank.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeUserRename })
+	if renamed.User.NickName != "grace2" || renamed.User.Token != "" {
+		t.Errorf("rename = %q token %q, want grace2 without a token", renamed.User.NickName, renamed.User.Token)
+	}
+	own := grace.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeUserRename })
+	if own.User.Token == "" {
+		t.Error("the renamed user did not receive a new token")
+	}
+
+	content := "renamed " + time.Now().Format(time.RFC3339Nano)
+	grace.say(logic.DefaultRoom, content)
+	frank.expect(normal("grace2", content))
+
+	grace.close()
+	frank.expect(func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeUserLeave && msg.User.NickName == "grace2"
+	})
+}
+
+func TestRenameRollsBackAccount(t *testing.T) {
+	// 同一個存儲中多次運行時帳號已經存在
+	logic.Accounts.Register("kate", "secret-password")
+	account, token, err := logic.Accounts.Login("kate", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident, err := logic.AuthenticateToken(token, "kate", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kate := connectAs(t, ident, false, logic.DefaultRoom)
+	connect(t, "liam", logic.DefaultRoom)
+
+	// 新昵稱被在線用戶佔用時，帳號保持原昵稱
+	kate.say(logic.DefaultRoom, "/nick liam")
+	kate.expect(func(msg *logic.Message) bool { return msg.Type == logic.MsgTypeError })
+	if uid, ok := logic.Accounts.UID("kate"); !ok || uid != account.UID {
+		t.Errorf("account kate = %d, %v, want uid %d", uid, ok, account.UID)
+	}
+	if _, ok := logic.Accounts.UID("liam"); ok {
+		t.Error("account was renamed to the nickname of an online user")
+	}
+}
+
+func TestReliableRedelivery(t *testing.T) {
+	room := "reliable-" + time.Now().Format("150405.000000000")
+	ident, err := logic.AuthenticateToken("", "henry", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	henry := connectAs(t, ident, true, room)
+	ivan := connect(t, "ivan", room)
+
+	for _, content := range []string{"one", "two", "three"} {
+		ivan.say(room, content)
+		if msg := henry.expect(normal("ivan", content)); msg.Delivery == 0 {
+			t.Errorf("%s: no delivery seq", content)
+		}
+	}
+	// 只確認第一條，斷開後重新連接時重發其餘兩條，投遞序號保持不變
+	henry.send(map[string]string{"type": "ack", "seq": "1"})
+	// ack 與斷開之間沒有順序保證，等待 ack 被讀取
+	time.Sleep(100 * time.Millisecond)
+	henry.close()
+
+	again, err := logic.AuthenticateToken(ident.Token, "henry", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	henry = connectAs(t, again, true)
+	for i, content := range []string{"two", "three"} {
+		msg := henry.expect(func(msg *logic.Message) bool { return msg.Delivery != 0 })
+		if msg.Content != content || msg.Delivery != int64(i+2) {
+			t.Errorf("redelivered %q with seq %d, want %q with seq %d", msg.Content, msg.Delivery, content, i+2)
+		}
+	}
+}
+
+func TestReconnectBeforeOldSessionCloses(t *testing.T) {
+	room := "reconnect-" + time.Now().Format("150405.000000000")
+	ident, err := logic.AuthenticateToken("", "olive", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := connectAs(t, ident, true, room)
+	petra := connect(t, "petra", room)
+
+	// 舊連接還沒有斷開時以同一個 token 重新連接，舊連接被服務端斷開
+	again, err := logic.AuthenticateToken(ident.Token, "olive", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	olive := connectAs(t, again, true, room)
+	select {
+	case <-old.done:
+	case <-time.After(testWait):
+		t.Fatal("the old session was not closed")
+	}
+	petra.expectNone(func(msg *logic.Message) bool {
+		return msg.Type == logic.MsgTypeUserLeave && msg.User.NickName == "olive"
+	})
+
+	content := "after reconnect " + time.Now().Format(time.RFC3339Nano)
+	petra.say(room, content)
+	olive.expect(normal("petra", content))
+
+	// 其他用戶不能使用在線用戶的昵稱
+	other, err := logic.AuthenticateToken("", "olive", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipe := transport.NewPipe(64)
+	go serveConn(context.Background(), pipe, other, "pipe", false)
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	for {
+		msg, err := pipe.Receive(ctx)
+		if err != nil {
+			t.Fatal("a different user with the same nickname was not rejected")
+		}
+		if msg.Type == logic.MsgTypeError {
+			break
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+/*
+SSE + HTTP POST 後備傳輸：
+  - GET /events：與 /ws 相同的參數和認證方式，響應為 text/event-stream，每條消息一個 data 事件
+  - POST /messages：請求體為與 WebSocket 相同格式的 JSON 消息，
+    通過 Authorization: Bearer <token>（或 token 參數）找到該用戶的 SSE 會話
+
+SSE 會話與 WebSocket 會話走同一個 serveConn 流程，離線消息和進出通知完全相同。
+*/
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/rorast/go-chatroom/transport"
+)
+
+// SSE 保活間隔
+const sseKeepAliveInterval = 20 * time.Second
+
+// sseSessions 在線的 SSE 會話，key 為 UID
+var sseSessions = struct {
+	sync.Mutex
+	conns map[int]*transport.SSEConn
+}{conns: make(map[int]*transport.SSEConn)}
+
+func eventsHandleFunc(w http.ResponseWriter, req *http.Request) {
+	ident, err := authenticate(req)
+	if err != nil {
+		log.Println("authenticate error:", req.FormValue("nickname"), err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	conn, err := transport.NewSSEConn(w)
+	if err != nil {
+		log.Println("sse error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 同一個用戶重連時，新會話取代舊會話接收 POST 的消息
+	sseSessions.Lock()
+	sseSessions.conns[ident.UID] = conn
+	sseSessions.Unlock()
+	defer func() {
+		sseSessions.Lock()
+		if sseSessions.conns[ident.UID] == conn {
+			delete(sseSessions.conns, ident.UID)
+		}
+		sseSessions.Unlock()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(sseKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if conn.KeepAlive() != nil {
+					return
+				}
+			case <-conn.Done():
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}()
+
+	serveConn(req.Context(), conn, ident, req.RemoteAddr, req.FormValue("ack") == "1", logic.DefaultRoom)
+}
+
+func messagesHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 POST 請求"})
+		return
+	}
+
+	token := bearerToken(req)
+	if token == "" {
+		token = req.FormValue("token")
+	}
+	claims, err := logic.ParseToken(token)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	sseSessions.Lock()
+	conn := sseSessions.conns[claims.UID()]
+	sseSessions.Unlock()
+	if conn == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "沒有在線的 SSE 會話"})
+		return
+	}
+
+	var receiveMsg map[string]string
+	if err = json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&receiveMsg); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "消息格式錯誤"})
+		return
+	}
+
+	if err = conn.Deliver(req.Context(), receiveMsg); err != nil {
+		writeJSON(w, http.StatusGone, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+package server
+
+/*
+行模式 TCP 聊天服務：可以直接用 telnet / nc 連接，每行輸入一條消息。
+TCP 用戶與 WebSocket 用戶一樣登記到 logic.Broadcaster，共用同一個聊天室，
+同樣支持斜線指令；已註冊的昵稱需要輸入密碼登入。
+*/
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/rorast/go-chatroom/transport"
+	"github.com/spf13/viper"
+)
+
+// 昵稱協商最多嘗試的次數
+const tcpLoginTries = 3
+
+// Accept 出錯（例如文件描述符用盡）後重試的最長等待時間
+const maxAcceptDelay = time.Second
+
+// ServeTCP 在 addr 上提供行模式的 TCP 聊天服務
+func ServeTCP(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return acceptLoop(listener, "tcp", handleTCPConn)
+}
+
+// acceptLoop 不斷接受連接並在新的 goroutine 中交給 handle 處理。
+// Accept 出錯時等待一段時間再重試，連續出錯時等待時間加倍，避免空轉佔滿 CPU；監聽關閉後返回
+func acceptLoop(listener net.Listener, name string, handle func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay *= 2; delay == 0 {
+				delay = 5 * time.Millisecond
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("%s accept error: %v; retrying in %v", name, err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		delay = 0
+		go handle(conn)
+	}
+}
+
+// handleTCPConn 處理一個 TCP 連接：協商昵稱後進入與 WebSocket 相同的會話流程
+func handleTCPConn(conn net.Conn) {
+	lineConn := transport.NewLineConn(conn, viper.GetDuration("tcp.idle-timeout"))
+
+	// 1. 協商昵稱並認證身份
+	ident, err := negotiateTCPUser(lineConn)
+	if err != nil {
+		lineConn.Close(logic.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	serveConn(context.Background(), lineConn, ident, conn.RemoteAddr().String(), false, logic.DefaultRoom)
+}
+
+// negotiateTCPUser 提示用戶輸入昵稱，已註冊的昵稱需要再輸入密碼
+func negotiateTCPUser(conn *transport.LineConn) (*logic.Identity, error) {
+	for i := 0; i < tcpLoginTries; i++ {
+		nickname, err := conn.Prompt("請輸入昵稱：")
+		if err != nil {
+			return nil, err
+		}
+
+		if err = logic.CheckNickname(nickname); err != nil {
+			conn.Println(err.Error())
+			continue
+		}
+		if !logic.Broadcaster.CanEnterRoom(nickname) {
+			conn.Println("該昵稱已在聊天室中，請換一個")
+			continue
+		}
+
+		var token string
+		account, err := logic.Accounts.Get(nickname)
+		if err != nil {
+			return nil, err
+		}
+		if account != nil {
+			password, err := conn.Prompt("該昵稱已註冊，請輸入密碼：")
+			if err != nil {
+				return nil, err
+			}
+			if _, token, err = logic.Accounts.Login(nickname, password); err != nil {
+				conn.Println(err.Error())
+				continue
+			}
+		}
+
+		ident, err := logic.AuthenticateToken(token, nickname, allowGuest())
+		if err != nil {
+			conn.Println(err.Error())
+			continue
+		}
+		return ident, nil
+	}
+
+	return nil, errors.New("嘗試次數過多，再見！")
+}
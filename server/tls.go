@@ -0,0 +1,215 @@
+package server
+
+/*
+TLS：設定檔 tls.enable 為 true 時，聊天室在 tls.addr 上以 HTTPS（自動支持 HTTP/2）提供服務，
+並可在 tls.redirect-addr 上監聽 HTTP，把請求跳轉到 HTTPS。
+證書通過 GetCertificate 提供，證書文件變更（例如 certbot 續期）後自動重新加載，不需要重啟服務。
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rorast/go-chatroom/global"
+	"github.com/spf13/viper"
+)
+
+// ListenAndServe 啟動聊天室 HTTP 服務，啟用 TLS 時 addr 被 tls.addr 取代
+func ListenAndServe(addr string) error {
+	if !viper.GetBool("tls.enable") {
+		return http.ListenAndServe(addr, mux)
+	}
+
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	tlsAddr := viper.GetString("tls.addr")
+	if redirectAddr := viper.GetString("tls.redirect-addr"); redirectAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(redirectAddr, redirectHandler(tlsAddr)))
+		}()
+	}
+
+	srv := &http.Server{
+		Addr:      tlsAddr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	// 證書由 TLSConfig.GetCertificate 提供，這裡不需要傳入證書文件
+	return srv.ListenAndServeTLS("", "")
+}
+
+// newTLSConfig 根據設定檔創建 TLS 配置
+func newTLSConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(configPath("tls.cert-file"), configPath("tls.key-file"))
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	switch v := viper.GetString("tls.min-version"); v {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	case "1.1":
+		tlsConfig.MinVersion = tls.VersionTLS11
+	case "1.0":
+		tlsConfig.MinVersion = tls.VersionTLS10
+	default:
+		return nil, fmt.Errorf("unknown tls.min-version: %s", v)
+	}
+
+	switch v := viper.GetString("tls.client-auth"); v {
+	case "", "none":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "request":
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	case "verify-if-given":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown tls.client-auth: %s", v)
+	}
+
+	if tlsConfig.ClientAuth >= tls.VerifyClientCertIfGiven {
+		pem, err := os.ReadFile(configPath("tls.client-ca-file"))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in tls.client-ca-file")
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// redirectHandler 將 HTTP 請求跳轉到 tlsAddr 上的 HTTPS
+func redirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// configPath 讀取設定檔中的文件路徑，相對路徑基於項目根目錄
+func configPath(key string) string {
+	p := viper.GetString(key)
+	if p != "" && !filepath.IsAbs(p) {
+		p = filepath.Join(global.RootDir, p)
+	}
+	return p
+}
+
+// certReloader 持有當前使用的證書，證書或私鑰文件變更時重新加載
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// 監聽目錄而不是文件：證書更新工具通常以替換文件的方式寫入，直接監聽文件會丟失後續事件
+	dirs := map[string]struct{}{
+		filepath.Dir(certFile): {},
+		filepath.Dir(keyFile):  {},
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	go r.watch(watcher)
+
+	return r, nil
+}
+
+func (r *certReloader) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(event.Name)
+			if name != filepath.Clean(r.certFile) && name != filepath.Clean(r.keyFile) {
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			// 證書和私鑰可能不是同時寫完，加載失敗時保留舊證書，等待下一次變更
+			if err := r.reload(); err != nil {
+				log.Println("reload certificate error:", err)
+			} else {
+				log.Println("certificate reloaded:", r.certFile)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("certificate watcher error:", err)
+		}
+	}
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate 供 tls.Config 使用，每次握手時返回當前證書
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+/*
+附件上傳和下載：
+  - POST /upload：multipart 表單的 file 字段，返回附件的元數據；認證方式與進入聊天室相同，
+    但昵稱、token 等只能放在 URL 查詢參數或請求頭中，不讀取表單中的字段
+  - GET /files/{id}：附件內容；GET /files/{id}/thumb：圖片的縮略圖
+附件按內容編號，內容不會改變，因此下載不需要認證，並允許客戶端永久緩存。
+*/
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// multipart 表單中除文件之外的部分最多佔用的內存
+const uploadMemory = 1 << 20
+
+func uploadHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "只支持 POST 請求"})
+		return
+	}
+	if !logic.Attachments.Enabled() {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "附件功能未啟用"})
+		return
+	}
+
+	// 先只根據請求頭和 URL 查詢參數認證，未認證的請求不讀取請求體，避免緩存大量上傳內容
+	ident, err := authenticateWithoutBody(req)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, logic.Attachments.MaxSize()+uploadMemory)
+	if err := req.ParseMultipartForm(uploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": logic.ErrAttachmentTooLarge.Error()})
+		} else {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "請以 multipart/form-data 上傳文件"})
+		}
+		return
+	}
+	defer req.MultipartForm.RemoveAll()
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "缺少 file 字段"})
+		return
+	}
+	defer file.Close()
+
+	a, err := logic.Attachments.Upload(header.Filename, file)
+	switch {
+	case err == nil:
+	case errors.Is(err, logic.ErrAttachmentTooLarge):
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, logic.ErrAttachmentType):
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, logic.ErrAttachmentEmpty):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	default:
+		// 存儲的錯誤只記錄日誌，不返回給客戶端
+		log.Println("upload error:", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "上傳失敗，請稍後再試"})
+		return
+	}
+
+	log.Println("upload", a.ID, a.ContentType, a.Size, "by", ident.NickName)
+	writeJSON(w, http.StatusOK, a)
+}
+
+func fileHandleFunc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, suffix, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/files/"), "/")
+	thumb := suffix == "thumb"
+	if suffix != "" && !thumb {
+		http.NotFound(w, req)
+		return
+	}
+
+	etag := `"` + id + `"`
+	if thumb {
+		etag = `"` + id + `-thumb"`
+	}
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	r, a, err := logic.Attachments.Open(id, thumb)
+	if errors.Is(err, logic.ErrAttachmentNotFound) {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		log.Println("open attachment error:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer r.Close()
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if thumb {
+		h.Set("Content-Type", a.ThumbnailType())
+	} else {
+		h.Set("Content-Type", a.ContentType)
+		h.Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	}
+	// 圖片在瀏覽器中直接顯示，其他文件一律下載，避免上傳的文件在本站的源下執行
+	disposition := "attachment"
+	if a.IsImage() {
+		disposition = "inline"
+	}
+	h.Set("Content-Disposition", disposition+"; filename*=UTF-8''"+url.PathEscape(a.Name))
+
+	if req.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, r)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/spf13/viper"
+)
+
+// countingReader 記錄被讀取的字節數
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestUploadAuthenticatesBeforeReadingBody(t *testing.T) {
+	initAuthenticators()
+	viper.Set("attachments.store", "local")
+	viper.Set("attachments.local.dir", t.TempDir())
+	viper.Set("attachments.allowed-types", []string{"text/plain"})
+	t.Cleanup(func() {
+		viper.Set("attachments.store", nil)
+		viper.Set("attachments.local.dir", nil)
+		viper.Set("attachments.allowed-types", nil)
+	})
+	if err := logic.Attachments.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("nickname", "uploadguest")
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte(strings.Repeat("notes ", 1000)))
+	mw.Close()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		// 表單中的昵稱不用於認證，也不讀取請求體
+		{"credentials in the form", "", http.StatusUnauthorized},
+		{"credentials in the query", "?nickname=uploadguest", http.StatusOK},
+	}
+	for _, tt := range tests {
+		body := &countingReader{r: bytes.NewReader(form.Bytes())}
+		req := httptest.NewRequest(http.MethodPost, "/upload"+tt.query, body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		uploadHandleFunc(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+		if tt.status == http.StatusUnauthorized && body.n != 0 {
+			t.Errorf("%s: read %d bytes of the body before authentication", tt.name, body.n)
+		}
+	}
+}
@@ -1,68 +1,64 @@
 package server
 
 import (
-	"github.com/rorast/go-chatroom/logic"
 	"log"
 	"net/http"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/rorast/go-chatroom/logic"
+	"github.com/rorast/go-chatroom/transport"
+	"github.com/spf13/viper"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
+// gorillaUpgrader Origin 已經由 originAllowed 檢查過，這裡不再檢查
+var gorillaUpgrader = gorilla.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(*http.Request) bool { return true },
+}
+
 func websocketHandleFunc(w http.ResponseWriter, req *http.Request) {
-	// Accept 從客戶端接收 WebSocket 握手，升級 HTTP 請求到 WebSocket 請求
-	// 如果 Origin 域與主機不同，Accept 會拒絕請求，除非設置了 InsecureSkipVerify 選項(通過第三個參數 AcceptOption 進行設置)
-	// 默認不允許跨域請求。如果發生錯誤，Accept 將始終寫入適當的響應
-	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	// 跨域檢查：只允許同源或設定檔 allowed-origins 中的來源，防止任意網站借用訪客的瀏覽器連接聊天室
+	if !originAllowed(req) {
+		log.Println("websocket origin not allowed:", req.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	conn, err := acceptWebsocket(w, req)
 	if err != nil {
 		log.Println("websocket accept error:", err)
 		return
 	}
 
-	// 1. 創建用戶進來，構建用戶對象
-	token := req.FormValue("token")
-	nickname := req.FormValue("nickname")
-	if l := len(nickname); l < 2 || l > 20 {
-		log.Println("nickname illegal:", nickname)
-		wsjson.Write(req.Context(), conn, logic.NewErrorMessage("昵稱長度不合法，昵稱長度：2-20"))
-		conn.Close(websocket.StatusUnsupportedData, "nickname illegal")
+	// 1. 認證用戶身份，創建用戶進來，構建用戶對象
+	ident, err := authenticate(req)
+	if err != nil {
+		log.Println("authenticate error:", req.FormValue("nickname"), err)
+		rejectConn(req.Context(), conn, err)
 		return
 	}
 
-	userHasToken := logic.NewUser(conn, token, nickname, req.RemoteAddr)
-
-	// 2. 啟動用戶寫入數據的 goroutine
-	go userHasToken.SendMessage(req.Context())
-
-	// 3. 給當前用戶發送歡迎消息
-	userHasToken.MessageChannel <- logic.NewWelcomeMessage(userHasToken)
-
-	// 避免 token 泄露
-	tmpUser := *userHasToken
-	user := &tmpUser
-	user.Token = ""
-
-	// 發給所有用戶歡迎新用戶的進入
-	msg := logic.NewUserEnterMessage(user)
-	logic.Broadcaster.Broadcast(msg)
-
-	// 4. 將該用戶加入到廣播器的用戶列表中
-	logic.Broadcaster.UserEntering(user)
-	log.Println("user:", nickname, "joins chat")
-
-	// 5. 接收用戶消息
-	err = user.ReceiveMessage(req.Context())
+	serveConn(req.Context(), conn, ident, req.RemoteAddr, req.FormValue("ack") == "1", logic.DefaultRoom)
+}
 
-	// 6. 用戶離開
-	logic.Broadcaster.UserLeaving(user)
-	msg = logic.NewUserLeaveMessage(user)
-	logic.Broadcaster.Broadcast(msg)
-	log.Println("user:", nickname, "Leaves Chat")
+// acceptWebsocket 按設定檔 websocket.library 選擇 WebSocket 實現，完成握手
+func acceptWebsocket(w http.ResponseWriter, req *http.Request) (logic.Conn, error) {
+	if viper.GetString("websocket.library") == "gorilla" {
+		conn, err := gorillaUpgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return nil, err
+		}
+		return transport.NewGorillaConn(conn), nil
+	}
 
-	// 根據取到的錯誤執行同的 Close
-	if err == nil {
-		conn.Close(websocket.StatusNormalClosure, "")
-	} else {
-		log.Println("Read from client error:", err)
-		conn.Close(websocket.StatusInternalError, "Read from client error")
+	// Accept 從客戶端接收 WebSocket 握手，升級 HTTP 請求到 WebSocket 請求
+	// 如果 Origin 域與主機不同，Accept 會拒絕請求，除非設置了 InsecureSkipVerify 選項(通過第三個參數 AcceptOption 進行設置)
+	// 上面已經按 allowed-origins 檢查過 Origin，這裡跳過 Accept 自帶的同源檢查。如果發生錯誤，Accept 將始終寫入適當的響應
+	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
 	}
+	return transport.NewNhooyrConn(conn), nil
 }
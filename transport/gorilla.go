@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// 寫入關閉幀的超時時間
+const gorillaCloseTimeout = time.Second
+
+// gorillaConn 基於 github.com/gorilla/websocket 的連接，消息以 JSON 傳輸
+// gorilla 的連接不支持 context，讀寫時忽略 ctx
+type gorillaConn struct {
+	conn *websocket.Conn
+}
+
+// NewGorillaConn 包裝 gorilla/websocket 的連接
+func NewGorillaConn(conn *websocket.Conn) logic.Conn {
+	return &gorillaConn{conn: conn}
+}
+
+func (c *gorillaConn) ReadMessage(ctx context.Context) (map[string]string, error) {
+	var receiveMsg map[string]string
+	err := c.conn.ReadJSON(&receiveMsg)
+	if err != nil {
+		// 客戶端正常關閉連接，統一返回 io.EOF
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return receiveMsg, nil
+}
+
+func (c *gorillaConn) WriteMessage(ctx context.Context, msg *logic.Message) error {
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *gorillaConn) Close(code logic.CloseCode, reason string) error {
+	// WriteControl 可以與 WriteJSON 並發調用
+	data := websocket.FormatCloseMessage(int(websocketStatus(code)), reason)
+	c.conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(gorillaCloseTimeout))
+	return c.conn.Close()
+}
@@ -0,0 +1,413 @@
+package transport
+
+/*
+IRC 連接：把 IRC 客戶端的命令轉換為聊天室的客戶端消息，把聊天室消息轉換為 IRC 命令。
+IRC 頻道 #name 對應聊天室的房間 name。
+
+需要聊天室處理的命令（JOIN、PART、PRIVMSG、NICK、設置 TOPIC）由 ReadMessage 返回給 logic.User 處理，
+只讀的查詢（NAMES、WHO、查看 TOPIC）以及 PING 等協議命令直接在 ReadMessage 中回覆。
+*/
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// 單行命令的最大長度，RFC 1459 規定為 512 字節，這裡放寬以容納較長的中文消息
+const ircMaxLineLen = 4096
+
+// CTCP ACTION（/me）的前後綴
+const (
+	ctcpActionPrefix = "\x01ACTION "
+	ctcpDelim        = "\x01"
+)
+
+// IRCCommand 一條 IRC 命令
+type IRCCommand struct {
+	Command string
+	Params  []string
+}
+
+// Param 返回第 i 個參數，不存在時返回空字符串
+func (m *IRCCommand) Param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// ParseIRCCommand 解析一行 IRC 命令，客戶端發來的前綴會被忽略
+func ParseIRCCommand(line string) *IRCCommand {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	m := new(IRCCommand)
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param == "" {
+			continue
+		}
+		if m.Command == "" {
+			m.Command = strings.ToUpper(param)
+		} else {
+			m.Params = append(m.Params, param)
+		}
+	}
+	return m
+}
+
+// IRCConn IRC 客戶端連接
+type IRCConn struct {
+	conn        net.Conn
+	input       *bufio.Scanner
+	idleTimeout time.Duration
+	serverName  string
+
+	// 寫入可能同時來自讀取 goroutine（協議回覆）和寫入 goroutine（聊天消息）
+	mu   sync.Mutex
+	nick string
+
+	// 一條 JOIN / PART 命令可以包含多個頻道，尚未返回的部分暫存在這裡
+	pending []map[string]string
+}
+
+// NewIRCConn 包裝 TCP 連接，idleTimeout 為 0 時不限制空閒時間
+func NewIRCConn(conn net.Conn, serverName string, idleTimeout time.Duration) *IRCConn {
+	input := bufio.NewScanner(conn)
+	input.Buffer(make([]byte, 512), ircMaxLineLen)
+
+	return &IRCConn{
+		conn:        conn,
+		input:       input,
+		idleTimeout: idleTimeout,
+		serverName:  serverName,
+		nick:        "*",
+	}
+}
+
+// ReadCommand 讀取一條非空的 IRC 命令
+func (c *IRCConn) ReadCommand() (*IRCCommand, error) {
+	for {
+		if c.idleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+		if !c.input.Scan() {
+			if err := c.input.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		if m := ParseIRCCommand(c.input.Text()); m.Command != "" {
+			return m, nil
+		}
+	}
+}
+
+// Nick 當前昵稱，註冊完成前為 *
+func (c *IRCConn) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// SetNick 設置當前昵稱
+func (c *IRCConn) SetNick(nick string) {
+	c.mu.Lock()
+	c.nick = nick
+	c.mu.Unlock()
+}
+
+// Reply 以服務器的名義發送數字回覆，最後一個參數作為 trailing 參數
+func (c *IRCConn) Reply(numeric string, params ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLine(":"+c.serverName, numeric, append([]string{c.nick}, params...)...)
+}
+
+// Send 以服務器的名義發送命令，例如 PONG、CAP
+func (c *IRCConn) Send(command string, params ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLine(":"+c.serverName, command, params...)
+}
+
+// ircUnsafe 把 CR、LF 和 NUL 替換為空格：它們在 IRC 中表示一行的結束，
+// 如果出現在昵稱、消息內容等參數中，客戶端會把後面的內容當作另一條命令
+var ircUnsafe = strings.NewReplacer("\r", " ", "\n", " ", "\x00", " ")
+
+// writeLine 寫入一行命令，前綴和每個參數中的 CR、LF、NUL 都會被替換，調用者需持有 mu
+func (c *IRCConn) writeLine(prefix, command string, params ...string) error {
+	var b strings.Builder
+	b.WriteString(ircUnsafe.Replace(prefix))
+	b.WriteString(" ")
+	b.WriteString(command)
+	for i, param := range params {
+		b.WriteString(" ")
+		// 最後一個參數總是作為 trailing 參數，以便包含空格
+		if i == len(params)-1 {
+			b.WriteString(":")
+		}
+		b.WriteString(ircUnsafe.Replace(param))
+	}
+	b.WriteString("\r\n")
+
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// userPrefix 用戶的消息前綴 nick!user@host
+func (c *IRCConn) userPrefix(u *logic.User) string {
+	return fmt.Sprintf(":%s!u%d@%s", u.NickName, u.UID, c.serverName)
+}
+
+// ReadMessage 讀取下一條需要聊天室處理的消息，協議命令和只讀查詢在這裡直接回覆
+func (c *IRCConn) ReadMessage(ctx context.Context) (map[string]string, error) {
+	for {
+		if len(c.pending) > 0 {
+			msg := c.pending[0]
+			c.pending = c.pending[1:]
+			return msg, nil
+		}
+
+		m, err := c.ReadCommand()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.Command {
+		case "PING":
+			c.Send("PONG", m.Param(0))
+		case "PONG", "CAP":
+			// 註冊完成後不再處理能力協商
+		case "JOIN", "PART":
+			if len(m.Params) == 0 {
+				c.Reply("461", m.Command, "Not enough parameters")
+				continue
+			}
+			for _, channel := range strings.Split(m.Param(0), ",") {
+				room, ok := c.channelRoom(channel)
+				if !ok {
+					continue
+				}
+				c.pending = append(c.pending, map[string]string{
+					"type": strings.ToLower(m.Command),
+					"room": room,
+				})
+			}
+		case "PRIVMSG", "NOTICE":
+			if len(m.Params) < 2 || m.Param(1) == "" {
+				c.Reply("412", "No text to send")
+				continue
+			}
+			content := m.Param(1)
+			action := strings.HasPrefix(content, ctcpActionPrefix)
+			if action {
+				content = strings.TrimSuffix(content[len(ctcpActionPrefix):], ctcpDelim)
+			} else if strings.HasPrefix(content, ctcpDelim) {
+				// 其他 CTCP 請求（VERSION 等）不轉發到聊天室
+				continue
+			}
+
+			// 發給昵稱的是私聊
+			if !strings.HasPrefix(m.Param(0), "#") {
+				if action {
+					content = "* " + content
+				}
+				return map[string]string{"to": m.Param(0), "content": content}, nil
+			}
+
+			room, ok := c.channelRoom(m.Param(0))
+			if !ok {
+				continue
+			}
+			if action {
+				content = "/me " + content
+			}
+			return map[string]string{"room": room, "content": content}, nil
+		case "NICK":
+			if m.Param(0) == "" {
+				c.Reply("431", "No nickname given")
+				continue
+			}
+			return map[string]string{"content": "/nick " + m.Param(0)}, nil
+		case "TOPIC":
+			room, ok := c.channelRoom(m.Param(0))
+			if !ok {
+				continue
+			}
+			if len(m.Params) < 2 {
+				c.replyTopic(m.Param(0), logic.Broadcaster.Topic(room))
+				continue
+			}
+			return map[string]string{"room": room, "content": "/topic " + m.Param(1)}, nil
+		case "NAMES":
+			for _, channel := range strings.Split(m.Param(0), ",") {
+				if room, ok := c.channelRoom(channel); ok {
+					c.replyNames(channel, logic.Broadcaster.RoomMembers(room))
+				}
+			}
+		case "WHO":
+			if room, ok := c.channelRoom(m.Param(0)); ok {
+				for _, u := range logic.Broadcaster.RoomMembers(room) {
+					c.Reply("352", m.Param(0), fmt.Sprintf("u%d", u.UID), c.serverName, c.serverName, u.NickName, "H", "0 "+u.NickName)
+				}
+			}
+			c.Reply("315", m.Param(0), "End of WHO list")
+		case "MODE":
+			if strings.HasPrefix(m.Param(0), "#") {
+				c.Reply("324", m.Param(0), "+nt")
+			} else {
+				c.Reply("221", "+i")
+			}
+		case "USER", "PASS":
+			c.Reply("462", "You may not reregister")
+		case "QUIT":
+			return nil, io.EOF
+		default:
+			c.Reply("421", m.Command, "Unknown command")
+		}
+	}
+}
+
+// channelRoom 把 #name 轉換為房間名稱，不是頻道時回覆 403
+func (c *IRCConn) channelRoom(channel string) (string, bool) {
+	room := strings.TrimPrefix(channel, "#")
+	if !strings.HasPrefix(channel, "#") || logic.CheckRoomName(room) != nil {
+		c.Reply("403", channel, "No such channel")
+		return "", false
+	}
+	return room, true
+}
+
+func (c *IRCConn) replyTopic(channel, topic string) {
+	if topic == "" {
+		c.Reply("331", channel, "No topic is set")
+	} else {
+		c.Reply("332", channel, topic)
+	}
+}
+
+func (c *IRCConn) replyNames(channel string, members []*logic.User) {
+	nicknames := make([]string, 0, len(members))
+	for _, u := range members {
+		nicknames = append(nicknames, u.NickName)
+	}
+	sort.Strings(nicknames)
+
+	c.Reply("353", "=", channel, strings.Join(nicknames, " "))
+	c.Reply("366", channel, "End of NAMES list")
+}
+
+// WriteMessage 把聊天室消息轉換為 IRC 命令
+func (c *IRCConn) WriteMessage(ctx context.Context, msg *logic.Message) error {
+	if c.idleTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.idleTimeout))
+	}
+	channel := "#" + msg.Room
+
+	switch msg.Type {
+	case logic.MsgTypeWelcome:
+		c.SetNick(msg.User.NickName)
+		c.Reply("001", "Welcome to the chatroom IRC gateway "+msg.User.NickName)
+		c.Reply("002", "Your host is "+c.serverName)
+		c.Reply("003", "This server was created "+msg.MsgTime.Format(time.RFC1123))
+		c.Reply("004", c.serverName, "go-chatroom", "i", "nt")
+		return c.Reply("422", "MOTD File is missing")
+	case logic.MsgTypeNormal:
+		if msg.To != "" {
+			// IRC 客戶端自己會顯示發出的私聊
+			if msg.User.NickName == c.Nick() {
+				return nil
+			}
+			return c.sendLines(c.userPrefix(msg.User), "PRIVMSG", msg.To, msg.Content)
+		}
+		return c.sendLines(c.userPrefix(msg.User), "PRIVMSG", channel, msg.ContentWithAttachments())
+	case logic.MsgTypeReaction:
+		target := channel
+		if msg.To != "" {
+			target = msg.To
+		}
+		return c.sendLines(c.userPrefix(msg.User), "NOTICE", target, "回應了 "+msg.Content)
+	case logic.MsgTypeAction:
+		// IRC 客戶端自己會顯示發出的動作
+		if msg.User.NickName == c.Nick() {
+			return nil
+		}
+		return c.sendLines(c.userPrefix(msg.User), "PRIVMSG", channel, ctcpActionPrefix+msg.Content+ctcpDelim)
+	case logic.MsgTypeUserEnter:
+		return c.sendLines(c.userPrefix(msg.User), "JOIN", channel)
+	case logic.MsgTypeRoomJoined:
+		c.sendLines(c.userPrefix(msg.User), "JOIN", channel)
+		c.replyTopic(channel, msg.Content)
+		c.replyNames(channel, msg.Users)
+		if msg.Unread > 0 {
+			c.sendLines(":"+c.serverName, "NOTICE", channel, fmt.Sprintf("%d 條未讀消息", msg.Unread))
+		}
+		return nil
+	case logic.MsgTypeUserLeave:
+		if msg.Room == "" {
+			return c.sendLines(c.userPrefix(msg.User), "QUIT", "Quit")
+		}
+		return c.sendLines(c.userPrefix(msg.User), "PART", channel)
+	case logic.MsgTypeUserRename:
+		oldUser := *msg.User
+		oldUser.NickName = msg.OldNickName
+		if msg.OldNickName == c.Nick() {
+			c.SetNick(msg.User.NickName)
+		}
+		return c.sendLines(c.userPrefix(&oldUser), "NICK", msg.User.NickName)
+	case logic.MsgTypeTopic:
+		return c.sendLines(c.userPrefix(msg.User), "TOPIC", channel, msg.Content)
+	case logic.MsgTypeError, logic.MsgTypeCommand:
+		return c.sendLines(":"+c.serverName, "NOTICE", c.Nick(), msg.Content)
+	}
+
+	// 其他消息（例如 token、@ 提醒）對 IRC 客戶端沒有意義，IRC 客戶端會自己高亮提到自己的消息
+	return nil
+}
+
+// sendLines 發送命令，最後一個參數中的換行拆成多條命令
+func (c *IRCConn) sendLines(prefix, command string, params ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(params) == 0 {
+		return c.writeLine(prefix, command)
+	}
+
+	// 多行內容拆成多條命令發送，其餘的控制字符由 writeLine 替換
+	last := len(params) - 1
+	for _, line := range strings.Split(params[last], "\n") {
+		line = strings.TrimRight(line, "\r")
+		if err := c.writeLine(prefix, command, append(params[:last:last], line)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 發送 ERROR 後關閉連接
+func (c *IRCConn) Close(code logic.CloseCode, reason string) error {
+	if reason == "" {
+		reason = "Closing link"
+	}
+	c.Send("ERROR", reason)
+	return c.conn.Close()
+}
@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseIRCCommand(t *testing.T) {
+	m := ParseIRCCommand(":nick!user@host PRIVMSG #lobby :hello there")
+	if m.Command != "PRIVMSG" || m.Param(0) != "#lobby" || m.Param(1) != "hello there" {
+		t.Errorf("parsed %+v", m)
+	}
+	if m.Param(2) != "" {
+		t.Errorf("Param(2) = %q, want empty", m.Param(2))
+	}
+}
+
+func TestIRCWriteLineSanitizes(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	c := NewIRCConn(server, "test", 0)
+	go func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.writeLine(":evil\r\nQUIT", "PRIVMSG", "#lob\x00by", "a\rb\nc")
+	}()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ":evil  QUIT PRIVMSG #lob by :a b c\r\n"; line != want {
+		t.Errorf("writeLine = %q, want %q", line, want)
+	}
+}
@@ -0,0 +1,124 @@
+package transport
+
+/*
+行模式的文本連接：用於 telnet / nc 等終端客戶端，每行輸入一條消息，
+收到的消息格式化為一行文本輸出。
+*/
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+// LineConn 行模式的 TCP 連接
+type LineConn struct {
+	conn        net.Conn
+	input       *bufio.Scanner
+	idleTimeout time.Duration
+}
+
+// NewLineConn 包裝 TCP 連接，idleTimeout 為 0 時不限制空閒時間
+func NewLineConn(conn net.Conn, idleTimeout time.Duration) *LineConn {
+	return &LineConn{
+		conn:        conn,
+		input:       bufio.NewScanner(conn),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// ReadLine 讀取一行輸入，去掉 telnet 的 \r
+func (c *LineConn) ReadLine() (string, error) {
+	if c.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+	if !c.input.Scan() {
+		if err := c.input.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return strings.TrimRight(c.input.Text(), "\r"), nil
+}
+
+// Prompt 輸出提示並讀取一行輸入
+func (c *LineConn) Prompt(prompt string) (string, error) {
+	fmt.Fprint(c.conn, prompt)
+	line, err := c.ReadLine()
+	return strings.TrimSpace(line), err
+}
+
+// Println 直接輸出一行文本
+func (c *LineConn) Println(text string) {
+	fmt.Fprintln(c.conn, text)
+}
+
+// ReadMessage 讀取一行非空輸入作為消息內容
+func (c *LineConn) ReadMessage(ctx context.Context) (map[string]string, error) {
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) != "" {
+			return map[string]string{"content": line}, nil
+		}
+	}
+}
+
+func (c *LineConn) WriteMessage(ctx context.Context, msg *logic.Message) error {
+	line := FormatTextMessage(msg)
+	if line == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(c.conn, line)
+	return err
+}
+
+func (c *LineConn) Close(code logic.CloseCode, reason string) error {
+	if reason != "" {
+		fmt.Fprintln(c.conn, reason)
+	}
+	return c.conn.Close()
+}
+
+// FormatTextMessage 將消息格式化為一行文本，多行內容的後續行會縮進
+func FormatTextMessage(msg *logic.Message) string {
+	content := strings.ReplaceAll(msg.ContentWithAttachments(), "\n", "\n    ")
+	t := msg.MsgTime.Format("15:04:05")
+
+	switch msg.Type {
+	case logic.MsgTypeNormal:
+		if msg.To != "" {
+			return fmt.Sprintf("[%s] %s → %s: %s", t, msg.User.NickName, msg.To, content)
+		}
+		return fmt.Sprintf("[%s] %s: %s", t, msg.User.NickName, content)
+	case logic.MsgTypeReaction:
+		return fmt.Sprintf("[%s] * %s 回應了 %s", t, msg.User.NickName, content)
+	case logic.MsgTypeAction:
+		return fmt.Sprintf("[%s] * %s %s", t, msg.User.NickName, content)
+	case logic.MsgTypeError:
+		return fmt.Sprintf("[%s] !! %s", t, content)
+	case logic.MsgTypeTopic:
+		return fmt.Sprintf("[%s] *** %s 將話題設置為：%s", t, msg.User.NickName, content)
+	case logic.MsgTypeHighlight:
+		return fmt.Sprintf("[%s] *** %s 在房間 %s 中提到了您", t, msg.User.NickName, msg.Room)
+	case logic.MsgTypeRoomJoined:
+		// 房間成員列表對終端用戶沒有意義，只提示未讀數量
+		if msg.Unread > 0 {
+			return fmt.Sprintf("[%s] *** 房間 %s 有 %d 條未讀消息", t, msg.Room, msg.Unread)
+		}
+		return ""
+	case logic.MsgTypeToken, logic.MsgTypeRead:
+		// token 和已讀回執對終端用戶沒有意義
+		return ""
+	default:
+		return fmt.Sprintf("[%s] *** %s", t, content)
+	}
+}
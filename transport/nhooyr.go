@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/rorast/go-chatroom/logic"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// nhooyrConn 基於 nhooyr.io/websocket 的連接，消息以 JSON 傳輸
+type nhooyrConn struct {
+	conn *websocket.Conn
+}
+
+// NewNhooyrConn 包裝 nhooyr.io/websocket 的連接
+func NewNhooyrConn(conn *websocket.Conn) logic.Conn {
+	return &nhooyrConn{conn: conn}
+}
+
+func (c *nhooyrConn) ReadMessage(ctx context.Context) (map[string]string, error) {
+	// 每次讀取都使用新的 map，避免上一條消息的字段殘留
+	var receiveMsg map[string]string
+	err := wsjson.Read(ctx, c.conn, &receiveMsg)
+	if err != nil {
+		// 客戶端正常關閉連接，統一返回 io.EOF
+		var closeErr websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return receiveMsg, nil
+}
+
+func (c *nhooyrConn) WriteMessage(ctx context.Context, msg *logic.Message) error {
+	return wsjson.Write(ctx, c.conn, msg)
+}
+
+func (c *nhooyrConn) Close(code logic.CloseCode, reason string) error {
+	return c.conn.Close(websocketStatus(code), reason)
+}
+
+// websocketStatus 將關閉原因映射為 WebSocket 關閉碼（RFC 6455），gorilla 使用同樣的數值
+func websocketStatus(code logic.CloseCode) websocket.StatusCode {
+	switch code {
+	case logic.ClosePolicyViolation:
+		return websocket.StatusPolicyViolation
+	case logic.CloseInternalError:
+		return websocket.StatusInternalError
+	default:
+		return websocket.StatusNormalClosure
+	}
+}
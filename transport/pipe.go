@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+var errPipeClosed = errors.New("pipe closed")
+
+// Pipe 內存中的連接，一端作為 logic.Conn 交給 User，另一端由測試或進程內的客戶端使用
+//
+//	服務端：ReadMessage / WriteMessage / Close（實現 logic.Conn）
+//	客戶端：Send / Receive / CloseClient
+type Pipe struct {
+	toServer chan map[string]string
+	toClient chan *logic.Message
+
+	once   sync.Once
+	closed chan struct{}
+	// 服務端關閉時的原因
+	CloseCode   logic.CloseCode
+	CloseReason string
+}
+
+// NewPipe 創建內存連接，buffer 為兩個方向的緩衝大小
+func NewPipe(buffer int) *Pipe {
+	return &Pipe{
+		toServer: make(chan map[string]string, buffer),
+		toClient: make(chan *logic.Message, buffer),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (p *Pipe) ReadMessage(ctx context.Context) (map[string]string, error) {
+	select {
+	case msg := <-p.toServer:
+		return msg, nil
+	case <-p.closed:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pipe) WriteMessage(ctx context.Context, msg *logic.Message) error {
+	if p.isClosed() {
+		return errPipeClosed
+	}
+	select {
+	case p.toClient <- msg:
+		return nil
+	case <-p.closed:
+		return errPipeClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pipe) Close(code logic.CloseCode, reason string) error {
+	p.once.Do(func() {
+		p.CloseCode = code
+		p.CloseReason = reason
+		close(p.closed)
+	})
+	return nil
+}
+
+// isClosed 連接是否已關閉；緩衝區有空位時 select 會隨機選擇，所以寫入前要先單獨檢查
+func (p *Pipe) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send 客戶端發送一條消息
+func (p *Pipe) Send(ctx context.Context, msg map[string]string) error {
+	if p.isClosed() {
+		return errPipeClosed
+	}
+	select {
+	case p.toServer <- msg:
+		return nil
+	case <-p.closed:
+		return errPipeClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Receive 客戶端接收一條消息，連接關閉且沒有未讀消息時返回 io.EOF
+func (p *Pipe) Receive(ctx context.Context) (*logic.Message, error) {
+	select {
+	case msg := <-p.toClient:
+		return msg, nil
+	case <-p.closed:
+		// 關閉前寫入的消息仍然可以讀到
+		select {
+		case msg := <-p.toClient:
+			return msg, nil
+		default:
+			return nil, io.EOF
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CloseClient 客戶端關閉連接，服務端的 ReadMessage 會返回 io.EOF
+func (p *Pipe) CloseClient() {
+	p.Close(logic.CloseNormal, "")
+}
@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+func TestPipeRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	p := NewPipe(1)
+	if err := p.Send(ctx, map[string]string{"content": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.ReadMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["content"] != "hello" {
+		t.Errorf("ReadMessage = %v, want content hello", got)
+	}
+
+	msg := &logic.Message{Content: "world"}
+	if err = p.WriteMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.Receive(ctx); err != nil || got != msg {
+		t.Errorf("Receive = %v, %v, want %v", got, err, msg)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	p := NewPipe(1)
+	msg := &logic.Message{Content: "bye"}
+	if err := p.WriteMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	p.Close(logic.ClosePolicyViolation, "kicked")
+	p.Close(logic.CloseNormal, "")
+
+	if p.CloseCode != logic.ClosePolicyViolation || p.CloseReason != "kicked" {
+		t.Errorf("close = %v %q, want the first close to win", p.CloseCode, p.CloseReason)
+	}
+	if _, err := p.ReadMessage(ctx); !errors.Is(err, io.EOF) {
+		t.Errorf("ReadMessage after close = %v, want io.EOF", err)
+	}
+	if err := p.WriteMessage(ctx, msg); !errors.Is(err, errPipeClosed) {
+		t.Errorf("WriteMessage after close = %v, want errPipeClosed", err)
+	}
+	if err := p.Send(ctx, map[string]string{}); !errors.Is(err, errPipeClosed) {
+		t.Errorf("Send after close = %v, want errPipeClosed", err)
+	}
+
+	// 關閉前寫入的消息仍然可以讀到，之後返回 io.EOF
+	if got, err := p.Receive(ctx); err != nil || got != msg {
+		t.Errorf("Receive = %v, %v, want the message written before close", got, err)
+	}
+	if _, err := p.Receive(ctx); !errors.Is(err, io.EOF) {
+		t.Errorf("Receive = %v, want io.EOF", err)
+	}
+}
+
+func TestPipeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := NewPipe(0)
+	if _, err := p.ReadMessage(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadMessage = %v, want context.Canceled", err)
+	}
+	if _, err := p.Receive(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Receive = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,142 @@
+package transport
+
+/*
+Server-Sent Events 連接：服務端到客戶端的消息通過 text/event-stream 推送，
+客戶端到服務端的消息通過另外的 HTTP POST 請求送達，再由 Deliver 交給連接。
+用於 WebSocket 被代理阻斷的環境。
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/rorast/go-chatroom/logic"
+)
+
+var errSSEClosed = errors.New("sse connection closed")
+
+// SSEConn 基於 Server-Sent Events 的連接
+type SSEConn struct {
+	// 寫入響應時加鎖：消息與保活註釋可能在不同的 goroutine 中寫入
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+
+	inbound chan map[string]string
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+// NewSSEConn 設置 event-stream 響應頭並創建連接，ResponseWriter 不支持 Flush 時返回錯誤
+func NewSSEConn(w http.ResponseWriter) (*SSEConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// 關閉 nginx 的響應緩衝
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &SSEConn{
+		w:       w,
+		flusher: flusher,
+		inbound: make(chan map[string]string, 16),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// Deliver 將客戶端通過 POST 發來的消息交給連接
+func (c *SSEConn) Deliver(ctx context.Context, msg map[string]string) error {
+	select {
+	case c.inbound <- msg:
+		return nil
+	case <-c.closed:
+		return errSSEClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// KeepAlive 寫入一條 SSE 註釋，避免代理因為空閒而斷開連接
+func (c *SSEConn) KeepAlive() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isClosed() {
+		return errSSEClosed
+	}
+	if _, err := io.WriteString(c.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Done 連接關閉時被關閉
+func (c *SSEConn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// ReadMessage 等待客戶端 POST 的消息；請求結束（客戶端斷開）時返回 io.EOF
+func (c *SSEConn) ReadMessage(ctx context.Context) (map[string]string, error) {
+	select {
+	case msg := <-c.inbound:
+		return msg, nil
+	case <-c.closed:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (c *SSEConn) WriteMessage(ctx context.Context, msg *logic.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isClosed() {
+		return errSSEClosed
+	}
+	if _, err = fmt.Fprintf(c.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Close 結束連接，之後不再寫入響應；handler 返回後響應才會真正結束
+func (c *SSEConn) Close(code logic.CloseCode, reason string) error {
+	// 加鎖等待正在進行的寫入完成，避免 handler 返回後仍然寫入 ResponseWriter
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *SSEConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}